@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"errors"
 	"io/ioutil"
 	"os"
@@ -14,6 +16,7 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/spf13/viper"
 	"github.com/centrifugal/centrifugo/libcentrifugo"
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
 )
 
 // newConfig creates new libcentrifugo.Config using viper.
@@ -57,15 +60,29 @@ func newConfig() *libcentrifugo.Config {
 	cfg.ExpiredConnectionCloseDelay = time.Duration(viper.GetInt("expired_connection_close_delay")) * time.Second
 	cfg.StaleConnectionCloseDelay = time.Duration(viper.GetInt("stale_connection_close_delay")) * time.Second
 	cfg.ClientRequestMaxSize = viper.GetInt("client_request_max_size")
+	cfg.WebsocketCompression = viper.GetBool("websocket_compression")
+	cfg.WebsocketCompressionLevel = viper.GetInt("websocket_compression_level")
+	cfg.WebsocketCompressionMinSize = viper.GetInt("websocket_compression_min_size")
 	cfg.ClientQueueMaxSize = viper.GetInt("client_queue_max_size")
 	cfg.ClientQueueInitialCapacity = viper.GetInt("client_queue_initial_capacity")
 	cfg.ClientChannelLimit = viper.GetInt("client_channel_limit")
+	cfg.ClientMessageBatching = viper.GetBool("client_message_batching")
+	cfg.ClientMessageBatchMaxSize = viper.GetInt("client_message_batch_max_size")
 	cfg.Insecure = viper.GetBool("insecure")
 	cfg.InsecureAPI = viper.GetBool("insecure_api")
 	cfg.InsecureAdmin = viper.GetBool("insecure_admin") || viper.GetBool("insecure_web")
 
-	cfg.Secret = viper.GetString("secret")
+	cfg.Secret, cfg.SecretID, cfg.Secrets = secretsFromConfig(viper.GetString("secret"))
+	cfg.GRPCAPIKey = viper.GetString("grpc_api_key")
+	cfg.TokenRSAPublicKey, cfg.TokenECDSAPublicKey = tokenPublicKeysFromConfig()
 	cfg.ConnLifetime = int64(viper.GetInt("connection_lifetime"))
+	cfg.ConnectProxyEndpoint = viper.GetString("connect_proxy_endpoint")
+	cfg.ConnectProxyTimeout = time.Duration(viper.GetInt("connect_proxy_timeout")) * time.Second
+	cfg.PublishProxyEndpoint = viper.GetString("publish_proxy_endpoint")
+	cfg.PublishProxyTimeout = time.Duration(viper.GetInt("publish_proxy_timeout")) * time.Second
+	cfg.SubscribeProxyEndpoint = viper.GetString("subscribe_proxy_endpoint")
+	cfg.SubscribeProxyTimeout = time.Duration(viper.GetInt("subscribe_proxy_timeout")) * time.Second
+	cfg.ProxyHeaders = viper.GetStringSlice("proxy_headers")
 
 	cfg.Watch = viper.GetBool("watch")
 	cfg.Publish = viper.GetBool("publish")
@@ -76,11 +93,84 @@ func newConfig() *libcentrifugo.Config {
 	cfg.HistoryLifetime = viper.GetInt("history_lifetime")
 	cfg.HistoryDropInactive = viper.GetBool("history_drop_inactive")
 	cfg.Recover = viper.GetBool("recover")
+	cfg.PublishProxy = viper.GetBool("publish_proxy")
+	cfg.SubscribeProxy = viper.GetBool("subscribe_proxy")
 	cfg.Namespaces = namespacesFromConfig(nil)
 
 	return cfg
 }
 
+// tokenPublicKeysFromConfig parses PEM encoded public keys used to verify RS256 and
+// ES256 client JWTs. Key which can not be parsed is logged and left unset so tokens
+// signed with corresponding algorithm will be rejected.
+func tokenPublicKeysFromConfig() (*rsa.PublicKey, *ecdsa.PublicKey) {
+	var rsaKey *rsa.PublicKey
+	var ecdsaKey *ecdsa.PublicKey
+	var err error
+	if pemData := viper.GetString("token_rsa_public_key"); pemData != "" {
+		rsaKey, err = auth.ParseRSAPublicKey([]byte(pemData))
+		if err != nil {
+			logger.CRITICAL.Printf("Error parsing token_rsa_public_key: %v", err)
+		}
+	}
+	if pemData := viper.GetString("token_ecdsa_public_key"); pemData != "" {
+		ecdsaKey, err = auth.ParseECDSAPublicKey([]byte(pemData))
+		if err != nil {
+			logger.CRITICAL.Printf("Error parsing token_ecdsa_public_key: %v", err)
+		}
+	}
+	return rsaKey, ecdsaKey
+}
+
+// secretConfig is a single entry of "secrets" configuration option.
+type secretConfig struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret"`
+	Primary bool   `json:"primary"`
+}
+
+// secretsFromConfig parses "secrets" option used for secret key rotation. Secret
+// marked as primary (or the first one if "secret" option not set) is used instead
+// of "secret" option value, all others are only used to check signatures. As
+// configuration reloaded on SIGHUP secrets can be rotated without restart.
+func secretsFromConfig(secret string) (string, string, []auth.Secret) {
+	secrets := []auth.Secret{}
+	if !viper.IsSet("secrets") {
+		return secret, "", secrets
+	}
+	entries := []secretConfig{}
+	err := viper.MarshalKey("secrets", &entries)
+	if err != nil {
+		logger.CRITICAL.Printf("Error parsing secrets: %v", err)
+		return secret, "", secrets
+	}
+	primary := -1
+	for i, entry := range entries {
+		if entry.Primary {
+			primary = i
+			break
+		}
+	}
+	if primary == -1 && secret == "" && len(entries) > 0 {
+		primary = 0
+	}
+	var secretID string
+	for i, entry := range entries {
+		if i == primary {
+			continue
+		}
+		secrets = append(secrets, auth.Secret{ID: entry.ID, Key: entry.Secret})
+	}
+	if primary != -1 {
+		if secret != "" {
+			// keep accepting previous primary secret.
+			secrets = append(secrets, auth.Secret{Key: secret})
+		}
+		secret, secretID = entries[primary].Secret, entries[primary].ID
+	}
+	return secret, secretID, secrets
+}
+
 // getApplicationName returns a name for this node. If no name provided
 // in configuration then it constructs node name based on hostname and port
 func getApplicationName() string {
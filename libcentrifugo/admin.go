@@ -200,7 +200,7 @@ func (c *adminClient) infoCmd() (*response, error) {
 	defer c.app.RUnlock()
 	resp := newResponse("info")
 	resp.Body = map[string]interface{}{
-		"engine": c.app.engine.name(),
+		"engine": c.app.engine.Name(),
 		"config": c.app.config,
 	}
 	return resp, nil
@@ -2,23 +2,38 @@ package libcentrifugo
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/FZambia/go-logger"
 )
 
 // apiCmd builds API command and dispatches it into correct handler method.
 func (app *Application) apiCmd(command apiCommand) (*response, error) {
+	resp, err := app.decodeAPICmd(command.Method, command.Params, json.Unmarshal)
+	if err != nil {
+		return nil, err
+	}
+	resp.UID = command.UID
+	return resp, nil
+}
+
+// paramsDecoder decodes API command params into command struct pointer.
+type paramsDecoder func(params []byte, cmd interface{}) error
+
+// decodeAPICmd decodes API command params using provided decoder and dispatches
+// command into correct handler method. This allows to share API semantics between
+// JSON and Protocol Buffers API transports.
+func (app *Application) decodeAPICmd(method string, params []byte, decode paramsDecoder) (*response, error) {
 
 	var err error
 	var resp *response
 
-	method := command.Method
-	params := command.Params
+	defer app.metrics.APICommandTimes.ObserveSince(method, time.Now())
 
 	switch method {
 	case "publish":
 		var cmd publishAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
@@ -26,15 +41,23 @@ func (app *Application) apiCmd(command apiCommand) (*response, error) {
 		resp, err = app.publishCmd(&cmd)
 	case "broadcast":
 		var cmd broadcastAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
 		}
 		resp, err = app.broadcastCmd(&cmd)
+	case "subscribe":
+		var cmd subscribeAPICommand
+		err = decode(params, &cmd)
+		if err != nil {
+			logger.ERROR.Println(err)
+			return nil, ErrInvalidMessage
+		}
+		resp, err = app.subscribeCmd(&cmd)
 	case "unsubscribe":
 		var cmd unsubscribeAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
@@ -42,7 +65,7 @@ func (app *Application) apiCmd(command apiCommand) (*response, error) {
 		resp, err = app.unsubcribeCmd(&cmd)
 	case "disconnect":
 		var cmd disconnectAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
@@ -50,7 +73,7 @@ func (app *Application) apiCmd(command apiCommand) (*response, error) {
 		resp, err = app.disconnectCmd(&cmd)
 	case "presence":
 		var cmd presenceAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
@@ -58,7 +81,7 @@ func (app *Application) apiCmd(command apiCommand) (*response, error) {
 		resp, err = app.presenceCmd(&cmd)
 	case "history":
 		var cmd historyAPICommand
-		err = json.Unmarshal(params, &cmd)
+		err = decode(params, &cmd)
 		if err != nil {
 			logger.ERROR.Println(err)
 			return nil, ErrInvalidMessage
@@ -77,8 +100,6 @@ func (app *Application) apiCmd(command apiCommand) (*response, error) {
 		return nil, err
 	}
 
-	resp.UID = command.UID
-
 	return resp, nil
 }
 
@@ -125,6 +146,18 @@ func (app *Application) broadcastCmd(cmd *broadcastAPICommand) (*response, error
 	return resp, nil
 }
 
+// subscribeCmd subscribes project's user on channel and sends subscribe
+// control message to other nodes.
+func (app *Application) subscribeCmd(cmd *subscribeAPICommand) (*response, error) {
+	resp := newResponse("subscribe")
+	err := app.Subscribe(cmd.User, cmd.Channel)
+	if err != nil {
+		resp.Err(err)
+		return resp, nil
+	}
+	return resp, nil
+}
+
 // unsubscribeCmd unsubscribes project's user from channel and sends
 // unsubscribe control message to other nodes.
 func (app *Application) unsubcribeCmd(cmd *unsubscribeAPICommand) (*response, error) {
@@ -177,7 +210,12 @@ func (app *Application) historyCmd(cmd *historyAPICommand) (*response, error) {
 		Channel: channel,
 	}
 	resp.Body = body
-	history, err := app.History(channel)
+	opts, err := newHistoryOptions(cmd.Since, cmd.Limit, cmd.Direction)
+	if err != nil {
+		resp.Err(err)
+		return resp, nil
+	}
+	history, err := app.history(channel, opts)
 	if err != nil {
 		resp.Err(err)
 		return resp, nil
@@ -48,6 +48,21 @@ func TestAPICmd(t *testing.T) {
 	_, err = app.apiCmd(cmd)
 	assert.Equal(t, ErrInvalidMessage, err)
 
+	cmd = apiCommand{
+		Method: "subscribe",
+		Params: []byte("{}"),
+	}
+	resp, err = app.apiCmd(cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInvalidMessage, resp.err)
+
+	cmd = apiCommand{
+		Method: "subscribe",
+		Params: []byte("test"),
+	}
+	_, err = app.apiCmd(cmd)
+	assert.Equal(t, ErrInvalidMessage, err)
+
 	cmd = apiCommand{
 		Method: "unsubscribe",
 		Params: []byte("{}"),
@@ -176,6 +191,25 @@ func TestAPIBroadcast(t *testing.T) {
 	assert.Equal(t, ErrInvalidMessage, resp.err)
 }
 
+func TestAPISubscribe(t *testing.T) {
+	app := testApp()
+	cmd := &subscribeAPICommand{
+		User:    "test user",
+		Channel: "channel",
+	}
+	resp, err := app.subscribeCmd(cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.err)
+
+	cmd = &subscribeAPICommand{
+		User:    "test user",
+		Channel: "nonexistentnamespace:channel",
+	}
+	resp, err = app.subscribeCmd(cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrNamespaceNotFound, resp.err)
+}
+
 func TestAPIUnsubscribe(t *testing.T) {
 	app := testApp()
 	cmd := &unsubscribeAPICommand{
@@ -224,6 +258,34 @@ func TestAPIHistory(t *testing.T) {
 	resp, err := app.historyCmd(cmd)
 	assert.Equal(t, nil, err)
 	assert.Equal(t, nil, resp.err)
+
+	cmd = &historyAPICommand{
+		Channel:   "channel",
+		Direction: "sideways",
+	}
+	resp, err = app.historyCmd(cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInvalidMessage, resp.err)
+}
+
+func TestAPIHistoryPaging(t *testing.T) {
+	c := newTestConfig()
+	c.HistorySize = 10
+	c.HistoryLifetime = 60
+	app := testMemoryAppWithConfig(&c)
+	for i := 0; i < 3; i++ {
+		err := app.Publish(Channel("channel"), []byte("{}"), "", nil)
+		assert.Equal(t, nil, err)
+	}
+	resp, err := app.historyCmd(&historyAPICommand{
+		Channel:   "channel",
+		Since:     1,
+		Limit:     1,
+		Direction: "forward",
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.err)
+	assert.Equal(t, []uint64{2}, testHistorySeqs(resp.Body.(*HistoryBody).Data))
 }
 
 func TestAPIChannels(t *testing.T) {
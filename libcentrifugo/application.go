@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/FZambia/go-logger"
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
 	"github.com/gorilla/securecookie"
 	"github.com/satori/go.uuid"
 )
@@ -89,7 +90,7 @@ func NewApplication(config *Config) (*Application, error) {
 		admins:     newAdminHub(),
 		nodes:      make(map[string]NodeInfo),
 		started:    time.Now().Unix(),
-		metrics:    &metricsRegistry{},
+		metrics:    newMetricsRegistry(),
 		chIDPrefix: config.ChannelPrefix + channelIDClientSuffix,
 	}
 	return app, nil
@@ -98,7 +99,7 @@ func NewApplication(config *Config) (*Application, error) {
 // Run performs all startup actions. At moment must be called once on start after engine and
 // structure set.
 func (app *Application) Run() error {
-	if err := app.engine.run(); err != nil {
+	if err := app.engine.Run(); err != nil {
 		return err
 	}
 	go app.sendNodePingMsg()
@@ -196,7 +197,7 @@ func (app *Application) channels() ([]Channel, error) {
 	controlChID := app.config.ControlChannel
 	adminChID := app.config.AdminChannel
 	app.RUnlock()
-	chIDs, err := app.engine.channels()
+	chIDs, err := app.engine.Channels()
 	if err != nil {
 		return []Channel{}, err
 	}
@@ -243,9 +244,10 @@ func (app *Application) node() NodeInfo {
 	return info
 }
 
-// handleMsg called when new message of any type received by this node.
-// It looks at channel and decides which message handler to call.
-func (app *Application) handleMsg(chID ChannelID, message []byte) error {
+// HandleMsg called when new message of any type received by this node.
+// It looks at channel and decides which message handler to call. Engines
+// must call it for every message received from channels they subscribed on.
+func (app *Application) HandleMsg(chID ChannelID, message []byte) error {
 	switch chID {
 	case app.config.ControlChannel:
 		return app.controlMsg(message)
@@ -285,6 +287,14 @@ func (app *Application) controlMsg(message []byte) error {
 			return ErrInvalidMessage
 		}
 		return app.pingCmd(&cmd)
+	case "subscribe":
+		var cmd subscribeControlCommand
+		err := json.Unmarshal(*params, &cmd)
+		if err != nil {
+			logger.ERROR.Println(err)
+			return ErrInvalidMessage
+		}
+		return app.subscribeUser(cmd.User, cmd.Channel)
 	case "unsubscribe":
 		var cmd unsubscribeControlCommand
 		err := json.Unmarshal(*params, &cmd)
@@ -340,7 +350,7 @@ func (app *Application) pubControl(method string, params []byte) error {
 	app.RLock()
 	controlChannel := app.config.ControlChannel
 	app.RUnlock()
-	return <-app.engine.publish(controlChannel, messageBytes, nil)
+	return <-app.engine.Publish(controlChannel, messageBytes, nil)
 }
 
 // Publish sends a message to all clients subscribed on channel with provided data, client and ClientInfo.
@@ -431,12 +441,12 @@ func (app *Application) pubClient(ch Channel, chOpts ChannelOptions, data []byte
 		app.RUnlock()
 		// No error handling because we can not block to wait
 		// for publish error here.
-		app.engine.publish(adminChannel, byteMessage, nil)
+		app.engine.Publish(adminChannel, byteMessage, nil)
 	}
 
 	chID := app.channelID(ch)
 
-	pubOpts := &publishOpts{
+	pubOpts := &PublishOptions{
 		Message:             message,
 		HistorySize:         chOpts.HistorySize,
 		HistoryLifetime:     chOpts.HistoryLifetime,
@@ -445,7 +455,7 @@ func (app *Application) pubClient(ch Channel, chOpts ChannelOptions, data []byte
 
 	app.metrics.NumMsgPublished.Inc()
 
-	return app.engine.publish(chID, byteMessage, pubOpts)
+	return app.engine.Publish(chID, byteMessage, pubOpts)
 }
 
 // pubJoinLeave allows to publish join message into channel when
@@ -461,7 +471,7 @@ func (app *Application) pubJoinLeave(ch Channel, method string, info ClientInfo)
 	if err != nil {
 		return err
 	}
-	return <-app.engine.publish(chID, byteMessage, nil)
+	return <-app.engine.Publish(chID, byteMessage, nil)
 }
 
 // pubPing sends control ping message to all nodes - this message
@@ -496,6 +506,23 @@ func (app *Application) pubPing() error {
 	return app.pubControl("ping", cmdBytes)
 }
 
+// pubSubscribe publishes subscribe control message to all nodes – so all
+// nodes could subscribe user on channel.
+func (app *Application) pubSubscribe(user UserID, ch Channel) error {
+
+	cmd := &subscribeControlCommand{
+		User:    user,
+		Channel: ch,
+	}
+
+	cmdBytes, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	return app.pubControl("subscribe", cmdBytes)
+}
+
 // pubUnsubscribe publishes unsubscribe control message to all nodes – so all
 // nodes could unsubscribe user from channel.
 func (app *Application) pubUnsubscribe(user UserID, ch Channel) error {
@@ -570,7 +597,7 @@ func (app *Application) addSub(ch Channel, c clientConn) error {
 		return err
 	}
 	if first {
-		return app.engine.subscribe(chID)
+		return app.engine.Subscribe(chID)
 	}
 	return nil
 }
@@ -584,7 +611,45 @@ func (app *Application) removeSub(ch Channel, c clientConn) error {
 		return err
 	}
 	if empty {
-		return app.engine.unsubscribe(chID)
+		return app.engine.Unsubscribe(chID)
+	}
+	return nil
+}
+
+// Subscribe subscribes all user connections on channel. Clients receive
+// subscribe response without uid so they know about server-side subscription.
+func (app *Application) Subscribe(user UserID, ch Channel) error {
+
+	if string(user) == "" || string(ch) == "" {
+		return ErrInvalidMessage
+	}
+
+	_, err := app.channelOpts(ch)
+	if err != nil {
+		return err
+	}
+
+	// First subscribe on this node.
+	err = app.subscribeUser(user, ch)
+	if err != nil {
+		return ErrInternalServerError
+	}
+	// Second send subscribe control message to other nodes.
+	err = app.pubSubscribe(user, ch)
+	if err != nil {
+		return ErrInternalServerError
+	}
+	return nil
+}
+
+// subscribeUser subscribes all user connections on this node on channel.
+func (app *Application) subscribeUser(user UserID, ch Channel) error {
+	userConnections := app.clients.userConnections(user)
+	for _, c := range userConnections {
+		err := c.subscribe(ch)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -694,13 +759,13 @@ func (app *Application) channelOpts(ch Channel) (ChannelOptions, error) {
 // addPresence proxies presence adding to engine.
 func (app *Application) addPresence(ch Channel, uid ConnID, info ClientInfo) error {
 	chID := app.channelID(ch)
-	return app.engine.addPresence(chID, uid, info)
+	return app.engine.AddPresence(chID, uid, info)
 }
 
 // removePresence proxies presence removing to engine.
 func (app *Application) removePresence(ch Channel, uid ConnID) error {
 	chID := app.channelID(ch)
-	return app.engine.removePresence(chID, uid)
+	return app.engine.RemovePresence(chID, uid)
 }
 
 // Presence returns a map of active clients in project channel.
@@ -721,7 +786,7 @@ func (app *Application) Presence(ch Channel) (map[ConnID]ClientInfo, error) {
 
 	chID := app.channelID(ch)
 
-	presence, err := app.engine.presence(chID)
+	presence, err := app.engine.Presence(chID)
 	if err != nil {
 		logger.ERROR.Println(err)
 		return map[ConnID]ClientInfo{}, ErrInternalServerError
@@ -729,8 +794,36 @@ func (app *Application) Presence(ch Channel) (map[ConnID]ClientInfo, error) {
 	return presence, nil
 }
 
+// History directions for paging through channel history.
+const (
+	historyBackward = "backward"
+	historyForward  = "forward"
+)
+
+// newHistoryOptions validates history paging parameters came from client or API
+// command and converts them to history options.
+func newHistoryOptions(since uint64, limit int, direction string) (HistoryOptions, error) {
+	if limit < 0 {
+		return HistoryOptions{}, ErrInvalidMessage
+	}
+	opts := HistoryOptions{Since: since, Limit: limit}
+	switch direction {
+	case "", historyBackward:
+	case historyForward:
+		opts.Forward = true
+	default:
+		return HistoryOptions{}, ErrInvalidMessage
+	}
+	return opts, nil
+}
+
 // History returns a slice of last messages published into project channel.
 func (app *Application) History(ch Channel) ([]Message, error) {
+	return app.history(ch, HistoryOptions{})
+}
+
+// history returns a page of messages published into project channel.
+func (app *Application) history(ch Channel, opts HistoryOptions) ([]Message, error) {
 
 	if string(ch) == "" {
 		return []Message{}, ErrInvalidMessage
@@ -747,7 +840,7 @@ func (app *Application) History(ch Channel) ([]Message, error) {
 
 	chID := app.channelID(ch)
 
-	history, err := app.engine.history(chID, historyOpts{})
+	history, err := app.engine.History(chID, opts)
 	if err != nil {
 		logger.ERROR.Println(err)
 		return []Message{}, ErrInternalServerError
@@ -755,16 +848,46 @@ func (app *Application) History(ch Channel) ([]Message, error) {
 	return history, nil
 }
 
-func (app *Application) lastMessageID(ch Channel) (MessageID, error) {
+// lastMessage returns last message saved into channel history, it's nil if
+// history is empty.
+func (app *Application) lastMessage(ch Channel) (*Message, error) {
 	chID := app.channelID(ch)
-	history, err := app.engine.history(chID, historyOpts{Limit: 1})
+	history, err := app.engine.History(chID, HistoryOptions{Limit: 1})
 	if err != nil {
-		return MessageID(""), err
+		return nil, err
 	}
 	if len(history) == 0 {
-		return MessageID(""), nil
+		return nil, nil
+	}
+	return &history[0], nil
+}
+
+// secrets returns all currently active secrets, primary secret goes first.
+func (app *Application) secrets() []auth.Secret {
+	app.RLock()
+	defer app.RUnlock()
+	return app.config.secrets()
+}
+
+// checkSecrets reports whether provided check passes with any of active secrets.
+func (app *Application) checkSecrets(check func(secret string) bool) bool {
+	for _, secret := range app.secrets() {
+		if check(secret.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtKeys returns keys to verify client JWTs with.
+func (app *Application) jwtKeys() auth.JWTKeys {
+	app.RLock()
+	defer app.RUnlock()
+	return auth.JWTKeys{
+		HMACSecrets:    app.config.secrets(),
+		RSAPublicKey:   app.config.TokenRSAPublicKey,
+		ECDSAPublicKey: app.config.TokenECDSAPublicKey,
 	}
-	return history[0].UID, nil
 }
 
 // privateChannel checks if channel private and therefore subscription
@@ -63,7 +63,7 @@ func testRedisAppWithConfig(c *Config) *Application {
 }
 
 func newTestClient(app *Application, sess session) *client {
-	c, _ := newClient(app, sess)
+	c, _ := newClient(app, sess, jsonClientEncoding)
 	return c
 }
 
@@ -195,6 +195,17 @@ func testPingControlCmd(uid string) []byte {
 	return cmdBytes
 }
 
+func testSubscribeControlCmd(uid string) []byte {
+	params := json.RawMessage([]byte("{}"))
+	cmd := controlCommand{
+		UID:    uid,
+		Method: "subscribe",
+		Params: &params,
+	}
+	cmdBytes, _ := json.Marshal(cmd)
+	return cmdBytes
+}
+
 func testUnsubscribeControlCmd(uid string) []byte {
 	params := json.RawMessage([]byte("{}"))
 	cmd := controlCommand{
@@ -277,6 +288,8 @@ func TestControlMessages(t *testing.T) {
 	assert.Equal(t, nil, err)
 	err = app.controlMsg(testWrongControlCmd("another node"))
 	assert.Equal(t, ErrInvalidMessage, err)
+	err = app.controlMsg(testSubscribeControlCmd("another node"))
+	assert.Equal(t, nil, err)
 	err = app.controlMsg(testUnsubscribeControlCmd("another node"))
 	assert.Equal(t, nil, err)
 	err = app.controlMsg(testDisconnectControlCmd("another node"))
@@ -296,9 +309,24 @@ func TestUpdateMetrics(t *testing.T) {
 	assert.Equal(t, int64(1), app.metrics.NumMsgPublished.LoadRaw())
 }
 
+func TestSubscribe(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(c.channels()))
+	app.subscribeUser(UserID("user1"), Channel("test"))
+	assert.Equal(t, 1, len(c.channels()))
+	// channel of another user skipped.
+	app.subscribeUser(UserID("user1"), Channel("test#user2"))
+	assert.Equal(t, 1, len(c.channels()))
+}
+
 func TestUnsubscribe(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
 	cmds := []clientCommand{testConnectCmd(timestamp), testSubscribeCmd("test")}
@@ -362,7 +390,7 @@ func BenchmarkReceiveBroadcast(b *testing.B) {
 
 		go func() {
 			for _, item := range inputData {
-				app.handleMsg(item.ch, item.data)
+				app.HandleMsg(item.ch, item.data)
 			}
 		}()
 
@@ -13,6 +13,14 @@ const (
 	HMACLength = 64
 )
 
+// Secret is a secret key with optional ID. Several secrets can be active at the
+// same time during secret rotation – ID allows to pick the right one to verify
+// JWT by its "kid" header instead of trying all of them.
+type Secret struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
 // GenerateClientToken generates client token based on project secret key and provided
 // connection parameters such as user ID, timestamp and info JSON string.
 func GenerateClientToken(secret, user, timestamp, info string) string {
@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// JWT signing algorithms supported by Centrifugo.
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+)
+
+var (
+	// ErrMalformedToken returned when token is not a valid compact JWT.
+	ErrMalformedToken = errors.New("malformed token")
+	// ErrUnsupportedAlgorithm returned when token signed with algorithm not
+	// supported or no key configured to verify it.
+	ErrUnsupportedAlgorithm = errors.New("unsupported token algorithm")
+	// ErrInvalidSignature returned when token signature does not match.
+	ErrInvalidSignature = errors.New("invalid token signature")
+	// ErrInvalidTokenType returned when private channel subscription JWT used
+	// as client connection JWT.
+	ErrInvalidTokenType = errors.New("invalid token type")
+)
+
+// JWTKeys contains keys used to verify JWT signatures. HMACSecrets are used for
+// HS256 tokens, RSAPublicKey for RS256 and ECDSAPublicKey for ES256. Tokens
+// signed with algorithm which has no key configured are rejected. If HS256 token
+// has "kid" header then only secret with the same ID is used to verify it.
+type JWTKeys struct {
+	HMACSecrets    []Secret
+	RSAPublicKey   *rsa.PublicKey
+	ECDSAPublicKey *ecdsa.PublicKey
+}
+
+// ClientClaims is a set of claims in client connection JWT.
+type ClientClaims struct {
+	// User is web application user ID.
+	User string `json:"sub"`
+	// ExpireAt is unix seconds when connection must be considered expired, 0
+	// means that token does not expire itself.
+	ExpireAt int64 `json:"exp,omitempty"`
+	// IssuedAt is unix seconds when token was generated.
+	IssuedAt int64 `json:"iat,omitempty"`
+	// Info is additional connection information JSON.
+	Info json.RawMessage `json:"info,omitempty"`
+	// Channels is a list of channels server subscribes connection on right
+	// after successful connect.
+	Channels []string `json:"channels,omitempty"`
+}
+
+// ChannelClaims is a set of claims in private channel subscription JWT. Unlike
+// channel sign subscription JWT is bound to user instead of connection so it can
+// be reused by the same user across reconnects until it expires.
+type ChannelClaims struct {
+	// User is web application user ID allowed to subscribe on channel.
+	User string `json:"sub"`
+	// Channel is a channel name token grants access to.
+	Channel string `json:"channel"`
+	// ExpireAt is unix seconds when token expires, 0 means that token never expires.
+	ExpireAt int64 `json:"exp,omitempty"`
+	// Info is additional channel information JSON.
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// IsJWT reports whether provided token looks like compact JWT so it can be
+// distinguished from HMAC hex tokens.
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// GenerateClientJWT generates HS256 client connection JWT using project secret.
+func GenerateClientJWT(secret string, claims ClientClaims) (string, error) {
+	return signJWT(AlgorithmHS256, "", []byte(secret), claims)
+}
+
+// GenerateClientJWTWithKeyID generates HS256 client connection JWT using project
+// secret and sets secret ID as "kid" header.
+func GenerateClientJWTWithKeyID(keyID, secret string, claims ClientClaims) (string, error) {
+	return signJWT(AlgorithmHS256, keyID, []byte(secret), claims)
+}
+
+// GenerateClientJWTRSA generates RS256 client connection JWT using RSA private key.
+func GenerateClientJWTRSA(key *rsa.PrivateKey, claims ClientClaims) (string, error) {
+	return signJWT(AlgorithmRS256, "", key, claims)
+}
+
+// GenerateClientJWTECDSA generates ES256 client connection JWT using ECDSA P-256 private key.
+func GenerateClientJWTECDSA(key *ecdsa.PrivateKey, claims ClientClaims) (string, error) {
+	return signJWT(AlgorithmES256, "", key, claims)
+}
+
+// VerifyClientJWT checks client connection JWT signature and returns claims it
+// contains. Token expiration is not checked here – Centrifugo uses ExpireAt to
+// tell client that it must refresh connection. Private channel subscription JWT
+// is signed with the same keys and has the same user claim so it's rejected with
+// ErrInvalidTokenType when has channel claim – otherwise long-lived channel token
+// could be used to connect.
+func VerifyClientJWT(token string, keys JWTKeys) (ClientClaims, error) {
+	var claims struct {
+		ClientClaims
+		Channel json.RawMessage `json:"channel"`
+	}
+	err := verifyJWT(token, keys, &claims)
+	if err != nil {
+		return ClientClaims{}, err
+	}
+	if claims.Channel != nil {
+		return ClientClaims{}, ErrInvalidTokenType
+	}
+	return claims.ClientClaims, nil
+}
+
+// GenerateChannelJWT generates HS256 private channel subscription JWT using project secret.
+func GenerateChannelJWT(secret string, claims ChannelClaims) (string, error) {
+	return signJWT(AlgorithmHS256, "", []byte(secret), claims)
+}
+
+// GenerateChannelJWTWithKeyID generates HS256 private channel subscription JWT using
+// project secret and sets secret ID as "kid" header.
+func GenerateChannelJWTWithKeyID(keyID, secret string, claims ChannelClaims) (string, error) {
+	return signJWT(AlgorithmHS256, keyID, []byte(secret), claims)
+}
+
+// GenerateChannelJWTRSA generates RS256 private channel subscription JWT using RSA private key.
+func GenerateChannelJWTRSA(key *rsa.PrivateKey, claims ChannelClaims) (string, error) {
+	return signJWT(AlgorithmRS256, "", key, claims)
+}
+
+// GenerateChannelJWTECDSA generates ES256 private channel subscription JWT using ECDSA P-256 private key.
+func GenerateChannelJWTECDSA(key *ecdsa.PrivateKey, claims ChannelClaims) (string, error) {
+	return signJWT(AlgorithmES256, "", key, claims)
+}
+
+// VerifyChannelJWT checks private channel subscription JWT signature and returns
+// claims it contains. Caller is responsible for checking that claims match
+// subscription request and that token not expired.
+func VerifyChannelJWT(token string, keys JWTKeys) (ChannelClaims, error) {
+	var claims ChannelClaims
+	err := verifyJWT(token, keys, &claims)
+	return claims, err
+}
+
+// ParseRSAPublicKey parses PEM encoded RSA public key.
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	pub, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not RSA public key")
+	}
+	return key, nil
+}
+
+// ParseECDSAPublicKey parses PEM encoded ECDSA public key.
+func ParseECDSAPublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	pub, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not ECDSA public key")
+	}
+	return key, nil
+}
+
+func parsePublicKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func encodeSegment(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSegment(seg string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(seg, "="))
+}
+
+func signJWT(alg, keyID string, key interface{}, claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: alg, Type: "JWT", KeyID: keyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(header) + "." + encodeSegment(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var sig []byte
+
+	switch alg {
+	case AlgorithmHS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signingInput))
+		sig = mac.Sum(nil)
+	case AlgorithmRS256:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			return "", err
+		}
+	case AlgorithmES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses fixed size big-endian R || S representation.
+		sig = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rBytes):32], rBytes)
+		copy(sig[64-len(sBytes):], sBytes)
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+
+	return signingInput + "." + encodeSegment(sig), nil
+}
+
+func verifyJWT(token string, keys JWTKeys, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformedToken
+	}
+
+	headerBytes, err := decodeSegment(parts[0])
+	if err != nil {
+		return ErrMalformedToken
+	}
+	var header jwtHeader
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return ErrMalformedToken
+	}
+
+	signingInput := parts[0] + "." + parts[1]
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch header.Algorithm {
+	case AlgorithmHS256:
+		if len(keys.HMACSecrets) == 0 {
+			return ErrUnsupportedAlgorithm
+		}
+		if !checkHMACSecrets(keys.HMACSecrets, header.KeyID, signingInput, sig) {
+			return ErrInvalidSignature
+		}
+	case AlgorithmRS256:
+		if keys.RSAPublicKey == nil {
+			return ErrUnsupportedAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(keys.RSAPublicKey, crypto.SHA256, digest[:], sig) != nil {
+			return ErrInvalidSignature
+		}
+	case AlgorithmES256:
+		if keys.ECDSAPublicKey == nil {
+			return ErrUnsupportedAlgorithm
+		}
+		if len(sig) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(keys.ECDSAPublicKey, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return ErrUnsupportedAlgorithm
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return ErrMalformedToken
+	}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+// checkHMACSecrets checks HS256 signature using secret with provided ID or, when
+// ID is empty, every secret in order.
+func checkHMACSecrets(secrets []Secret, keyID, signingInput string, sig []byte) bool {
+	for _, secret := range secrets {
+		if keyID != "" && secret.ID != keyID {
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(secret.Key))
+		mac.Write([]byte(signingInput))
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestIsJWT(t *testing.T) {
+	if IsJWT(GenerateClientToken("secret", "user", "1430669930", "")) {
+		t.Error("HMAC token must not be treated as JWT")
+	}
+	token, err := GenerateClientJWT("secret", ClientClaims{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsJWT(token) {
+		t.Error("generated JWT must be treated as JWT")
+	}
+}
+
+func TestClientJWTHMAC(t *testing.T) {
+	claims := ClientClaims{
+		User:     "user",
+		ExpireAt: 1430669930,
+		Info:     json.RawMessage(`{"name":"Alexander"}`),
+	}
+	token, err := GenerateClientJWT("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := VerifyClientJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.User != "user" || parsed.ExpireAt != 1430669930 || string(parsed.Info) != `{"name":"Alexander"}` {
+		t.Errorf("unexpected claims: %#v", parsed)
+	}
+	_, err = VerifyClientJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "wrong"}}})
+	if err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+	_, err = VerifyClientJWT(token, JWTKeys{})
+	if err != ErrUnsupportedAlgorithm {
+		t.Errorf("expected unsupported algorithm error, got %v", err)
+	}
+}
+
+func TestClientJWTRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateClientJWTRSA(key, ClientClaims{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseRSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := VerifyClientJWT(token, JWTKeys{RSAPublicKey: pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.User != "user" {
+		t.Errorf("unexpected user: %s", parsed.User)
+	}
+	// HMAC secret must not be accepted for RS256 token.
+	_, err = VerifyClientJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != ErrUnsupportedAlgorithm {
+		t.Errorf("expected unsupported algorithm error, got %v", err)
+	}
+}
+
+func TestClientJWTECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateClientJWTECDSA(key, ClientClaims{User: "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseECDSAPublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = VerifyClientJWT(token, JWTKeys{ECDSAPublicKey: pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tampered payload must be rejected.
+	parts := strings.Split(token, ".")
+	forged, _ := GenerateClientJWTECDSA(key, ClientClaims{User: "another"})
+	parts[1] = strings.Split(forged, ".")[1]
+	_, err = VerifyClientJWT(strings.Join(parts, "."), JWTKeys{ECDSAPublicKey: pub})
+	if err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+}
+
+func TestVerifyMalformedJWT(t *testing.T) {
+	_, err := VerifyClientJWT("not.a.jwt", JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != ErrMalformedToken {
+		t.Errorf("expected malformed token error, got %v", err)
+	}
+	// Unsigned tokens must never be accepted.
+	_, err = VerifyClientJWT("eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyIn0.", JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != ErrUnsupportedAlgorithm {
+		t.Errorf("expected unsupported algorithm error, got %v", err)
+	}
+}
+
+func TestChannelJWT(t *testing.T) {
+	claims := ChannelClaims{
+		User:    "user",
+		Channel: "$private",
+		Info:    json.RawMessage(`{"role":"admin"}`),
+	}
+	token, err := GenerateChannelJWT("secret", claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := VerifyChannelJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.User != "user" || parsed.Channel != "$private" || string(parsed.Info) != `{"role":"admin"}` {
+		t.Errorf("unexpected claims: %#v", parsed)
+	}
+	_, err = VerifyChannelJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "wrong"}}})
+	if err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+	// Channel token can't be used to connect.
+	_, err = VerifyClientJWT(token, JWTKeys{HMACSecrets: []Secret{{Key: "secret"}}})
+	if err != ErrInvalidTokenType {
+		t.Errorf("expected invalid token type error, got %v", err)
+	}
+}
+
+func TestClientJWTKeyRotation(t *testing.T) {
+	keys := JWTKeys{
+		HMACSecrets: []Secret{{ID: "new", Key: "new secret"}, {ID: "old", Key: "old secret"}},
+	}
+
+	// token without kid checked against all active secrets.
+	token, _ := GenerateClientJWT("old secret", ClientClaims{User: "user"})
+	_, err := VerifyClientJWT(token, keys)
+	if err != nil {
+		t.Errorf("token signed with old secret must pass check, got %v", err)
+	}
+
+	token, _ = GenerateClientJWTWithKeyID("new", "new secret", ClientClaims{User: "user"})
+	_, err = VerifyClientJWT(token, keys)
+	if err != nil {
+		t.Errorf("token signed with new secret must pass check, got %v", err)
+	}
+
+	// kid pointing to another secret.
+	token, _ = GenerateClientJWTWithKeyID("old", "new secret", ClientClaims{User: "user"})
+	_, err = VerifyClientJWT(token, keys)
+	if err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+
+	// secret removed from rotation.
+	token, _ = GenerateClientJWTWithKeyID("older", "older secret", ClientClaims{User: "user"})
+	_, err = VerifyClientJWT(token, keys)
+	if err != ErrInvalidSignature {
+		t.Errorf("expected invalid signature error, got %v", err)
+	}
+}
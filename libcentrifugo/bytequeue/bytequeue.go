@@ -14,11 +14,21 @@ type ByteQueue interface {
 	// In that case the []byte is dropped.
 	Add(i []byte) bool
 
+	// AddValue adds a []byte with associated value to the back of the queue,
+	// value can be anything consumer can use instead of or together with
+	// []byte (for example []byte already framed for transport). Returns false
+	// if the queue is closed.
+	AddValue(i []byte, v interface{}) bool
+
 	// Remove will remove a []byte from the queue.
 	// If false is returned, it either means 1) there were no items on the queue
 	// or 2) the queue is closed.
 	Remove() ([]byte, bool)
 
+	// Peek returns the first []byte in the queue without removing it.
+	// If false is returned, there are no items on the queue or it is closed.
+	Peek() ([]byte, bool)
+
 	// Close the queue and discard all entried in the queue
 	// all goroutines in wait() will return
 	Close()
@@ -35,6 +45,10 @@ type ByteQueue interface {
 	// Otherwise the return value of "remove" is returned.
 	Wait() ([]byte, bool)
 
+	// WaitValue is the same as Wait but also returns value added together with
+	// []byte, nil for []byte added without value.
+	WaitValue() ([]byte, interface{}, bool)
+
 	// Cap returns the capacity (without allocations).
 	Cap() int
 
@@ -45,10 +59,16 @@ type ByteQueue interface {
 	Size() int
 }
 
+// node is a queue element.
+type node struct {
+	data  []byte
+	value interface{}
+}
+
 type byteQueue struct {
 	mu      sync.RWMutex
 	cond    *sync.Cond
-	nodes   [][]byte
+	nodes   []node
 	head    int
 	tail    int
 	cnt     int
@@ -61,7 +81,7 @@ type byteQueue struct {
 func New(initialCapacity int) ByteQueue {
 	sq := &byteQueue{
 		initCap: initialCapacity,
-		nodes:   make([][]byte, initialCapacity),
+		nodes:   make([]node, initialCapacity),
 	}
 	sq.cond = sync.NewCond(&sq.mu)
 	return sq
@@ -69,7 +89,7 @@ func New(initialCapacity int) ByteQueue {
 
 // Write mutex must be held when calling
 func (q *byteQueue) resize(n int) {
-	nodes := make([][]byte, n)
+	nodes := make([]node, n)
 	if q.head < q.tail {
 		copy(nodes, q.nodes[q.head:q.tail])
 	} else {
@@ -86,6 +106,11 @@ func (q *byteQueue) resize(n int) {
 // will return false if the queue is closed.
 // In that case the []byte is dropped.
 func (q *byteQueue) Add(i []byte) bool {
+	return q.AddValue(i, nil)
+}
+
+// AddValue adds a []byte with associated value to the back of the queue.
+func (q *byteQueue) AddValue(i []byte, v interface{}) bool {
 	q.mu.Lock()
 	if q.closed {
 		q.mu.Unlock()
@@ -96,7 +121,7 @@ func (q *byteQueue) Add(i []byte) bool {
 		// In Go this resulted in a higher memory usage.
 		q.resize(q.cnt * 2)
 	}
-	q.nodes[q.tail] = i
+	q.nodes[q.tail] = node{i, v}
 	q.tail = (q.tail + 1) % len(q.nodes)
 	q.size += len(i)
 	q.cnt++
@@ -133,40 +158,63 @@ func (q *byteQueue) Closed() bool {
 // Will return "", false if the queue is closed.
 // Otherwise the return value of "remove" is returned.
 func (q *byteQueue) Wait() ([]byte, bool) {
+	i, _, ok := q.WaitValue()
+	return i, ok
+}
+
+// WaitValue is the same as Wait but also returns value associated with []byte.
+func (q *byteQueue) WaitValue() ([]byte, interface{}, bool) {
 	q.mu.Lock()
 	if q.closed {
 		q.mu.Unlock()
-		return []byte{}, false
+		return []byte{}, nil, false
 	}
 	if q.cnt != 0 {
 		q.mu.Unlock()
-		return q.Remove()
+		return q.remove()
 	}
 	q.cond.Wait()
 	q.mu.Unlock()
-	return q.Remove()
+	return q.remove()
 }
 
 // Remove will remove a []byte from the queue.
 // If false is returned, it either means 1) there were no items on the queue
 // or 2) the queue is closed.
 func (q *byteQueue) Remove() ([]byte, bool) {
+	i, _, ok := q.remove()
+	return i, ok
+}
+
+func (q *byteQueue) remove() ([]byte, interface{}, bool) {
 	q.mu.Lock()
 	if q.cnt == 0 {
 		q.mu.Unlock()
-		return []byte{}, false
+		return []byte{}, nil, false
 	}
 	i := q.nodes[q.head]
+	// Do not keep reference to value in queue, it can hold large data.
+	q.nodes[q.head] = node{}
 	q.head = (q.head + 1) % len(q.nodes)
 	q.cnt--
-	q.size -= len(i)
+	q.size -= len(i.data)
 
 	if n := len(q.nodes) / 2; n >= q.initCap && q.cnt <= n {
 		q.resize(n)
 	}
 
 	q.mu.Unlock()
-	return i, true
+	return i.data, i.value, true
+}
+
+// Peek returns the first []byte in the queue without removing it.
+func (q *byteQueue) Peek() ([]byte, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.cnt == 0 {
+		return []byte{}, false
+	}
+	return q.nodes[q.head].data, true
 }
 
 // Return the capacity (without allocations)
@@ -69,6 +69,44 @@ func TestByteQueueWait(t *testing.T) {
 
 }
 
+func TestByteQueuePeek(t *testing.T) {
+	q := New(2)
+	_, ok := q.Peek()
+	assert.Equal(t, false, ok)
+	q.Add([]byte("1"))
+	q.Add([]byte("2"))
+	s, ok := q.Peek()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "1", string(s))
+	assert.Equal(t, 2, q.Len())
+	q.Remove()
+	s, ok = q.Peek()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "2", string(s))
+}
+
+func TestByteQueueWaitValue(t *testing.T) {
+	q := New(2)
+	q.Add([]byte("1"))
+	q.AddValue([]byte("2"), 2)
+	assert.Equal(t, 2, q.Size())
+
+	s, v, ok := q.WaitValue()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "1", string(s))
+	assert.Equal(t, nil, v)
+
+	s, v, ok = q.WaitValue()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "2", string(s))
+	assert.Equal(t, 2, v)
+
+	q.Close()
+	_, _, ok = q.WaitValue()
+	assert.Equal(t, false, ok)
+	assert.Equal(t, false, q.AddValue([]byte("3"), 3))
+}
+
 func TestByteQueueClose(t *testing.T) {
 	initialCapacity := 2
 	q := New(initialCapacity)
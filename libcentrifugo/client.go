@@ -2,6 +2,8 @@ package libcentrifugo
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
 	"strconv"
 	"sync"
 	"time"
@@ -24,9 +26,12 @@ type client struct {
 	sync.RWMutex
 	app            *Application
 	sess           session
+	enc            clientEncoding
+	header         http.Header
 	UID            ConnID
 	User           UserID
 	timestamp      int64
+	expireAt       int64
 	defaultInfo    []byte
 	authenticated  bool
 	channelInfo    map[Channel][]byte
@@ -39,6 +44,9 @@ type client struct {
 	sendTimeout    time.Duration
 	maxQueueSize   int
 	maxRequestSize int
+	// batchMaxSize is a maximum size of messages joined into one message sent
+	// to client, 0 if messages sent one by one.
+	batchMaxSize int
 }
 
 // ClientInfo contains information about client to use in message
@@ -50,12 +58,14 @@ type ClientInfo struct {
 	ChannelInfo *json.RawMessage `json:"channel_info,omitempty"`
 }
 
-// newClient creates new ready to communicate client.
-func newClient(app *Application, s session) (*client, error) {
+// newClient creates new ready to communicate client which encodes messages it
+// sends with enc.
+func newClient(app *Application, s session, enc clientEncoding) (*client, error) {
 	c := client{
 		UID:       ConnID(uuid.NewV4().String()),
 		app:       app,
 		sess:      s,
+		enc:       enc,
 		closeChan: make(chan struct{}),
 	}
 	app.RLock()
@@ -64,7 +74,13 @@ func newClient(app *Application, s session) (*client, error) {
 	c.maxQueueSize = app.config.ClientQueueMaxSize
 	c.maxRequestSize = app.config.ClientRequestMaxSize
 	c.sendTimeout = app.config.MessageSendTimeout
+	if app.config.ClientMessageBatching {
+		c.batchMaxSize = app.config.ClientMessageBatchMaxSize
+	}
 	app.RUnlock()
+	if bs, ok := s.(batchingSession); ok && !bs.batchMessages() {
+		c.batchMaxSize = 0
+	}
 	c.messages = bytequeue.New(queueInitialCapacity)
 	go c.sendMessages()
 	if staleCloseDelay > 0 {
@@ -76,25 +92,57 @@ func newClient(app *Application, s session) (*client, error) {
 // sendMessages waits for messages from queue and sends them to client.
 func (c *client) sendMessages() {
 	for {
-		msg, ok := c.messages.Wait()
+		msg, value, ok := c.messages.WaitValue()
 		if !ok {
 			if c.messages.Closed() {
 				return
 			}
 			continue
 		}
-		err := c.sendMsgTimeout(msg)
+		prepared, _ := value.(preparedFrame)
+		count := 1
+		if c.batchMaxSize > 0 {
+			if batch, n := c.batch(msg); n > 1 {
+				msg, prepared, count = batch, nil, n
+			}
+		}
+		err := c.sendMsgTimeout(msg, prepared)
 		if err != nil {
 			logger.INFO.Println("error sending to", c.uid(), err.Error())
 			c.close("error sending message")
 			return
 		}
-		c.app.metrics.NumMsgSent.Inc()
+		c.app.metrics.NumMsgSent.Add(int64(count))
 		c.app.metrics.BytesClientOut.Add(int64(len(msg)))
 	}
 }
 
-func (c *client) sendMsgTimeout(msg []byte) error {
+// batch removes messages queued after msg from client queue while joined message
+// fits into batchMaxSize and joins them with msg so they are sent to client in
+// one write. It returns joined message and number of messages in it.
+func (c *client) batch(msg []byte) ([]byte, int) {
+	messages := [][]byte{msg}
+	// size is enough for JSON array of messages with brackets and commas.
+	size := len(msg) + 1
+	for {
+		next, ok := c.messages.Peek()
+		if !ok || size+len(next)+len(messages)+1 > c.batchMaxSize {
+			break
+		}
+		// Only this goroutine removes messages from queue so it's the one peeked.
+		c.messages.Remove()
+		messages = append(messages, next)
+		size += len(next)
+	}
+	if len(messages) == 1 {
+		return msg, 1
+	}
+	return c.enc.joinMessages(messages), len(messages)
+}
+
+// sendMsgTimeout sends message to client's session. Message frame prepared on
+// broadcast used instead of message if session supports it.
+func (c *client) sendMsgTimeout(msg []byte, prepared preparedFrame) error {
 	select {
 	case <-c.closeChan:
 		return nil
@@ -106,7 +154,7 @@ func (c *client) sendMsgTimeout(msg []byte) error {
 		to := time.After(sendTimeout)
 		sent := make(chan error)
 		go func() {
-			sent <- c.sess.Send(msg)
+			sent <- c.sendSession(msg, prepared)
 		}()
 		select {
 		case err := <-sent:
@@ -119,8 +167,17 @@ func (c *client) sendMsgTimeout(msg []byte) error {
 		// Centrifugo behind properly configured reverse proxy.
 		// But slow client connections will be closed anyway after exceeding
 		// client max queue size.
-		return c.sess.Send(msg)
+		return c.sendSession(msg, prepared)
+	}
+}
+
+func (c *client) sendSession(msg []byte, prepared preparedFrame) error {
+	if prepared != nil {
+		if sess, ok := c.sess.(preparedSession); ok {
+			return sess.SendPrepared(msg, prepared)
+		}
 	}
+	return c.sess.Send(msg)
 }
 
 // closeUnauthenticated closes connection if it's not authenticated yet.
@@ -168,6 +225,10 @@ func (c *client) user() UserID {
 	return c.User
 }
 
+func (c *client) encoding() clientEncoding {
+	return c.enc
+}
+
 func (c *client) channels() []Channel {
 	c.RLock()
 	defer c.RUnlock()
@@ -180,6 +241,28 @@ func (c *client) channels() []Channel {
 	return keys
 }
 
+// subscribe subscribes connection on channel by server request and sends
+// subscribe response to client so it knows about new subscription. Channel
+// connection can't subscribe on is skipped.
+func (c *client) subscribe(ch Channel) error {
+	c.Lock()
+	defer c.Unlock()
+	body, err := c.serverSubscribe(ch)
+	if err != nil {
+		return err
+	}
+	if !body.Status {
+		return nil
+	}
+	resp := newClientResponse("subscribe")
+	resp.Body = body
+	encoded, err := c.enc.encodeResponse(resp)
+	if err != nil {
+		return err
+	}
+	return c.send(encoded)
+}
+
 func (c *client) unsubscribe(ch Channel) error {
 	c.Lock()
 	defer c.Unlock()
@@ -193,15 +276,34 @@ func (c *client) unsubscribe(ch Channel) error {
 	if resp.err != nil {
 		return resp.err
 	}
-	respJSON, err := json.Marshal(resp)
+	encoded, err := c.enc.encodeResponse(resp)
 	if err != nil {
 		return err
 	}
-	return c.send(respJSON)
+	return c.send(encoded)
 }
 
 func (c *client) send(message []byte) error {
-	ok := c.messages.Add(message)
+	return c.enqueue(message, nil)
+}
+
+// sendPrepared puts broadcast message into client queue together with its
+// websocket frame if client's session can send prepared frames.
+func (c *client) sendPrepared(msg *broadcastMessage) error {
+	if _, ok := c.sess.(preparedSession); ok {
+		return c.enqueue(msg.data, msg.preparedMessage())
+	}
+	return c.enqueue(msg.data, nil)
+}
+
+// enqueue puts message with optional prepared frame into client queue.
+func (c *client) enqueue(message []byte, prepared preparedFrame) error {
+	var ok bool
+	if prepared != nil {
+		ok = c.messages.AddValue(message, prepared)
+	} else {
+		ok = c.messages.Add(message)
+	}
 	if !ok {
 		return ErrClientClosed
 	}
@@ -341,7 +443,7 @@ func (c *client) message(msg []byte) error {
 		return ErrLimitExceeded
 	}
 
-	commands, err := cmdFromClientMsg(msg)
+	commands, err := c.enc.decodeCommands(msg)
 	if err != nil {
 		logger.ERROR.Println(err)
 		c.disconnect(ErrInvalidMessage.Error(), false)
@@ -380,11 +482,11 @@ func (c *client) disconnect(reason string, reconnect bool) error {
 		Reason:    reason,
 		Reconnect: reconnect,
 	}
-	jsonResp, err := json.Marshal(resp)
+	encoded, err := c.enc.encodeResponse(resp)
 	if err != nil {
 		return err
 	}
-	return c.send(jsonResp)
+	return c.send(encoded)
 }
 
 func (c *client) handleCommands(commands []clientCommand) error {
@@ -400,11 +502,11 @@ func (c *client) handleCommands(commands []clientCommand) error {
 		resp.UID = command.UID
 		mr = append(mr, resp)
 	}
-	jsonResp, err := json.Marshal(mr)
+	encoded, err := c.enc.encodeResponses(mr)
 	if err != nil {
 		return err
 	}
-	err = c.send(jsonResp)
+	err = c.send(encoded)
 	return err
 }
 
@@ -421,59 +523,61 @@ func (c *client) handleCmd(command clientCommand) (*clientResponse, error) {
 		return nil, ErrUnauthorized
 	}
 
+	defer c.app.metrics.ClientCommandTimes.ObserveSince(method, time.Now())
+
 	switch method {
 	case "connect":
 		var cmd ConnectClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.connectCmd(&cmd)
 	case "refresh":
 		var cmd RefreshClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.refreshCmd(&cmd)
 	case "subscribe":
 		var cmd SubscribeClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.subscribeCmd(&cmd)
 	case "unsubscribe":
 		var cmd UnsubscribeClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.unsubscribeCmd(&cmd)
 	case "publish":
 		var cmd PublishClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.publishCmd(&cmd)
 	case "ping":
 		var cmd PingClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.pingCmd(&cmd)
 	case "presence":
 		var cmd PresenceClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
 		resp, err = c.presenceCmd(&cmd)
 	case "history":
 		var cmd HistoryClientCommand
-		err = json.Unmarshal(params, &cmd)
+		err = c.enc.decodeParams(params, &cmd)
 		if err != nil {
 			return nil, ErrInvalidMessage
 		}
@@ -507,11 +611,16 @@ func (c *client) expire() {
 	connLifetime := c.app.config.ConnLifetime
 	c.app.RUnlock()
 
-	if connLifetime <= 0 {
-		return
+	var timeToExpire int64
+	if c.expireAt > 0 {
+		// connection authenticated with JWT which sets expiration time explicitly.
+		timeToExpire = c.expireAt - time.Now().Unix()
+	} else {
+		if connLifetime <= 0 {
+			return
+		}
+		timeToExpire = c.timestamp + connLifetime - time.Now().Unix()
 	}
-
-	timeToExpire := c.timestamp + connLifetime - time.Now().Unix()
 	if timeToExpire > 0 {
 		// connection was succesfully refreshed
 		return
@@ -537,16 +646,17 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 	info := cmd.Info
 
 	c.app.RLock()
-	secret := c.app.config.Secret
 	insecure := c.app.config.Insecure
 	closeDelay := c.app.config.ExpiredConnectionCloseDelay
 	connLifetime := c.app.config.ConnLifetime
 	version := c.app.config.Version
 	presenceInterval := c.app.config.PresencePingInterval
+	connectProxyEndpoint := c.app.config.ConnectProxyEndpoint
 	c.app.RUnlock()
 
 	var timestamp string
 	var token string
+	var channels []Channel
 	if !insecure {
 		timestamp = cmd.Timestamp
 		token = cmd.Token
@@ -555,23 +665,63 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 		token = ""
 	}
 
-	if !insecure {
-		isValid := auth.CheckClientToken(secret, string(user), timestamp, info, token)
-		if !isValid {
-			logger.ERROR.Println("invalid token for user", user)
+	if !insecure && token == "" && connectProxyEndpoint != "" {
+		reply, err := c.app.connectProxy(c.UID, c.header)
+		if err == ErrUnauthorized {
+			logger.ERROR.Println("connect proxy rejected connection", c.UID)
+			return nil, ErrUnauthorized
+		}
+		if err != nil {
+			resp.Err(clientError{ErrUnauthorized, errorAdviceRetry})
+			return resp, nil
+		}
+		user = reply.User
+		info = string(reply.Info)
+		channels = reply.Channels
+		c.expireAt = reply.ExpireAt
+		c.timestamp = time.Now().Unix()
+	} else if !insecure && auth.IsJWT(token) {
+		claims, err := auth.VerifyClientJWT(token, c.app.jwtKeys())
+		if err != nil {
+			logger.ERROR.Println("invalid JWT:", err)
 			return nil, ErrInvalidToken
 		}
-	}
-
-	if !insecure {
-		ts, err := strconv.Atoi(timestamp)
+		expireAt, err := jwtExpireAt(claims, connLifetime)
 		if err != nil {
 			logger.ERROR.Println(err)
-			return nil, ErrInvalidMessage
+			return nil, ErrInvalidToken
+		}
+		user = UserID(claims.User)
+		info = string(claims.Info)
+		for _, ch := range claims.Channels {
+			channels = append(channels, Channel(ch))
+		}
+		c.expireAt = expireAt
+		c.timestamp = claims.IssuedAt
+		if c.timestamp == 0 {
+			c.timestamp = time.Now().Unix()
 		}
-		c.timestamp = int64(ts)
 	} else {
-		c.timestamp = time.Now().Unix()
+		if !insecure {
+			isValid := c.app.checkSecrets(func(secret string) bool {
+				return auth.CheckClientToken(secret, string(user), timestamp, info, token)
+			})
+			if !isValid {
+				logger.ERROR.Println("invalid token for user", user)
+				return nil, ErrInvalidToken
+			}
+		}
+
+		if !insecure {
+			ts, err := strconv.Atoi(timestamp)
+			if err != nil {
+				logger.ERROR.Println(err)
+				return nil, ErrInvalidMessage
+			}
+			c.timestamp = int64(ts)
+		} else {
+			c.timestamp = time.Now().Unix()
+		}
 	}
 
 	c.User = user
@@ -583,7 +733,17 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 
 	var timeToExpire int64
 
-	if connLifetime > 0 && !insecure {
+	if c.expireAt > 0 {
+		timeToExpire = c.expireAt - time.Now().Unix()
+		body.Expires = true
+		body.TTL = timeToExpire
+		if timeToExpire <= 0 {
+			body.TTL = 0
+			body.Expired = true
+			resp.Body = body
+			return resp, nil
+		}
+	} else if connLifetime > 0 && !insecure {
 		timeToExpire = c.timestamp + connLifetime - time.Now().Unix()
 		if timeToExpire <= 0 {
 			body.Expired = true
@@ -597,10 +757,6 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 	c.Channels = map[Channel]bool{}
 	c.channelInfo = map[Channel][]byte{}
 
-	if c.staleTimer != nil {
-		c.staleTimer.Stop()
-	}
-
 	c.presenceTimer = time.AfterFunc(presenceInterval, c.updatePresence)
 
 	err := c.app.addConn(c)
@@ -609,6 +765,22 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 		return nil, ErrInternalServerError
 	}
 
+	for _, ch := range channels {
+		sub, err := c.serverSubscribe(ch)
+		if err != nil {
+			logger.ERROR.Printf("server-side subscribe of client %s on channel %s failed: %v", c.UID, ch, err)
+			c.cancelConnect()
+			resp.Err(clientError{err, errorAdviceRetry})
+			return resp, nil
+		}
+		body.Subscriptions = append(body.Subscriptions, *sub)
+	}
+
+	// Stale client still closed if connect was cancelled.
+	if c.staleTimer != nil {
+		c.staleTimer.Stop()
+	}
+
 	if c.app.mediator != nil {
 		c.app.mediator.Connect(c.UID, c.User)
 	}
@@ -623,22 +795,49 @@ func (c *client) connectCmd(cmd *ConnectClientCommand) (*clientResponse, error)
 	return resp, nil
 }
 
+// cancelConnect reverts connect of client already added to hub: client is
+// unsubscribed from channels and removed from hub so it can send connect again.
+func (c *client) cancelConnect() {
+	for channel := range c.Channels {
+		_, err := c.unsubscribeCmd(&UnsubscribeClientCommand{Channel: channel})
+		if err != nil {
+			logger.ERROR.Println(err)
+		}
+	}
+	err := c.app.removeConn(c)
+	if err != nil {
+		logger.ERROR.Println(err)
+	}
+	c.presenceTimer.Stop()
+	c.authenticated = false
+}
+
 // refreshCmd handle refresh command to update connection with new
 // timestamp - this is only required when connection lifetime option set.
 func (c *client) refreshCmd(cmd *RefreshClientCommand) (*clientResponse, error) {
 
 	resp := newClientResponse("refresh")
 
+	c.app.RLock()
+	insecure := c.app.config.Insecure
+	connectProxyEndpoint := c.app.config.ConnectProxyEndpoint
+	c.app.RUnlock()
+
+	if !insecure && cmd.Token == "" && connectProxyEndpoint != "" {
+		return c.refreshProxy(resp)
+	}
+	if auth.IsJWT(cmd.Token) {
+		return c.refreshJWT(resp, cmd.Token)
+	}
+
 	user := cmd.User
 	info := cmd.Info
 	timestamp := cmd.Timestamp
 	token := cmd.Token
 
-	c.app.RLock()
-	secret := c.app.config.Secret
-	c.app.RUnlock()
-
-	isValid := auth.CheckClientToken(secret, string(user), timestamp, info, token)
+	isValid := c.app.checkSecrets(func(secret string) bool {
+		return auth.CheckClientToken(secret, string(user), timestamp, info, token)
+	})
 	if !isValid {
 		logger.ERROR.Println("invalid refresh token for user", user)
 		return nil, ErrInvalidToken
@@ -650,6 +849,67 @@ func (c *client) refreshCmd(cmd *RefreshClientCommand) (*clientResponse, error)
 		return nil, ErrInvalidMessage
 	}
 
+	// Expiration time set by JWT before is replaced with connection lifetime
+	// counted from token timestamp.
+	resp.Body = c.refreshed(0, int64(ts), []byte(info))
+	return resp, nil
+}
+
+// refreshJWT refreshes connection authenticated with JWT. New token must belong
+// to the same user and its expiration time replaces current one.
+func (c *client) refreshJWT(resp *clientResponse, token string) (*clientResponse, error) {
+	claims, err := auth.VerifyClientJWT(token, c.app.jwtKeys())
+	if err != nil {
+		logger.ERROR.Println("invalid refresh JWT:", err)
+		return nil, ErrInvalidToken
+	}
+	if UserID(claims.User) != c.User {
+		logger.ERROR.Println("refresh JWT issued for another user", claims.User)
+		return nil, ErrInvalidToken
+	}
+
+	c.app.RLock()
+	connLifetime := c.app.config.ConnLifetime
+	c.app.RUnlock()
+
+	expireAt, err := jwtExpireAt(claims, connLifetime)
+	if err != nil {
+		logger.ERROR.Println(err)
+		return nil, ErrInvalidToken
+	}
+	timestamp := claims.IssuedAt
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	resp.Body = c.refreshed(expireAt, timestamp, claims.Info)
+	return resp, nil
+}
+
+// refreshProxy refreshes connection authenticated by connect proxy asking it
+// again with headers of connection request. Proxy must authenticate the same user,
+// its expiration time replaces current one.
+func (c *client) refreshProxy(resp *clientResponse) (*clientResponse, error) {
+	reply, err := c.app.connectProxy(c.UID, c.header)
+	if err == ErrUnauthorized {
+		logger.ERROR.Println("connect proxy rejected refresh of connection", c.UID)
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		resp.Err(clientError{ErrUnauthorized, errorAdviceRetry})
+		return resp, nil
+	}
+	if reply.User != c.User {
+		logger.ERROR.Println("connect proxy refreshed connection for another user", reply.User)
+		return nil, ErrUnauthorized
+	}
+	resp.Body = c.refreshed(reply.ExpireAt, time.Now().Unix(), reply.Info)
+	return resp, nil
+}
+
+// refreshed extends connection with new expiration time and info. Zero expireAt
+// means that connection lifetime counts from timestamp. Connection stays as is
+// if new expiration time already passed, reply body tells client about it.
+func (c *client) refreshed(expireAt int64, timestamp int64, info []byte) *ConnectBody {
 	c.app.RLock()
 	closeDelay := c.app.config.ExpiredConnectionCloseDelay
 	connLifetime := c.app.config.ConnLifetime
@@ -658,54 +918,93 @@ func (c *client) refreshCmd(cmd *RefreshClientCommand) (*clientResponse, error)
 
 	body := &ConnectBody{}
 	body.Version = version
-	body.Expires = connLifetime > 0
-	body.TTL = connLifetime
 	body.Client = c.UID
 
-	if connLifetime > 0 {
-		// connection check enabled
-		timeToExpire := int64(ts) + connLifetime - time.Now().Unix()
-		if timeToExpire > 0 {
-			// connection refreshed, update client timestamp and set new expiration timeout
-			c.timestamp = int64(ts)
-			c.defaultInfo = []byte(info)
-			if c.expireTimer != nil {
-				c.expireTimer.Stop()
-			}
-			duration := time.Duration(timeToExpire)*time.Second + closeDelay
-			c.expireTimer = time.AfterFunc(duration, c.expire)
-		} else {
-			body.Expired = true
-		}
+	var timeToExpire int64
+	if expireAt > 0 {
+		timeToExpire = expireAt - time.Now().Unix()
+	} else if connLifetime > 0 {
+		timeToExpire = timestamp + connLifetime - time.Now().Unix()
 	}
-	resp.Body = body
-	return resp, nil
+	body.Expires = expireAt > 0 || connLifetime > 0
+	if body.Expires && timeToExpire <= 0 {
+		body.Expired = true
+		return body
+	}
+
+	c.expireAt = expireAt
+	c.timestamp = timestamp
+	c.defaultInfo = info
+	if c.expireTimer != nil {
+		c.expireTimer.Stop()
+	}
+	if body.Expires {
+		duration := time.Duration(timeToExpire)*time.Second + closeDelay
+		c.expireTimer = time.AfterFunc(duration, c.expire)
+		body.TTL = timeToExpire
+	}
+	return body
+}
+
+// jwtExpireAt returns unix time when connection authenticated with JWT claims
+// expires. Explicit exp claim wins, otherwise connection lifetime counts from
+// iat claim. Zero means that connection never expires.
+func jwtExpireAt(claims auth.ClientClaims, connLifetime int64) (int64, error) {
+	if claims.ExpireAt > 0 {
+		return claims.ExpireAt, nil
+	}
+	if connLifetime <= 0 {
+		return 0, nil
+	}
+	if claims.IssuedAt == 0 {
+		return 0, errors.New("exp or iat claim required in JWT when connection lifetime set")
+	}
+	return claims.IssuedAt + connLifetime, nil
 }
 
-func recoverMessages(last MessageID, messages []Message) ([]Message, bool) {
-	if last == MessageID("") {
+// recoverMessages returns messages published after message with provided sequence
+// number from history messages sorted from the newest to the oldest. Recovered
+// flag set only when all missed messages are still in history.
+func recoverMessages(seq uint64, epoch string, messages []Message) ([]Message, bool) {
+	if epoch == "" {
 		// Client wants to recover messages but it seems that there were no
 		// messages in history before, so client missed all messages which
 		// exist now.
 		return messages, false
 	}
-	position := -1
+	if len(messages) == 0 || messages[0].Epoch != epoch {
+		// History was created from scratch since client received last message
+		// so we can't know how many messages it missed.
+		return messages, false
+	}
+	last := messages[0].Seq
+	if seq > last {
+		return messages, false
+	}
+	missed := last - seq
+	if missed > uint64(len(messages)) {
+		// Some of missed messages already removed from history. So we try to
+		// compensate as many as we can. But recovered flag stays false so we
+		// do not give a guarantee all missed messages recovered successfully.
+		return messages, false
+	}
+	return messages[:missed], true
+}
+
+// recoverMessagesByUID returns messages published after message with provided
+// UID, it's used for clients which do not send sequence number and epoch yet.
+func recoverMessagesByUID(last MessageID, messages []Message) ([]Message, bool) {
 	for index, msg := range messages {
 		if msg.UID == last {
-			position = index
-			break
+			// Last uid provided found in history. Set recovered flag which means that
+			// Centrifugo thinks missed messages fully recovered.
+			return messages[0:index], true
 		}
 	}
-	if position > -1 {
-		// Last uid provided found in history. Set recovered flag which means that
-		// Centrifugo thinks missed messages fully recovered.
-		return messages[0:position], true
-	}
 	// Last id provided not found in history messages. This means that client
-	// most probably missed too many messages (maybe wrong last uid provided but
-	// it's not a normal case). So we try to compensate as many as we can. But
-	// recovered flag stays false so we do not give a guarantee all missed messages
-	// recovered successfully.
+	// most probably missed too many messages. So we try to compensate as many
+	// as we can. But recovered flag stays false so we do not give a guarantee
+	// all missed messages recovered successfully.
 	return messages, false
 }
 
@@ -722,111 +1021,186 @@ func (c *client) subscribeCmd(cmd *SubscribeClientCommand) (*clientResponse, err
 		return nil, ErrInvalidMessage
 	}
 
+	body := &SubscribeBody{
+		Channel: channel,
+	}
+	resp.Body = body
+
+	chOpts, err := c.checkSubscribe(channel)
+	if err != nil {
+		resp.Err(clientError{err, errorAdviceFix})
+		return resp, nil
+	}
+
+	if c.app.privateChannel(channel) {
+		if cmd.Token != "" {
+			// private channel - subscription authorized with channel JWT.
+			channelInfo, err := c.checkChannelJWT(channel, cmd.Token)
+			if err != nil {
+				resp.Err(clientError{err, errorAdviceFix})
+				return resp, nil
+			}
+			c.channelInfo[channel] = channelInfo
+		} else {
+			// private channel - subscription must be properly signed
+			if string(c.UID) != string(cmd.Client) {
+				resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
+				return resp, nil
+			}
+			isValid := c.app.checkSecrets(func(secret string) bool {
+				return auth.CheckChannelSign(secret, string(cmd.Client), string(channel), cmd.Info, cmd.Sign)
+			})
+			if !isValid {
+				resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
+				return resp, nil
+			}
+			c.channelInfo[channel] = []byte(cmd.Info)
+		}
+	} else if chOpts.SubscribeProxy {
+		reply, err := c.app.subscribeProxy(c.UID, c.User, channel, c.defaultInfo, c.header)
+		if err == ErrPermissionDenied {
+			resp.Err(clientError{err, errorAdviceFix})
+			return resp, nil
+		}
+		if err != nil {
+			resp.Err(clientError{ErrInternalServerError, errorAdviceRetry})
+			return resp, nil
+		}
+		if len(reply.Info) > 0 {
+			c.channelInfo[channel] = []byte(reply.Info)
+		}
+	}
+
+	err = c.subscribeChannel(channel, chOpts, cmd.Recover, cmd.Seq, cmd.Epoch, cmd.Last, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// serverSubscribe subscribes client on channel listed in connection token or
+// requested over server API. Such subscriptions are authorized by server so
+// private channel sign is not required, but all other subscribe checks apply. Channel the client can't be
+// subscribed on reported with false status.
+func (c *client) serverSubscribe(channel Channel) (*SubscribeBody, error) {
+	body := &SubscribeBody{
+		Channel: channel,
+	}
+	chOpts, err := c.checkSubscribe(channel)
+	if err != nil {
+		logger.ERROR.Printf("can't subscribe client %s on channel %s: %v", c.UID, channel, err)
+		return body, nil
+	}
+	err = c.subscribeChannel(channel, chOpts, false, 0, "", "", body)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// checkSubscribe checks that client can subscribe on channel: channel name and
+// number of client channels must be within limits, user must be allowed to
+// subscribe and channel namespace must exist. Private channel authorization is
+// not checked here. It returns channel options on success.
+func (c *client) checkSubscribe(channel Channel) (ChannelOptions, error) {
 	c.app.RLock()
-	secret := c.app.config.Secret
 	maxChannelLength := c.app.config.MaxChannelLength
 	channelLimit := c.app.config.ClientChannelLimit
 	insecure := c.app.config.Insecure
 	c.app.RUnlock()
 
-	body := &SubscribeBody{
-		Channel: channel,
-	}
-	resp.Body = body
-
 	if len(channel) > maxChannelLength {
 		logger.ERROR.Printf("channel too long: max %d, got %d", maxChannelLength, len(channel))
-		resp.Err(clientError{ErrLimitExceeded, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, ErrLimitExceeded
 	}
 
 	if len(c.Channels) >= channelLimit {
 		logger.ERROR.Printf("maximimum limit of channels per client reached: %d", channelLimit)
-		resp.Err(clientError{ErrLimitExceeded, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, ErrLimitExceeded
 	}
 
 	if _, ok := c.Channels[channel]; ok {
-		resp.Err(clientError{ErrAlreadySubscribed, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, ErrAlreadySubscribed
 	}
 
 	if !c.app.userAllowed(channel, c.User) || !c.app.clientAllowed(channel, c.UID) {
-		resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, ErrPermissionDenied
 	}
 
 	chOpts, err := c.app.channelOpts(channel)
 	if err != nil {
-		resp.Err(clientError{err, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, err
 	}
 
 	if !chOpts.Anonymous && c.User == "" && !insecure {
-		resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
-		return resp, nil
+		return ChannelOptions{}, ErrPermissionDenied
 	}
 
-	if c.app.privateChannel(channel) {
-		// private channel - subscription must be properly signed
-		if string(c.UID) != string(cmd.Client) {
-			resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
-			return resp, nil
-		}
-		isValid := auth.CheckChannelSign(secret, string(cmd.Client), string(channel), cmd.Info, cmd.Sign)
-		if !isValid {
-			resp.Err(clientError{ErrPermissionDenied, errorAdviceFix})
-			return resp, nil
-		}
-		c.channelInfo[channel] = []byte(cmd.Info)
-	}
+	return chOpts, nil
+}
 
+// subscribeChannel subscribes client on channel which already passed all
+// permission checks, adds presence, publishes join message and fills subscribe
+// response body. Messages published after provided sequence number recovered
+// from history if recover flag set, last message UID used instead of sequence
+// number and epoch when they are not provided.
+func (c *client) subscribeChannel(channel Channel, chOpts ChannelOptions, recover bool, seq uint64, epoch string, last MessageID, body *SubscribeBody) error {
 	c.Channels[channel] = true
 
 	info := c.info(channel)
 
-	err = c.app.addSub(channel, c)
+	err := c.app.addSub(channel, c)
 	if err != nil {
 		logger.ERROR.Println(err)
-		return resp, ErrInternalServerError
+		return ErrInternalServerError
 	}
 
 	if chOpts.Presence {
 		err = c.app.addPresence(channel, c.UID, info)
 		if err != nil {
 			logger.ERROR.Println(err)
-			return nil, ErrInternalServerError
+			return ErrInternalServerError
 		}
 	}
 
 	if chOpts.Recover {
-		if cmd.Recover {
+		if recover {
 			// Client provided subscribe request with recover flag on. Try to recover missed messages
 			// automatically from history (we suppose here that history configured wisely) based on
-			// provided last message id value.
+			// provided sequence number and epoch of last message client received.
 			messages, err := c.app.History(channel)
 			if err != nil {
 				logger.ERROR.Printf("can't recover messages for channel %s: %s", string(channel), err)
 				body.Messages = []Message{}
 			} else {
-				recoveredMessages, recovered := recoverMessages(cmd.Last, messages)
+				var recoveredMessages []Message
+				var recovered bool
+				if epoch == "" && last != "" {
+					recoveredMessages, recovered = recoverMessagesByUID(last, messages)
+				} else {
+					recoveredMessages, recovered = recoverMessages(seq, epoch, messages)
+				}
 				body.Messages = recoveredMessages
 				body.Recovered = recovered
+				if len(messages) > 0 {
+					body.Seq, body.Epoch, body.Last = messages[0].Seq, messages[0].Epoch, messages[0].UID
+				}
 			}
 		} else {
-			// Client don't want to recover messages yet, we just return last message id to him here.
-			lastMessageID, err := c.app.lastMessageID(channel)
+			// Client don't want to recover messages yet, we just return current history position to him here.
+			msg, err := c.app.lastMessage(channel)
 			if err != nil {
 				logger.ERROR.Println(err)
-			} else {
-				body.Last = lastMessageID
+			} else if msg != nil {
+				body.Seq, body.Epoch, body.Last = msg.Seq, msg.Epoch, msg.UID
 			}
 		}
 	}
 
 	if chOpts.JoinLeave {
 		go func() {
-			err = c.app.pubJoinLeave(channel, "join", info)
+			err := c.app.pubJoinLeave(channel, "join", info)
 			if err != nil {
 				logger.ERROR.Println(err)
 			}
@@ -839,7 +1213,25 @@ func (c *client) subscribeCmd(cmd *SubscribeClientCommand) (*clientResponse, err
 
 	body.Status = true
 
-	return resp, nil
+	return nil
+}
+
+// checkChannelJWT validates private channel subscription JWT and returns channel
+// info it contains. Token must be issued for this channel and connection user.
+func (c *client) checkChannelJWT(ch Channel, token string) ([]byte, error) {
+	claims, err := auth.VerifyChannelJWT(token, c.app.jwtKeys())
+	if err != nil {
+		logger.ERROR.Printf("invalid channel JWT for channel %s: %v", ch, err)
+		return nil, ErrPermissionDenied
+	}
+	if Channel(claims.Channel) != ch || UserID(claims.User) != c.User {
+		logger.ERROR.Printf("channel JWT issued for channel %s and user %s", claims.Channel, claims.User)
+		return nil, ErrPermissionDenied
+	}
+	if claims.ExpireAt > 0 && claims.ExpireAt <= time.Now().Unix() {
+		return nil, ErrTokenExpired
+	}
+	return []byte(claims.Info), nil
 }
 
 // unsubscribeCmd handles unsubscribe command from client - it allows to
@@ -924,7 +1316,30 @@ func (c *client) publishCmd(cmd *PublishClientCommand) (*clientResponse, error)
 
 	info := c.info(channel)
 
-	err := c.app.publish(channel, data, c.UID, &info, true)
+	fromClient := true
+	chOpts, err := c.app.channelOpts(channel)
+	if err == nil && chOpts.PublishProxy {
+		reply, err := c.app.publishProxy(c.UID, c.User, channel, data, c.header)
+		if err == ErrPermissionDenied {
+			resp.Err(clientError{err, errorAdviceFix})
+			return resp, nil
+		}
+		if err != nil {
+			resp.Err(clientError{ErrInternalServerError, errorAdviceRetry})
+			return resp, nil
+		}
+		if reply.Error != "" {
+			resp.Err(clientError{errors.New(reply.Error), errorAdviceFix})
+			return resp, nil
+		}
+		if len(reply.Data) > 0 {
+			data = reply.Data
+		}
+		// Backend allowed publication so Publish channel option not checked.
+		fromClient = false
+	}
+
+	err = c.app.publish(channel, data, c.UID, &info, fromClient)
 	if err != nil {
 		resp.Err(clientError{err, errorAdviceRetry})
 		return resp, nil
@@ -971,7 +1386,8 @@ func (c *client) presenceCmd(cmd *PresenceClientCommand) (*clientResponse, error
 // historyCmd handles history command - it shows last M messages published
 // into channel. M is history size and can be configured for project or namespace
 // via channel options. Also this method checks that history available for channel
-// (also determined by channel options flag)
+// (also determined by channel options flag). Client can page through history
+// providing sequence number to start from, limit and direction.
 func (c *client) historyCmd(cmd *HistoryClientCommand) (*clientResponse, error) {
 
 	resp := newClientResponse("history")
@@ -989,7 +1405,13 @@ func (c *client) historyCmd(cmd *HistoryClientCommand) (*clientResponse, error)
 		return resp, nil
 	}
 
-	history, err := c.app.History(channel)
+	opts, err := newHistoryOptions(cmd.Since, cmd.Limit, cmd.Direction)
+	if err != nil {
+		resp.Err(clientError{err, errorAdviceFix})
+		return resp, nil
+	}
+
+	history, err := c.app.history(channel, opts)
 	if err != nil {
 		resp.Err(clientError{err, errorAdviceRetry})
 		return resp, nil
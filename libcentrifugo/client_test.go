@@ -2,7 +2,10 @@ package libcentrifugo
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
@@ -14,7 +17,7 @@ import (
 
 func TestUnauthenticatedClient(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, "", c.uid())
 
@@ -32,7 +35,7 @@ func TestUnauthenticatedClient(t *testing.T) {
 func TestCloseUnauthenticatedClient(t *testing.T) {
 	app := testApp()
 	app.config.StaleConnectionCloseDelay = 50 * time.Microsecond
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 	assert.NotEqual(t, "", c.uid())
 	time.Sleep(time.Millisecond)
@@ -41,7 +44,7 @@ func TestCloseUnauthenticatedClient(t *testing.T) {
 
 func TestClientMessage(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	// empty message
@@ -73,7 +76,7 @@ func TestClientMessage(t *testing.T) {
 
 func TestSingleObjectMessage(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	nonConnectFirstCmd := clientCommand{
@@ -119,6 +122,24 @@ func testRefreshCmd(timestamp string) clientCommand {
 	return cmd
 }
 
+func testConnectJWTCmd(claims auth.ClientClaims) clientCommand {
+	token, _ := auth.GenerateClientJWT("secret", claims)
+	cmdBytes, _ := json.Marshal(ConnectClientCommand{Token: token})
+	return clientCommand{
+		Method: "connect",
+		Params: cmdBytes,
+	}
+}
+
+func testRefreshJWTCmd(claims auth.ClientClaims) clientCommand {
+	token, _ := auth.GenerateClientJWT("secret", claims)
+	cmdBytes, _ := json.Marshal(RefreshClientCommand{Token: token})
+	return clientCommand{
+		Method: "refresh",
+		Params: cmdBytes,
+	}
+}
+
 func testChannelSign(client ConnID, ch Channel) string {
 	return auth.GenerateChannelSign("secret", string(client), string(ch), "")
 }
@@ -209,7 +230,7 @@ func testPingCmd() clientCommand {
 
 func TestClientConnect(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	var cmd clientCommand
@@ -247,7 +268,7 @@ func TestClientConnect(t *testing.T) {
 
 func TestClientRefresh(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -260,9 +281,212 @@ func TestClientRefresh(t *testing.T) {
 	assert.Equal(t, nil, err)
 }
 
+func TestClientRefreshAfterJWT(t *testing.T) {
+	app := testApp()
+	app.config.ConnLifetime = 60
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	_, err = c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		ExpireAt: time.Now().Unix() + 10,
+	}))
+	assert.Equal(t, nil, err)
+
+	// HMAC token refresh replaces expiration time set by JWT.
+	resp, err := c.handleCmd(testRefreshCmd(strconv.FormatInt(time.Now().Unix(), 10)))
+	assert.Equal(t, nil, err)
+	body := resp.Body.(*ConnectBody)
+	assert.Equal(t, true, body.Expires)
+	assert.True(t, body.TTL > 10)
+	assert.Equal(t, int64(0), c.expireAt)
+
+	// Info updated by JWT without exp claim.
+	resp, err = c.handleCmd(testRefreshJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		IssuedAt: time.Now().Unix(),
+		Info:     json.RawMessage(`{"name":"Alexander"}`),
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, resp.Body.(*ConnectBody).Expired)
+	assert.Equal(t, `{"name":"Alexander"}`, string(c.defaultInfo))
+
+	// Info updated when connection never expires.
+	app.config.ConnLifetime = 0
+	resp, err = c.handleCmd(testRefreshJWTCmd(auth.ClientClaims{
+		User: "user1",
+		Info: json.RawMessage(`{"name":"John"}`),
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, resp.Body.(*ConnectBody).Expires)
+	assert.Equal(t, `{"name":"John"}`, string(c.defaultInfo))
+
+	err = c.clean()
+	assert.Equal(t, nil, err)
+}
+
+func TestClientConnectSecretRotation(t *testing.T) {
+	app := testApp()
+	app.config.Secret = "new secret"
+	app.config.Secrets = []auth.Secret{{Key: "secret"}}
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, c.authenticated)
+
+	app.config.Secrets = nil
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, ErrInvalidToken, err)
+}
+
+func TestClientConnectJWT(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	expireAt := time.Now().Unix() + 60
+	resp, err := c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		ExpireAt: expireAt,
+		Info:     json.RawMessage(`{"name":"Alexander"}`),
+	}))
+	assert.Equal(t, nil, err)
+	body := resp.Body.(*ConnectBody)
+	assert.Equal(t, true, body.Expires)
+	assert.Equal(t, false, body.Expired)
+	assert.Equal(t, true, c.authenticated)
+	assert.Equal(t, UserID("user1"), c.user())
+	assert.Equal(t, expireAt, c.expireAt)
+	assert.Equal(t, `{"name":"Alexander"}`, string(c.defaultInfo))
+	assert.NotEqual(t, nil, c.expireTimer)
+
+	// refresh with JWT of another user is not allowed.
+	_, err = c.handleCmd(testRefreshJWTCmd(auth.ClientClaims{User: "user2", ExpireAt: expireAt + 60}))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	resp, err = c.handleCmd(testRefreshJWTCmd(auth.ClientClaims{User: "user1", ExpireAt: expireAt + 60}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, resp.Body.(*ConnectBody).Expired)
+	assert.Equal(t, expireAt+60, c.expireAt)
+
+	err = c.clean()
+	assert.Equal(t, nil, err)
+}
+
+func TestClientConnectJWTExpired(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	resp, err := c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		ExpireAt: time.Now().Unix() - 10,
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, resp.Body.(*ConnectBody).Expired)
+	assert.Equal(t, false, c.authenticated)
+}
+
+func TestClientConnectJWTLifetime(t *testing.T) {
+	app := testApp()
+	app.config.ConnLifetime = 60
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	// without exp and iat claims there is no way to apply connection lifetime.
+	_, err = c.handleCmd(testConnectJWTCmd(auth.ClientClaims{User: "user1"}))
+	assert.Equal(t, ErrInvalidToken, err)
+
+	issuedAt := time.Now().Unix()
+	_, err = c.handleCmd(testConnectJWTCmd(auth.ClientClaims{User: "user1", IssuedAt: issuedAt}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, issuedAt+60, c.expireAt)
+}
+
+func TestClientConnectJWTInvalid(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	token, _ := auth.GenerateClientJWT("wrong secret", auth.ClientClaims{User: "user1"})
+	_, err = c.connectCmd(&ConnectClientCommand{Token: token})
+	assert.Equal(t, ErrInvalidToken, err)
+	assert.Equal(t, false, c.authenticated)
+}
+
+func TestClientConnectJWTChannels(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	resp, err := c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		Channels: []string{"test#user1", "test#user2", "$private", "unknown:channel", "test#user1"},
+	}))
+	assert.Equal(t, nil, err)
+	body := resp.Body.(*ConnectBody)
+	assert.Equal(t, 5, len(body.Subscriptions))
+	assert.Equal(t, Channel("test#user1"), body.Subscriptions[0].Channel)
+	assert.Equal(t, true, body.Subscriptions[0].Status)
+	// user not allowed to subscribe on channel of another user.
+	assert.Equal(t, false, body.Subscriptions[1].Status)
+	// private channels authorized by connection token itself.
+	assert.Equal(t, true, body.Subscriptions[2].Status)
+	assert.Equal(t, false, body.Subscriptions[3].Status)
+	assert.Equal(t, false, body.Subscriptions[4].Status)
+
+	assert.Equal(t, 2, len(c.channels()))
+	assert.Equal(t, 2, len(app.clients.subs))
+
+	_, err = c.handleCmd(testSubscribeCmd("test#user1"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(c.channels()))
+
+	err = c.clean()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(app.clients.subs))
+}
+
+// testPresenceFailEngine fails to add presence in one channel.
+type testPresenceFailEngine struct {
+	*testEngine
+	failChID ChannelID
+}
+
+func (e *testPresenceFailEngine) AddPresence(chID ChannelID, uid ConnID, info ClientInfo) error {
+	if chID == e.failChID {
+		return errors.New("presence error")
+	}
+	return nil
+}
+
+func TestClientConnectJWTChannelsError(t *testing.T) {
+	app := testApp()
+	app.config.Namespaces[0].Presence = true
+	app.SetEngine(&testPresenceFailEngine{newTestEngine(), app.channelID("test:fail")})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	resp, err := c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User:     "user1",
+		Channels: []string{"test:ok", "test:fail"},
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInternalServerError, resp.clientError.err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+	assert.Equal(t, false, c.authenticated)
+	assert.Equal(t, 0, len(c.channels()))
+	assert.Equal(t, 0, len(app.clients.subs))
+	assert.Equal(t, 0, app.clients.nClients())
+}
+
 func TestClientPublish(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -283,7 +507,7 @@ func TestClientPublish(t *testing.T) {
 
 func TestClientSubscribe(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -303,7 +527,7 @@ func TestClientSubscribe(t *testing.T) {
 
 func TestClientSubscribePrivate(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -320,9 +544,58 @@ func TestClientSubscribePrivate(t *testing.T) {
 
 }
 
+func testSubscribePrivateJWTCmd(claims auth.ChannelClaims) clientCommand {
+	token, _ := auth.GenerateChannelJWT("secret", claims)
+	cmdBytes, _ := json.Marshal(SubscribeClientCommand{
+		Channel: Channel(claims.Channel),
+		Token:   token,
+	})
+	return clientCommand{
+		Method: "subscribe",
+		Params: cmdBytes,
+	}
+}
+
+func TestClientSubscribePrivateJWT(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	cmds := []clientCommand{testConnectCmd(timestamp)}
+	_ = c.handleCommands(cmds)
+
+	// token issued for another user.
+	resp, err := c.handleCmd(testSubscribePrivateJWTCmd(auth.ChannelClaims{User: "user2", Channel: "$test"}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrPermissionDenied, resp.err)
+
+	// token issued for another channel.
+	cmd := testSubscribePrivateJWTCmd(auth.ChannelClaims{User: "user1", Channel: "$another"})
+	var subCmd SubscribeClientCommand
+	_ = json.Unmarshal(cmd.Params, &subCmd)
+	resp, err = c.subscribeCmd(&SubscribeClientCommand{Channel: "$test", Token: subCmd.Token})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrPermissionDenied, resp.err)
+
+	resp, err = c.handleCmd(testSubscribePrivateJWTCmd(auth.ChannelClaims{User: "user1", Channel: "$test", ExpireAt: time.Now().Unix() - 1}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrTokenExpired, resp.err)
+
+	resp, err = c.handleCmd(testSubscribePrivateJWTCmd(auth.ChannelClaims{
+		User:     "user1",
+		Channel:  "$test",
+		ExpireAt: time.Now().Unix() + 60,
+		Info:     json.RawMessage(`{"role":"admin"}`),
+	}))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.err)
+	assert.Equal(t, `{"role":"admin"}`, string(c.channelInfo["$test"]))
+}
+
 func TestClientSubscribeLimits(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -361,7 +634,7 @@ func TestClientSubscribeLimits(t *testing.T) {
 
 func TestClientUnsubscribe(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -382,7 +655,7 @@ func TestClientUnsubscribe(t *testing.T) {
 
 func TestClientUnsubscribeExternal(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -396,9 +669,32 @@ func TestClientUnsubscribeExternal(t *testing.T) {
 	assert.Equal(t, 0, len(c.channels()))
 }
 
+func TestClientSubscribeExternal(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+
+	err = c.subscribe(Channel("test"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(app.clients.subs))
+	assert.Equal(t, 1, len(c.channels()))
+
+	// already subscribed – nothing sent to client.
+	err = c.subscribe(Channel("test"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(c.channels()))
+
+	err = c.clean()
+	assert.Equal(t, nil, err)
+}
+
 func TestClientPresence(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -418,7 +714,7 @@ func TestClientPresence(t *testing.T) {
 
 func TestClientUpdatePresence(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -435,7 +731,7 @@ func TestClientUpdatePresence(t *testing.T) {
 
 func TestClientHistory(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -451,11 +747,16 @@ func TestClientHistory(t *testing.T) {
 	resp, err = c.handleCmd(testHistoryCmd("test"))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, nil, resp.err)
+
+	cmdBytes, _ := json.Marshal(HistoryClientCommand{Channel: "test", Limit: -1})
+	resp, err = c.handleCmd(clientCommand{Method: "history", Params: cmdBytes})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInvalidMessage, resp.err)
 }
 
 func TestClientPing(t *testing.T) {
 	app := testApp()
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -468,10 +769,11 @@ func TestClientPing(t *testing.T) {
 	assert.Equal(t, nil, resp.err)
 }
 
-func testSubscribeRecoverCmd(channel string, last MessageID, rec bool) clientCommand {
+func testSubscribeRecoverCmd(channel string, seq uint64, epoch string, rec bool) clientCommand {
 	subscribeCmd := SubscribeClientCommand{
 		Channel: Channel(channel),
-		Last:    last,
+		Seq:     seq,
+		Epoch:   epoch,
 		Recover: rec,
 	}
 	cmdBytes, _ := json.Marshal(subscribeCmd)
@@ -482,13 +784,14 @@ func testSubscribeRecoverCmd(channel string, last MessageID, rec bool) clientCom
 	return cmd
 }
 
-func TestSubscribeRecover(t *testing.T) {
-	app := testMemoryApp()
+// testSubscribeRecover checks recovery of missed messages, application engine
+// must be running.
+func testSubscribeRecover(t *testing.T, app *Application) {
 	app.config.Recover = true
 	app.config.HistoryLifetime = 30
 	app.config.HistorySize = 5
 
-	c, err := newClient(app, &testSession{})
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
 	assert.Equal(t, nil, err)
 
 	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
@@ -499,22 +802,32 @@ func TestSubscribeRecover(t *testing.T) {
 	data, _ := json.Marshal(map[string]string{"input": "test"})
 	err = app.Publish(Channel("test"), data, ConnID(""), nil)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, int64(1), app.metrics.NumMsgPublished.LoadRaw())
 
 	messages, _ := app.History(Channel("test"))
 	assert.Equal(t, 1, len(messages))
 	message := messages[0]
-	last := message.UID
+	assert.Equal(t, uint64(1), message.Seq)
+	assert.NotEqual(t, "", message.Epoch)
+	seq, epoch := message.Seq, message.Epoch
 
-	// test setting last message uid when no uid provided
-	c, _ = newClient(app, &testSession{})
+	// test setting history position when client does not recover
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
 	cmds = []clientCommand{testConnectCmd(timestamp)}
 	err = c.handleCommands(cmds)
 	assert.Equal(t, nil, err)
-	subscribeCmd := testSubscribeCmd("test")
-	resp, err := c.handleCmd(subscribeCmd)
+	resp, err := c.handleCmd(testSubscribeCmd("test"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, seq, resp.Body.(*SubscribeBody).Seq)
+	assert.Equal(t, epoch, resp.Body.(*SubscribeBody).Epoch)
+
+	// test nothing to recover when client is up to date
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", seq, epoch, true))
 	assert.Equal(t, nil, err)
-	assert.Equal(t, last, resp.Body.(*SubscribeBody).Last)
+	assert.Equal(t, 0, len(resp.Body.(*SubscribeBody).Messages))
+	assert.Equal(t, true, resp.Body.(*SubscribeBody).Recovered)
 
 	// publish 2 messages since last
 	data, _ = json.Marshal(map[string]string{"input": "test1"})
@@ -524,36 +837,43 @@ func TestSubscribeRecover(t *testing.T) {
 	err = app.Publish(Channel("test"), data, ConnID(""), nil)
 	assert.Equal(t, nil, err)
 
-	assert.Equal(t, int64(3), app.metrics.NumMsgPublished.LoadRaw())
-
 	// test no messages recovered when recover is false in subscribe cmd
-	c, _ = newClient(app, &testSession{})
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
 	cmds = []clientCommand{testConnectCmd(timestamp)}
 	err = c.handleCommands(cmds)
 	assert.Equal(t, nil, err)
-	subscribeLastCmd := testSubscribeRecoverCmd("test", last, false)
-	resp, err = c.handleCmd(subscribeLastCmd)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", seq, epoch, false))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(resp.Body.(*SubscribeBody).Messages))
-	assert.NotEqual(t, last, resp.Body.(*SubscribeBody).Last)
+	assert.Equal(t, uint64(3), resp.Body.(*SubscribeBody).Seq)
 
 	// test normal recover
-	c, _ = newClient(app, &testSession{})
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
 	cmds = []clientCommand{testConnectCmd(timestamp)}
 	err = c.handleCommands(cmds)
 	assert.Equal(t, nil, err)
-	subscribeLastCmd = testSubscribeRecoverCmd("test", last, true)
-	resp, err = c.handleCmd(subscribeLastCmd)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", seq, epoch, true))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(resp.Body.(*SubscribeBody).Messages))
 	assert.Equal(t, true, resp.Body.(*SubscribeBody).Recovered)
-	assert.Equal(t, MessageID(""), resp.Body.(*SubscribeBody).Last)
+	assert.Equal(t, uint64(3), resp.Body.(*SubscribeBody).Seq)
+	assert.Equal(t, epoch, resp.Body.(*SubscribeBody).Epoch)
 	messages = resp.Body.(*SubscribeBody).Messages
 	m0, _ := messages[0].Data.MarshalJSON()
 	m1, _ := messages[1].Data.MarshalJSON()
 	// in reversed order in history
 	assert.Equal(t, strings.Contains(string(m0), "test2"), true)
 	assert.Equal(t, strings.Contains(string(m1), "test1"), true)
+	assert.Equal(t, []uint64{3, 2}, testHistorySeqs(messages))
+
+	// test recover from another epoch
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", seq, "another epoch", true))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(resp.Body.(*SubscribeBody).Messages))
+	assert.Equal(t, false, resp.Body.(*SubscribeBody).Recovered)
 
 	// test part recover - when Centrifugo can not recover all missed messages
 	for i := 0; i < 10; i++ {
@@ -561,13 +881,180 @@ func TestSubscribeRecover(t *testing.T) {
 		err = app.Publish(Channel("test"), data, ConnID(""), nil)
 		assert.Equal(t, nil, err)
 	}
-	c, _ = newClient(app, &testSession{})
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
 	cmds = []clientCommand{testConnectCmd(timestamp)}
 	err = c.handleCommands(cmds)
 	assert.Equal(t, nil, err)
-	subscribeLastCmd = testSubscribeRecoverCmd("test", last, true)
-	resp, err = c.handleCmd(subscribeLastCmd)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", seq, epoch, true))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 5, len(resp.Body.(*SubscribeBody).Messages))
 	assert.Equal(t, false, resp.Body.(*SubscribeBody).Recovered)
+
+	// test recover of exactly missed range when oldest missed message is
+	// the oldest one in history.
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	resp, err = c.handleCmd(testSubscribeRecoverCmd("test", 8, epoch, true))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{13, 12, 11, 10, 9}, testHistorySeqs(resp.Body.(*SubscribeBody).Messages))
+	assert.Equal(t, true, resp.Body.(*SubscribeBody).Recovered)
+}
+
+func TestSubscribeRecover(t *testing.T) {
+	testSubscribeRecover(t, testMemoryApp())
+}
+
+func TestSubscribeRecoverByUID(t *testing.T) {
+	app := testMemoryApp()
+	app.config.Recover = true
+	app.config.HistoryLifetime = 30
+	app.config.HistorySize = 5
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	for i := 0; i < 3; i++ {
+		err := app.Publish(Channel("test"), []byte(`{"input":"test"}`), ConnID(""), nil)
+		assert.Equal(t, nil, err)
+	}
+	history, err := app.History(Channel("test"))
+	assert.Equal(t, nil, err)
+
+	c, _ := newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	// Client which knows only UID of last message received.
+	params, _ := json.Marshal(map[string]interface{}{"channel": "test", "recover": true, "last": history[2].UID})
+	resp, err := c.handleCmd(clientCommand{Method: "subscribe", Params: params})
+	assert.Equal(t, nil, err)
+	body := resp.Body.(*SubscribeBody)
+	assert.Equal(t, []uint64{3, 2}, testHistorySeqs(body.Messages))
+	assert.Equal(t, true, body.Recovered)
+	assert.Equal(t, history[0].UID, body.Last)
+
+	c, _ = newClient(app, &testSession{}, jsonClientEncoding)
+	err = c.handleCommands([]clientCommand{testConnectCmd(timestamp)})
+	assert.Equal(t, nil, err)
+	params, _ = json.Marshal(map[string]interface{}{"channel": "test", "recover": true, "last": "unknown"})
+	resp, err = c.handleCmd(clientCommand{Method: "subscribe", Params: params})
+	assert.Equal(t, nil, err)
+	body = resp.Body.(*SubscribeBody)
+	assert.Equal(t, 3, len(body.Messages))
+	assert.Equal(t, false, body.Recovered)
+}
+
+// testBlockingSession blocks sending messages until released so messages
+// queued for client meanwhile. Entering Send signalled on entered.
+type testBlockingSession struct {
+	sink    chan []byte
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *testBlockingSession) Send(msg []byte) error {
+	select {
+	case s.entered <- struct{}{}:
+	default:
+	}
+	<-s.release
+	s.sink <- msg
+	return nil
+}
+
+func (s *testBlockingSession) Close(status uint32, reason string) error {
+	return nil
+}
+
+func TestClientBatchMessages(t *testing.T) {
+	app := testApp()
+	app.config.ClientMessageBatching = true
+	app.config.ClientMessageBatchMaxSize = 64
+	sess := &testBlockingSession{sink: make(chan []byte, 16), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	c, err := newClient(app, sess, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	c.send([]byte(`{"method":"message","body":1}`))
+	// Wait until first message taken from queue and being sent.
+	<-sess.entered
+	c.send([]byte(`{"method":"message","body":2}`))
+	c.send([]byte(`[{"method":"ping"}]`))
+	// Does not fit into batch.
+	c.send([]byte(`{"method":"message","body":3}`))
+	close(sess.release)
+
+	assert.Equal(t, `{"method":"message","body":1}`, string(<-sess.sink))
+	assert.Equal(t, `[{"method":"message","body":2},{"method":"ping"}]`, string(<-sess.sink))
+	assert.Equal(t, `{"method":"message","body":3}`, string(<-sess.sink))
+	assert.Equal(t, int64(4), app.metrics.NumMsgSent.LoadRaw())
+	c.clean()
+}
+
+func TestClientBatchMessagesDisabled(t *testing.T) {
+	app := testApp()
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, c.batchMaxSize)
+
+	app.config.ClientMessageBatching = true
+	c, err = newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 65536, c.batchMaxSize)
+
+	// SSE sends every message as separate event.
+	c, err = newClient(app, &streamConn{batch: false}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, c.batchMaxSize)
+}
+
+// testFileSession writes every message into file so every send is a syscall
+// as when writing into real connection.
+type testFileSession struct {
+	f *os.File
+}
+
+func (s *testFileSession) Send(msg []byte) error {
+	_, err := s.f.Write(msg)
+	return err
+}
+
+func (s *testFileSession) Close(status uint32, reason string) error {
+	return nil
+}
+
+// benchmarkClientSendMessages measures throughput of messages sent to client
+// when message rate is high.
+func benchmarkClientSendMessages(b *testing.B, batching bool) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	app := testApp()
+	app.config.ClientMessageBatching = batching
+	c, err := newClient(app, &testFileSession{f}, jsonClientEncoding)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.clean()
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("test"), []byte(`{"input":"test"}`), "", nil)
+	message, _ := json.Marshal(resp)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for c.messages.Len() > 1000 {
+			runtime.Gosched()
+		}
+		c.send(message)
+	}
+	for app.metrics.NumMsgSent.LoadRaw() < int64(b.N) {
+		runtime.Gosched()
+	}
+}
+
+func BenchmarkClientSendMessages(b *testing.B) {
+	benchmarkClientSendMessages(b, false)
+}
+
+func BenchmarkClientSendMessagesBatching(b *testing.B) {
+	benchmarkClientSendMessages(b, true)
 }
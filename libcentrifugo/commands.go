@@ -45,7 +45,9 @@ type controlCommand struct {
 // ConnectClientCommand is a command to authorize connection - it contains user ID
 // in web application, additional connection information as JSON string, timestamp
 // with unix seconds on moment when connect parameters generated and HMAC token to
-// prove correctness of all those parameters.
+// prove correctness of all those parameters. Alternatively Token can be a signed
+// JWT carrying user ID, expiration time and info in its claims – in this case
+// User, Timestamp and Info fields are ignored.
 type ConnectClientCommand struct {
 	User      UserID `json:"user"`
 	Timestamp string `json:"timestamp"`
@@ -55,6 +57,7 @@ type ConnectClientCommand struct {
 
 // RefreshClientCommand is used to prolong connection lifetime when connection check
 // mechanism is enabled. It can only be sent by client after successfull connect.
+// Connections authenticated with JWT must be refreshed with new JWT in Token field.
 type RefreshClientCommand struct {
 	User      UserID `json:"user"`
 	Timestamp string `json:"timestamp"`
@@ -65,13 +68,22 @@ type RefreshClientCommand struct {
 // SubscribeClientCommand is used to subscribe on channel.
 // It can only be sent by client after successfull connect.
 // It also can have Client, Info and Sign properties when channel is private.
+// Instead of Client, Info and Sign private channel subscription can be authorized
+// with Token – JWT issued for user and channel which can be reused over reconnects.
+// Recover flag with Seq and Epoch of last message client received in channel
+// allows to recover messages missed while client was not subscribed. Clients
+// which do not know Seq and Epoch yet can send UID of last message received
+// as Last instead.
 type SubscribeClientCommand struct {
 	Channel Channel   `json:"channel"`
 	Client  ConnID    `json:"client"`
-	Last    MessageID `json:"last"`
 	Recover bool      `json:"recover"`
+	Seq     uint64    `json:"seq,omitempty"`
+	Epoch   string    `json:"epoch,omitempty"`
+	Last    MessageID `json:"last,omitempty"`
 	Info    string    `json:"info"`
 	Sign    string    `json:"sign"`
+	Token   string    `json:"token,omitempty"`
 }
 
 // UnsubscribeClientCommand is used to unsubscribe from channel.
@@ -91,9 +103,14 @@ type PresenceClientCommand struct {
 	Channel Channel `json:"channel"`
 }
 
-// HistoryClientCommand is used to get history information for channel.
+// HistoryClientCommand is used to get history information for channel. Since,
+// Limit and Direction allow to page through history using message sequence
+// numbers, see HistoryOptions.
 type HistoryClientCommand struct {
-	Channel Channel `json:"channel"`
+	Channel   Channel `json:"channel"`
+	Since     uint64  `json:"since,omitempty"`
+	Limit     int     `json:"limit,omitempty"`
+	Direction string  `json:"direction,omitempty"`
 }
 
 // PingClientCommand is used to ping server.
@@ -115,6 +132,12 @@ type broadcastAPICommand struct {
 	Client   ConnID
 }
 
+// subscribeApiCommand is used to subscribe user on channel.
+type subscribeAPICommand struct {
+	Channel Channel
+	User    UserID
+}
+
 // unsubscribeApiCommand is used to unsubscribe user from channel.
 type unsubscribeAPICommand struct {
 	Channel Channel
@@ -134,7 +157,10 @@ type presenceAPICommand struct {
 
 // historyApiCommand is used to get history information for channel.
 type historyAPICommand struct {
-	Channel Channel
+	Channel   Channel
+	Since     uint64
+	Limit     int
+	Direction string
 }
 
 // pingControlCommand allows nodes to know about each other - node sends this
@@ -143,6 +169,14 @@ type pingControlCommand struct {
 	Info NodeInfo
 }
 
+// subscribeControlCommand required when node received subscribe API command –
+// node subscribes user on channel and then send this control command so other
+// nodes could subscribe user too.
+type subscribeControlCommand struct {
+	User    UserID
+	Channel Channel
+}
+
 // unsubscribeControlCommand required when node received unsubscribe API command –
 // node unsubscribes user from channel and then send this control command so other
 // nodes could unsubscribe user too.
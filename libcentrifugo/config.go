@@ -1,9 +1,14 @@
 package libcentrifugo
 
 import (
+	"compress/flate"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"errors"
 	"regexp"
 	"time"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
 )
 
 // ChannelOptions represent channel specific configuration for namespace or project in a whole
@@ -54,6 +59,16 @@ type ChannelOptions struct {
 	// least one active subscriber. This can give a huge memory saving, with only minor edgecases that are
 	// different from without it as noted on https://github.com/centrifugal/centrifugo/issues/50.
 	HistoryDropInactive bool `mapstructure:"history_drop_inactive" json:"history_drop_inactive"`
+
+	// PublishProxy turns on forwarding of messages clients publish into channel to
+	// PublishProxyEndpoint. Backend can accept, reject or rewrite data of message
+	// before it's published so clients can publish without Publish option on.
+	PublishProxy bool `mapstructure:"publish_proxy" json:"publish_proxy"`
+
+	// SubscribeProxy turns on authorization of subscriptions on non-private channels
+	// by SubscribeProxyEndpoint. Backend decides whether client can subscribe and can
+	// set channel info for connection.
+	SubscribeProxy bool `mapstructure:"subscribe_proxy" json:"subscribe_proxy"`
 }
 
 // NamespaceKey is a name of namespace unique for project.
@@ -135,6 +150,16 @@ type Config struct {
 
 	// ClientRequestMaxSize sets maximum size in bytes of allowed client request.
 	ClientRequestMaxSize int `json:"client_request_max_size"`
+
+	// WebsocketCompression enables permessage-deflate compression of raw websocket
+	// connections for clients supporting it.
+	WebsocketCompression bool `json:"websocket_compression"`
+	// WebsocketCompressionLevel is a compression level from -2 to 9 as defined in
+	// compress/flate package, 1 (best speed) by default.
+	WebsocketCompressionLevel int `json:"websocket_compression_level"`
+	// WebsocketCompressionMinSize is a minimal size of message in bytes to compress,
+	// smaller messages sent uncompressed as compressing them is not worth it.
+	WebsocketCompressionMinSize int `json:"websocket_compression_min_size"`
 	// ClientQueueMaxSize is a maximum size of client's message queue in bytes.
 	// After this queue size exceeded Centrifugo closes client's connection.
 	ClientQueueMaxSize int `json:"client_queue_max_size"`
@@ -145,6 +170,14 @@ type Config struct {
 	// consumption per client connection grows with this option.
 	ClientQueueInitialCapacity int `json:"client_queue_initial_capacity"`
 
+	// ClientMessageBatching enables joining messages queued for client into one
+	// message so they are sent in one write (one websocket frame) when client
+	// can't keep up with message rate.
+	ClientMessageBatching bool `json:"client_message_batching"`
+	// ClientMessageBatchMaxSize is a maximum size in bytes of joined message,
+	// messages larger than it sent as is.
+	ClientMessageBatchMaxSize int `json:"client_message_batch_max_size"`
+
 	// ClientChannelLimit sets upper limit of channels each client can subscribe to.
 	ClientChannelLimit int `json:"client_channel_limit"`
 
@@ -181,10 +214,49 @@ type Config struct {
 
 	// Secret is a secret key, used to sign API requests and client connection tokens.
 	Secret string `json:"secret"`
+	// SecretID is an optional ID of primary Secret used as "kid" header in JWTs.
+	SecretID string `json:"-"`
+	// Secrets is a list of additional secrets accepted when checking API signs, client
+	// tokens and channel signs. This allows to rotate Secret without simultaneous
+	// switch of all backends and clients – new secret becomes primary Secret while
+	// previous one stays here until nobody uses it anymore.
+	Secrets []auth.Secret `json:"-"`
+
+	// GRPCAPIKey is a key gRPC API calls must provide in "authorization" metadata
+	// as "apikey <KEY>". Calls are rejected if it's not set and InsecureAPI is off.
+	GRPCAPIKey string `json:"grpc_api_key"`
+
+	// TokenRSAPublicKey is a public key used to verify RS256 signed client JWTs.
+	// If not set then RS256 tokens are rejected.
+	TokenRSAPublicKey *rsa.PublicKey `json:"-"`
+	// TokenECDSAPublicKey is a public key used to verify ES256 signed client JWTs.
+	// If not set then ES256 tokens are rejected.
+	TokenECDSAPublicKey *ecdsa.PublicKey `json:"-"`
 
 	// ConnLifetime determines time until connection expire, 0 means no connection expire at all.
 	ConnLifetime int64 `json:"connection_lifetime"`
 
+	// ConnectProxyEndpoint is a backend URL Centrifugo asks to authenticate clients
+	// connecting without token. Request contains headers of client connection request
+	// listed in ProxyHeaders. Refresh command without token asks it again to extend
+	// connection. Empty value disables connect proxy.
+	ConnectProxyEndpoint string `json:"connect_proxy_endpoint"`
+	// ConnectProxyTimeout is a timeout of request to connect proxy endpoint.
+	ConnectProxyTimeout time.Duration `json:"connect_proxy_timeout"`
+	// PublishProxyEndpoint is a backend URL client publications forwarded to in
+	// channels with PublishProxy option on.
+	PublishProxyEndpoint string `json:"publish_proxy_endpoint"`
+	// PublishProxyTimeout is a timeout of request to publish proxy endpoint.
+	PublishProxyTimeout time.Duration `json:"publish_proxy_timeout"`
+	// SubscribeProxyEndpoint is a backend URL asked to authorize subscriptions on
+	// channels with SubscribeProxy option on.
+	SubscribeProxyEndpoint string `json:"subscribe_proxy_endpoint"`
+	// SubscribeProxyTimeout is a timeout of request to subscribe proxy endpoint.
+	SubscribeProxyTimeout time.Duration `json:"subscribe_proxy_timeout"`
+	// ProxyHeaders is a list of headers of client connection request forwarded to
+	// proxy endpoints.
+	ProxyHeaders []string `json:"proxy_headers"`
+
 	// ChannelOptions embedded to config.
 	ChannelOptions `json:"channel_options"`
 
@@ -219,9 +291,72 @@ func (c *Config) Validate() error {
 		nss = append(nss, name)
 	}
 
+	var secretIDs []string
+	for _, secret := range c.secrets() {
+		if secret.ID == "" {
+			continue
+		}
+		if stringInSlice(secret.ID, secretIDs) {
+			return errors.New(errPrefix + "secret id must be unique – " + secret.ID)
+		}
+		secretIDs = append(secretIDs, secret.ID)
+	}
+
+	publishProxy := func(opts ChannelOptions) bool { return opts.PublishProxy }
+	if c.PublishProxyEndpoint == "" && c.anyChannelOptions(publishProxy) {
+		return errors.New(errPrefix + "publish proxy endpoint required when publish proxy enabled")
+	}
+
+	subscribeProxy := func(opts ChannelOptions) bool { return opts.SubscribeProxy }
+	if c.SubscribeProxyEndpoint == "" && c.anyChannelOptions(subscribeProxy) {
+		return errors.New(errPrefix + "subscribe proxy endpoint required when subscribe proxy enabled")
+	}
+
+	if c.ClientMessageBatching && c.ClientMessageBatchMaxSize <= 0 {
+		return errors.New(errPrefix + "client message batch max size must be positive")
+	}
+
+	if c.WebsocketCompression {
+		if c.WebsocketCompressionLevel < flate.HuffmanOnly || c.WebsocketCompressionLevel > flate.BestCompression {
+			return errors.New(errPrefix + "websocket compression level must be in range from -2 to 9")
+		}
+		if c.WebsocketCompressionMinSize < 0 {
+			return errors.New(errPrefix + "websocket compression min size must not be negative")
+		}
+	}
+
 	return nil
 }
 
+// anyChannelOptions reports whether project or any namespace channel options
+// satisfy f.
+func (c *Config) anyChannelOptions(f func(opts ChannelOptions) bool) bool {
+	if f(c.ChannelOptions) {
+		return true
+	}
+	for _, n := range c.Namespaces {
+		if f(n.ChannelOptions) {
+			return true
+		}
+	}
+	return false
+}
+
+// secrets returns all active secrets, primary secret goes first.
+func (c *Config) secrets() []auth.Secret {
+	secrets := make([]auth.Secret, 0, len(c.Secrets)+1)
+	if c.Secret != "" {
+		secrets = append(secrets, auth.Secret{ID: c.SecretID, Key: c.Secret})
+	}
+	for _, secret := range c.Secrets {
+		if secret.Key == "" || secret.Key == c.Secret {
+			continue
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets
+}
+
 // channelOpts searches for channel options for specified namespace key.
 func (c *Config) channelOpts(nk NamespaceKey) (ChannelOptions, error) {
 	if nk == NamespaceKey("") {
@@ -271,5 +406,18 @@ var DefaultConfig = &Config{
 	ClientQueueMaxSize:          10485760, // 10MB by default
 	ClientQueueInitialCapacity:  2,
 	ClientChannelLimit:          100,
+	ClientMessageBatchMaxSize:   65536, // 64KB by default
+	WebsocketCompressionLevel:   flate.BestSpeed,
 	Insecure:                    false,
+	ConnectProxyTimeout:         time.Second,
+	PublishProxyTimeout:         time.Second,
+	SubscribeProxyTimeout:       time.Second,
+	ProxyHeaders: []string{
+		"Cookie",
+		"Authorization",
+		"User-Agent",
+		"Origin",
+		"X-Real-Ip",
+		"X-Forwarded-For",
+	},
 }
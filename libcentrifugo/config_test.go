@@ -3,6 +3,7 @@ package libcentrifugo
 import (
 	"testing"
 
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -70,3 +71,63 @@ func TestValidateErrorNamespaceWrongName(t *testing.T) {
 	err := c.Validate()
 	assert.NotEqual(t, nil, err)
 }
+
+func TestValidateErrorSecretIDNotUnique(t *testing.T) {
+	c := *DefaultConfig
+	c.Secret = "secret"
+	c.SecretID = "1"
+	c.Secrets = []auth.Secret{{ID: "1", Key: "old secret"}}
+	err := c.Validate()
+	assert.NotEqual(t, nil, err)
+}
+
+func TestConfigSecrets(t *testing.T) {
+	c := *DefaultConfig
+	c.Secret = "secret"
+	c.SecretID = "2"
+	c.Secrets = []auth.Secret{{ID: "1", Key: "old secret"}, {Key: ""}, {Key: "secret"}}
+	secrets := c.secrets()
+	assert.Equal(t, 2, len(secrets))
+	assert.Equal(t, auth.Secret{ID: "2", Key: "secret"}, secrets[0])
+	assert.Equal(t, auth.Secret{ID: "1", Key: "old secret"}, secrets[1])
+}
+
+func TestValidateWebsocketCompression(t *testing.T) {
+	c := newTestConfig()
+	c.WebsocketCompression = true
+	assert.Equal(t, nil, c.Validate())
+	c.WebsocketCompressionLevel = 10
+	assert.NotEqual(t, nil, c.Validate())
+	c.WebsocketCompressionLevel = 1
+	c.WebsocketCompressionMinSize = -1
+	assert.NotEqual(t, nil, c.Validate())
+}
+
+func TestValidateClientMessageBatching(t *testing.T) {
+	c := newTestConfig()
+	c.ClientMessageBatching = true
+	c.ClientMessageBatchMaxSize = 65536
+	assert.Equal(t, nil, c.Validate())
+	c.ClientMessageBatchMaxSize = 0
+	assert.NotEqual(t, nil, c.Validate())
+}
+
+func TestValidatePublishProxy(t *testing.T) {
+	c := newTestConfig()
+	c.Namespaces[0].PublishProxy = true
+	assert.NotEqual(t, nil, c.Validate())
+	c.PublishProxyEndpoint = "http://localhost:3000/publish"
+	assert.Equal(t, nil, c.Validate())
+	c.Namespaces[0].PublishProxy = false
+	c.PublishProxy = true
+	c.PublishProxyEndpoint = ""
+	assert.NotEqual(t, nil, c.Validate())
+}
+
+func TestValidateSubscribeProxy(t *testing.T) {
+	c := newTestConfig()
+	c.Namespaces[0].SubscribeProxy = true
+	assert.NotEqual(t, nil, c.Validate())
+	c.SubscribeProxyEndpoint = "http://localhost:3000/subscribe"
+	assert.Equal(t, nil, c.Validate())
+}
@@ -9,14 +9,25 @@ type clientConn interface {
 	user() UserID
 	// channels returns a slice of channels connection subscribed to.
 	channels() []Channel
-	// send allows to send message to connection client.
+	// encoding returns client protocol encoding connection uses.
+	encoding() clientEncoding
+	// send allows to send message encoded with connection encoding to client.
 	send(message []byte) error
+	// subscribe allows to subscribe connection on channel.
+	subscribe(ch Channel) error
 	// unsubscribe allows to unsubscribe connection from channel.
 	unsubscribe(ch Channel) error
 	// close closes client's connection.
 	close(reason string) error
 }
 
+// preparedConn is a connection which can send websocket frame of broadcast
+// message prepared once for all connections message broadcast to.
+type preparedConn interface {
+	// sendPrepared allows to send broadcast message to client.
+	sendPrepared(msg *broadcastMessage) error
+}
+
 // adminConn is an interface abstracting all methods used
 // by application to interact with admin connection.
 type adminConn interface {
@@ -0,0 +1,543 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/protobuf"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ProtobufSubprotocol is a Websocket subprotocol name client can request to
+	// use binary Protocol Buffers client protocol over raw Websocket connection.
+	ProtobufSubprotocol = "centrifugo-protobuf"
+)
+
+// clientEncoding is a wire format of client protocol. JSON is a default encoding,
+// raw Websocket connections can also use Protocol Buffers described in client.proto.
+type clientEncoding interface {
+	// name returns encoding name.
+	name() string
+	// frameType returns type of Websocket frames to send encoded messages in.
+	frameType() int
+	// decodeCommands decodes commands sent by client in one message.
+	decodeCommands(data []byte) ([]clientCommand, error)
+	// decodeParams decodes command params into pointer to command struct.
+	decodeParams(params []byte, cmd interface{}) error
+	// encodeResponse encodes single response.
+	encodeResponse(resp *clientResponse) ([]byte, error)
+	// encodeResponses encodes responses to commands sent by client in one message.
+	encodeResponses(mr multiClientResponse) ([]byte, error)
+	// encodeBroadcast converts JSON encoded response published into channel (message,
+	// join or leave) into this encoding.
+	encodeBroadcast(message []byte) ([]byte, error)
+	// joinMessages joins several encoded messages sent to client into one message
+	// client decodes as if responses were sent in one message.
+	joinMessages(messages [][]byte) []byte
+}
+
+var (
+	jsonClientEncoding     clientEncoding = jsonEncoding{}
+	protobufClientEncoding clientEncoding = protobufEncoding{}
+)
+
+var errUnknownBody = errors.New("unknown response body")
+
+// rawWSEncoding returns encoding client requested when connected to raw Websocket
+// endpoint and Websocket response headers to confirm it.
+func rawWSEncoding(r *http.Request) (clientEncoding, http.Header) {
+	for _, subprotocol := range websocket.Subprotocols(r) {
+		if subprotocol == ProtobufSubprotocol {
+			return protobufClientEncoding, http.Header{"Sec-Websocket-Protocol": []string{ProtobufSubprotocol}}
+		}
+	}
+	if r.URL.Query().Get("format") == protobufClientEncoding.name() {
+		return protobufClientEncoding, nil
+	}
+	return jsonClientEncoding, nil
+}
+
+type jsonEncoding struct{}
+
+func (e jsonEncoding) name() string {
+	return "json"
+}
+
+func (e jsonEncoding) frameType() int {
+	return websocket.TextMessage
+}
+
+func (e jsonEncoding) decodeCommands(data []byte) ([]clientCommand, error) {
+	return cmdFromClientMsg(data)
+}
+
+func (e jsonEncoding) decodeParams(params []byte, cmd interface{}) error {
+	return json.Unmarshal(params, cmd)
+}
+
+func (e jsonEncoding) encodeResponse(resp *clientResponse) ([]byte, error) {
+	return json.Marshal(resp)
+}
+
+func (e jsonEncoding) encodeResponses(mr multiClientResponse) ([]byte, error) {
+	return json.Marshal(mr)
+}
+
+func (e jsonEncoding) encodeBroadcast(message []byte) ([]byte, error) {
+	return message, nil
+}
+
+// joinMessages joins JSON encoded responses into JSON array. Arrays of responses
+// to client commands flattened into it.
+func (e jsonEncoding) joinMessages(messages [][]byte) []byte {
+	size := len(messages) + 1
+	for _, message := range messages {
+		size += len(message)
+	}
+	joined := make([]byte, 0, size)
+	joined = append(joined, arrayJSONPrefix)
+	for _, message := range messages {
+		if len(message) > 1 && message[0] == arrayJSONPrefix {
+			message = message[1 : len(message)-1]
+			if len(message) == 0 {
+				continue
+			}
+		}
+		if len(joined) > 1 {
+			joined = append(joined, ',')
+		}
+		joined = append(joined, message...)
+	}
+	return append(joined, ']')
+}
+
+// protobufEncoding implements binary client protocol. Command params and
+// response bodies are encoded into separate messages so clientCommand Params
+// contain raw protobuf bytes here.
+type protobufEncoding struct{}
+
+func (e protobufEncoding) name() string {
+	return "protobuf"
+}
+
+func (e protobufEncoding) frameType() int {
+	return websocket.BinaryMessage
+}
+
+func (e protobufEncoding) decodeCommands(data []byte) ([]clientCommand, error) {
+	msgs, err := protobuf.SplitDelimited(data)
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]clientCommand, 0, len(msgs))
+	for _, msg := range msgs {
+		var cmd clientCommand
+		d := protobuf.NewDecoder(msg)
+		for d.Next() {
+			switch d.Field() {
+			case 1:
+				cmd.UID = d.String()
+			case 2:
+				cmd.Method = d.String()
+			case 3:
+				cmd.Params = d.Bytes()
+			default:
+				d.Skip()
+			}
+		}
+		if d.Err() != nil {
+			return nil, d.Err()
+		}
+		commands = append(commands, cmd)
+	}
+	return commands, nil
+}
+
+func (e protobufEncoding) decodeParams(params []byte, cmd interface{}) error {
+	return decodeProtobufParams(params, cmd)
+}
+
+// decodeProtobufParams decodes client or API command params encoded into
+// corresponding request message from client.proto or api.proto.
+func decodeProtobufParams(params []byte, cmd interface{}) error {
+	d := protobuf.NewDecoder(params)
+	for d.Next() {
+		field := d.Field()
+		switch cmd := cmd.(type) {
+		case *ConnectClientCommand:
+			decodeCredentials(d, field, &cmd.User, &cmd.Timestamp, &cmd.Info, &cmd.Token)
+		case *RefreshClientCommand:
+			decodeCredentials(d, field, &cmd.User, &cmd.Timestamp, &cmd.Info, &cmd.Token)
+		case *SubscribeClientCommand:
+			switch field {
+			case 1:
+				cmd.Channel = Channel(d.String())
+			case 2:
+				cmd.Client = ConnID(d.String())
+			case 4:
+				cmd.Recover = d.Bool()
+			case 5:
+				cmd.Info = d.String()
+			case 6:
+				cmd.Sign = d.String()
+			case 7:
+				cmd.Token = d.String()
+			case 8:
+				cmd.Seq = d.Varint()
+			case 9:
+				cmd.Epoch = d.String()
+			default:
+				d.Skip()
+			}
+		case *UnsubscribeClientCommand:
+			decodeChannel(d, field, &cmd.Channel)
+		case *PublishClientCommand:
+			switch field {
+			case 1:
+				cmd.Channel = Channel(d.String())
+			case 2:
+				cmd.Data = json.RawMessage(append([]byte(nil), d.Bytes()...))
+			default:
+				d.Skip()
+			}
+		case *PresenceClientCommand:
+			decodeChannel(d, field, &cmd.Channel)
+		case *HistoryClientCommand:
+			decodeHistoryParams(d, field, &cmd.Channel, &cmd.Since, &cmd.Limit, &cmd.Direction)
+		case *PingClientCommand:
+			if field == 1 {
+				cmd.Data = d.String()
+			} else {
+				d.Skip()
+			}
+		case *publishAPICommand:
+			switch field {
+			case 1:
+				cmd.Channel = Channel(d.String())
+			case 2:
+				cmd.Data = json.RawMessage(append([]byte(nil), d.Bytes()...))
+			case 3:
+				cmd.Client = ConnID(d.String())
+			default:
+				d.Skip()
+			}
+		case *broadcastAPICommand:
+			switch field {
+			case 1:
+				cmd.Channels = append(cmd.Channels, Channel(d.String()))
+			case 2:
+				cmd.Data = json.RawMessage(append([]byte(nil), d.Bytes()...))
+			case 3:
+				cmd.Client = ConnID(d.String())
+			default:
+				d.Skip()
+			}
+		case *subscribeAPICommand:
+			switch field {
+			case 1:
+				cmd.Channel = Channel(d.String())
+			case 2:
+				cmd.User = UserID(d.String())
+			default:
+				d.Skip()
+			}
+		case *unsubscribeAPICommand:
+			switch field {
+			case 1:
+				cmd.Channel = Channel(d.String())
+			case 2:
+				cmd.User = UserID(d.String())
+			default:
+				d.Skip()
+			}
+		case *disconnectAPICommand:
+			if field == 1 {
+				cmd.User = UserID(d.String())
+			} else {
+				d.Skip()
+			}
+		case *presenceAPICommand:
+			decodeChannel(d, field, &cmd.Channel)
+		case *historyAPICommand:
+			decodeHistoryParams(d, field, &cmd.Channel, &cmd.Since, &cmd.Limit, &cmd.Direction)
+		default:
+			return ErrInvalidMessage
+		}
+	}
+	return d.Err()
+}
+
+func decodeChannel(d *protobuf.Decoder, field int, ch *Channel) {
+	if field == 1 {
+		*ch = Channel(d.String())
+		return
+	}
+	d.Skip()
+}
+
+func decodeHistoryParams(d *protobuf.Decoder, field int, ch *Channel, since *uint64, limit *int, direction *string) {
+	switch field {
+	case 1:
+		*ch = Channel(d.String())
+	case 2:
+		*since = d.Varint()
+	case 3:
+		*limit = int(d.Int64())
+	case 4:
+		*direction = d.String()
+	default:
+		d.Skip()
+	}
+}
+
+func decodeCredentials(d *protobuf.Decoder, field int, user *UserID, timestamp, info, token *string) {
+	switch field {
+	case 1:
+		*user = UserID(d.String())
+	case 2:
+		*timestamp = d.String()
+	case 3:
+		*info = d.String()
+	case 4:
+		*token = d.String()
+	default:
+		d.Skip()
+	}
+}
+
+func (e protobufEncoding) encodeResponse(resp *clientResponse) ([]byte, error) {
+	return e.encodeResponses(multiClientResponse{resp})
+}
+
+func (e protobufEncoding) encodeResponses(mr multiClientResponse) ([]byte, error) {
+	frame := protobuf.NewBuffer(nil)
+	reply := protobuf.NewBuffer(nil)
+	for _, resp := range mr {
+		reply.Reset()
+		reply.EncodeString(1, resp.UID)
+		reply.EncodeString(2, resp.Method)
+		reply.EncodeString(3, resp.Error)
+		reply.EncodeString(4, string(resp.Advice))
+		if resp.Body != nil {
+			body, err := encodeBody(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			reply.EncodeMessage(5, body)
+		}
+		frame.EncodeDelimited(reply.Bytes())
+	}
+	return frame.Bytes(), nil
+}
+
+// joinMessages concatenates messages as every message is a sequence of length
+// delimited replies already.
+func (e protobufEncoding) joinMessages(messages [][]byte) []byte {
+	size := 0
+	for _, message := range messages {
+		size += len(message)
+	}
+	joined := make([]byte, 0, size)
+	for _, message := range messages {
+		joined = append(joined, message...)
+	}
+	return joined
+}
+
+func (e protobufEncoding) encodeBroadcast(message []byte) ([]byte, error) {
+	var published struct {
+		Method string          `json:"method"`
+		Body   json.RawMessage `json:"body"`
+	}
+	err := json.Unmarshal(message, &published)
+	if err != nil {
+		return nil, err
+	}
+	resp := newClientResponse(published.Method)
+	switch published.Method {
+	case "message":
+		var body Message
+		err = json.Unmarshal(published.Body, &body)
+		resp.Body = &body
+	case "join", "leave":
+		var body JoinLeaveBody
+		err = json.Unmarshal(published.Body, &body)
+		resp.Body = &body
+	default:
+		return nil, ErrInvalidMessage
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e.encodeResponse(resp)
+}
+
+// encodeBody encodes response body into corresponding message from client.proto.
+func encodeBody(body interface{}) ([]byte, error) {
+	b := protobuf.NewBuffer(nil)
+	switch body := body.(type) {
+	case *ConnectBody:
+		b.EncodeString(1, body.Version)
+		b.EncodeString(2, string(body.Client))
+		b.EncodeBool(3, body.Expires)
+		b.EncodeBool(4, body.Expired)
+		b.EncodeInt64(5, body.TTL)
+		for i := range body.Subscriptions {
+			sub, err := encodeBody(&body.Subscriptions[i])
+			if err != nil {
+				return nil, err
+			}
+			b.EncodeMessage(6, sub)
+		}
+	case *SubscribeBody:
+		b.EncodeString(1, string(body.Channel))
+		b.EncodeBool(2, body.Status)
+		for i := range body.Messages {
+			b.EncodeMessage(4, encodeMessage(&body.Messages[i]))
+		}
+		b.EncodeBool(5, body.Recovered)
+		b.EncodeInt64(6, int64(body.Seq))
+		b.EncodeString(7, body.Epoch)
+	case *UnsubscribeBody:
+		b.EncodeString(1, string(body.Channel))
+		b.EncodeBool(2, body.Status)
+	case *PublishBody:
+		b.EncodeString(1, string(body.Channel))
+		b.EncodeBool(2, body.Status)
+	case *PresenceBody:
+		b.EncodeString(1, string(body.Channel))
+		entry := protobuf.NewBuffer(nil)
+		for uid, info := range body.Data {
+			entry.Reset()
+			entry.EncodeString(1, string(uid))
+			entry.EncodeMessage(2, encodeClientInfo(&info))
+			b.EncodeMessage(2, entry.Bytes())
+		}
+	case *HistoryBody:
+		b.EncodeString(1, string(body.Channel))
+		for i := range body.Data {
+			b.EncodeMessage(2, encodeMessage(&body.Data[i]))
+		}
+	case *PingBody:
+		b.EncodeString(1, body.Data)
+	case *DisconnectBody:
+		b.EncodeString(1, body.Reason)
+		b.EncodeBool(2, body.Reconnect)
+	case *Message:
+		return encodeMessage(body), nil
+	case *JoinLeaveBody:
+		b.EncodeString(1, string(body.Channel))
+		b.EncodeMessage(2, encodeClientInfo(&body.Data))
+	case *ChannelsBody:
+		for _, ch := range body.Data {
+			b.EncodeMessage(1, []byte(ch))
+		}
+	case *StatsBody:
+		for i := range body.Data.Nodes {
+			node, err := encodeNodeInfo(&body.Data.Nodes[i])
+			if err != nil {
+				return nil, err
+			}
+			b.EncodeMessage(1, node)
+		}
+		b.EncodeInt64(2, body.Data.MetricsInterval)
+	case *NodeBody:
+		node, err := encodeNodeInfo(&body.Data)
+		if err != nil {
+			return nil, err
+		}
+		b.EncodeMessage(1, node)
+	default:
+		return nil, errUnknownBody
+	}
+	return b.Bytes(), nil
+}
+
+func encodeMessage(msg *Message) []byte {
+	b := protobuf.NewBuffer(nil)
+	b.EncodeString(1, string(msg.UID))
+	b.EncodeString(2, msg.Timestamp)
+	if msg.Info != nil {
+		b.EncodeMessage(3, encodeClientInfo(msg.Info))
+	}
+	b.EncodeString(4, string(msg.Channel))
+	if msg.Data != nil {
+		b.EncodeBytes(5, *msg.Data)
+	} else if msg.Binary != nil {
+		b.EncodeBytes(5, msg.Binary)
+	}
+	b.EncodeString(6, string(msg.Client))
+	b.EncodeInt64(7, int64(msg.Seq))
+	b.EncodeString(8, msg.Epoch)
+	return b.Bytes()
+}
+
+func encodeClientInfo(info *ClientInfo) []byte {
+	b := protobuf.NewBuffer(nil)
+	b.EncodeString(1, string(info.User))
+	b.EncodeString(2, string(info.Client))
+	if info.DefaultInfo != nil {
+		b.EncodeBytes(3, *info.DefaultInfo)
+	}
+	if info.ChannelInfo != nil {
+		b.EncodeBytes(4, *info.ChannelInfo)
+	}
+	return b.Bytes()
+}
+
+func encodeNodeInfo(info *NodeInfo) ([]byte, error) {
+	b := protobuf.NewBuffer(nil)
+	b.EncodeString(1, info.UID)
+	b.EncodeString(2, info.Name)
+	b.EncodeInt64(3, int64(info.Goroutines))
+	b.EncodeInt64(4, int64(info.Clients))
+	b.EncodeInt64(5, int64(info.Unique))
+	b.EncodeInt64(6, int64(info.Channels))
+	b.EncodeInt64(7, info.Started)
+	b.EncodeInt64(8, int64(info.Gomaxprocs))
+	b.EncodeInt64(9, int64(info.NumCPU))
+	// Metrics encoded as map using JSON names so protocol does not need to
+	// change every time new metric added. Command times encoded separately.
+	metrics := info.Metrics
+	metrics.TimeClient = nil
+	metrics.TimeAPI = nil
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]int64
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return nil, err
+	}
+	entry := protobuf.NewBuffer(nil)
+	for name, value := range values {
+		entry.Reset()
+		entry.EncodeString(1, name)
+		entry.EncodeInt64(2, value)
+		b.EncodeMessage(10, entry.Bytes())
+	}
+	encodeTimeQuantiles(b, 11, info.TimeClient)
+	encodeTimeQuantiles(b, 12, info.TimeAPI)
+	return b.Bytes(), nil
+}
+
+// encodeTimeQuantiles encodes command times as map entries with method as key.
+func encodeTimeQuantiles(b *protobuf.Buffer, field int, times map[string]TimeQuantiles) {
+	entry := protobuf.NewBuffer(nil)
+	value := protobuf.NewBuffer(nil)
+	for method, q := range times {
+		value.Reset()
+		value.EncodeInt64(1, q.Count)
+		value.EncodeInt64(2, q.P50)
+		value.EncodeInt64(3, q.P90)
+		value.EncodeInt64(4, q.P99)
+		value.EncodeInt64(5, q.Max)
+		entry.Reset()
+		entry.EncodeString(1, method)
+		entry.EncodeMessage(2, value.Bytes())
+		b.EncodeMessage(field, entry.Bytes())
+	}
+}
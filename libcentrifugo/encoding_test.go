@@ -0,0 +1,291 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+type testProtobufReply struct {
+	UID    string
+	Method string
+	Error  string
+	Advice string
+	Body   []byte
+}
+
+func testProtobufCommands(cmds ...clientCommand) []byte {
+	frame := protobuf.NewBuffer(nil)
+	for _, cmd := range cmds {
+		b := protobuf.NewBuffer(nil)
+		b.EncodeString(1, cmd.UID)
+		b.EncodeString(2, cmd.Method)
+		b.EncodeBytes(3, cmd.Params)
+		frame.EncodeDelimited(b.Bytes())
+	}
+	return frame.Bytes()
+}
+
+func testDecodeProtobufReplies(t *testing.T, data []byte) []testProtobufReply {
+	msgs, err := protobuf.SplitDelimited(data)
+	assert.Equal(t, nil, err)
+	var replies []testProtobufReply
+	for _, msg := range msgs {
+		var reply testProtobufReply
+		d := protobuf.NewDecoder(msg)
+		for d.Next() {
+			switch d.Field() {
+			case 1:
+				reply.UID = d.String()
+			case 2:
+				reply.Method = d.String()
+			case 3:
+				reply.Error = d.String()
+			case 4:
+				reply.Advice = d.String()
+			case 5:
+				reply.Body = d.Bytes()
+			default:
+				d.Skip()
+			}
+		}
+		assert.Equal(t, nil, d.Err())
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// testDecodeProtobufFields returns values of message fields, all fields must be
+// length-delimited.
+func testDecodeProtobufFields(t *testing.T, data []byte) map[int][]byte {
+	fields := map[int][]byte{}
+	d := protobuf.NewDecoder(data)
+	for d.Next() {
+		fields[d.Field()] = d.Bytes()
+	}
+	assert.Equal(t, nil, d.Err())
+	return fields
+}
+
+func TestProtobufDecodeCommands(t *testing.T) {
+	params := protobuf.NewBuffer(nil)
+	params.EncodeString(1, "test:channel")
+	params.EncodeBool(4, true)
+	params.EncodeString(7, "token")
+	params.EncodeInt64(8, 10)
+	params.EncodeString(9, "epoch")
+	params.EncodeString(100, "unknown field")
+
+	data := testProtobufCommands(
+		clientCommand{UID: "1", Method: "ping"},
+		clientCommand{UID: "2", Method: "subscribe", Params: params.Bytes()},
+	)
+
+	commands, err := protobufClientEncoding.decodeCommands(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(commands))
+	assert.Equal(t, "ping", commands[0].Method)
+	assert.Equal(t, "2", commands[1].UID)
+
+	var cmd SubscribeClientCommand
+	err = protobufClientEncoding.decodeParams(commands[1].Params, &cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, SubscribeClientCommand{
+		Channel: "test:channel",
+		Recover: true,
+		Seq:     10,
+		Epoch:   "epoch",
+		Token:   "token",
+	}, cmd)
+
+	_, err = protobufClientEncoding.decodeCommands(data[:len(data)-1])
+	assert.NotEqual(t, nil, err)
+}
+
+func TestProtobufDecodePublish(t *testing.T) {
+	params := protobuf.NewBuffer(nil)
+	params.EncodeString(1, "channel")
+	params.EncodeBytes(2, []byte(`{"input": "test"}`))
+	var cmd PublishClientCommand
+	err := protobufClientEncoding.decodeParams(params.Bytes(), &cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Channel("channel"), cmd.Channel)
+	assert.Equal(t, `{"input": "test"}`, string(cmd.Data))
+
+	params = protobuf.NewBuffer(nil)
+	params.EncodeString(1, "channel")
+	params.EncodeBytes(2, []byte{0xff, 0x00})
+	err = protobufClientEncoding.decodeParams(params.Bytes(), &cmd)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0xff, 0x00}, []byte(cmd.Data))
+}
+
+func TestProtobufEncodeResponses(t *testing.T) {
+	connect := newClientResponse("connect")
+	connect.UID = "1"
+	connect.Body = &ConnectBody{
+		Version:       "1.0",
+		Client:        "client",
+		TTL:           60,
+		Subscriptions: []SubscribeBody{{Channel: "user#1", Status: true}},
+	}
+	subscribe := newClientResponse("subscribe")
+	subscribe.UID = "2"
+	subscribe.Body = &SubscribeBody{Channel: "channel"}
+	subscribe.Err(clientError{ErrPermissionDenied, errorAdviceFix})
+
+	data, err := protobufClientEncoding.encodeResponses(multiClientResponse{connect, subscribe})
+	assert.Equal(t, nil, err)
+	replies := testDecodeProtobufReplies(t, data)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "1", replies[0].UID)
+	assert.Equal(t, "", replies[0].Error)
+	assert.Equal(t, "subscribe", replies[1].Method)
+	assert.Equal(t, ErrPermissionDenied.Error(), replies[1].Error)
+	assert.Equal(t, string(errorAdviceFix), replies[1].Advice)
+
+	var version, client string
+	var ttl int64
+	var subs [][]byte
+	d := protobuf.NewDecoder(replies[0].Body)
+	for d.Next() {
+		switch d.Field() {
+		case 1:
+			version = d.String()
+		case 2:
+			client = d.String()
+		case 5:
+			ttl = d.Int64()
+		case 6:
+			subs = append(subs, d.Bytes())
+		default:
+			d.Skip()
+		}
+	}
+	assert.Equal(t, nil, d.Err())
+	assert.Equal(t, "1.0", version)
+	assert.Equal(t, "client", client)
+	assert.Equal(t, int64(60), ttl)
+	assert.Equal(t, 1, len(subs))
+	d = protobuf.NewDecoder(subs[0])
+	assert.Equal(t, true, d.Next())
+	assert.Equal(t, "user#1", d.String())
+
+	_, err = protobufClientEncoding.encodeResponse(&clientResponse{Method: "unknown", Body: "unknown"})
+	assert.Equal(t, errUnknownBody, err)
+}
+
+func TestProtobufEncodeBroadcast(t *testing.T) {
+	info := ClientInfo{User: "user", Client: "client"}
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("channel"), []byte(`{"input":"test"}`), "", &info)
+	message, err := json.Marshal(resp)
+	assert.Equal(t, nil, err)
+
+	encoded, err := jsonClientEncoding.encodeBroadcast(message)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, message, encoded)
+
+	encoded, err = protobufClientEncoding.encodeBroadcast(message)
+	assert.Equal(t, nil, err)
+	replies := testDecodeProtobufReplies(t, encoded)
+	assert.Equal(t, 1, len(replies))
+	assert.Equal(t, "message", replies[0].Method)
+	fields := testDecodeProtobufFields(t, replies[0].Body)
+	assert.Equal(t, string(resp.Body.UID), string(fields[1]))
+	assert.Equal(t, "channel", string(fields[4]))
+	assert.Equal(t, `{"input":"test"}`, string(fields[5]))
+	assert.Equal(t, "user", string(testDecodeProtobufFields(t, fields[3])[1]))
+
+	resp.Body = newMessage(Channel("channel"), []byte{0xff, 0x00}, "", nil)
+	message, _ = json.Marshal(resp)
+	encoded, err = protobufClientEncoding.encodeBroadcast(message)
+	assert.Equal(t, nil, err)
+	replies = testDecodeProtobufReplies(t, encoded)
+	fields = testDecodeProtobufFields(t, replies[0].Body)
+	assert.Equal(t, []byte{0xff, 0x00}, fields[5])
+
+	join := newClientResponse("join")
+	join.Body = &JoinLeaveBody{Channel: "channel", Data: info}
+	message, _ = json.Marshal(join)
+	encoded, err = protobufClientEncoding.encodeBroadcast(message)
+	assert.Equal(t, nil, err)
+	replies = testDecodeProtobufReplies(t, encoded)
+	assert.Equal(t, "join", replies[0].Method)
+	fields = testDecodeProtobufFields(t, replies[0].Body)
+	assert.Equal(t, "channel", string(fields[1]))
+	assert.Equal(t, "client", string(testDecodeProtobufFields(t, fields[2])[2]))
+}
+
+func TestProtobufEncodeNodeInfo(t *testing.T) {
+	info := &NodeInfo{UID: "uid"}
+	info.NumMsgPublished = 42
+	info.TimeAPI = map[string]TimeQuantiles{
+		"publish": {Count: 10, P50: 100, P90: 200, P99: 300, Max: 400},
+	}
+	data, err := encodeNodeInfo(info)
+	assert.Equal(t, nil, err)
+
+	metrics := map[string]int64{}
+	var times []byte
+	d := protobuf.NewDecoder(data)
+	for d.Next() {
+		switch d.Field() {
+		case 10:
+			entry := protobuf.NewDecoder(d.Bytes())
+			var name string
+			for entry.Next() {
+				if entry.Field() == 1 {
+					name = entry.String()
+				} else {
+					metrics[name] = entry.Int64()
+				}
+			}
+		case 12:
+			times = d.Bytes()
+		default:
+			d.Skip()
+		}
+	}
+	assert.Equal(t, nil, d.Err())
+	assert.Equal(t, int64(42), metrics["num_msg_published"])
+	_, ok := metrics["time_api"]
+	assert.False(t, ok)
+
+	entry := testDecodeProtobufFields(t, times)
+	assert.Equal(t, "publish", string(entry[1]))
+	var values []int64
+	d = protobuf.NewDecoder(entry[2])
+	for d.Next() {
+		values = append(values, d.Int64())
+	}
+	assert.Equal(t, []int64{10, 100, 200, 300, 400}, values)
+}
+
+func TestJSONJoinMessages(t *testing.T) {
+	joined := jsonClientEncoding.joinMessages([][]byte{
+		[]byte(`{"method":"message"}`),
+		[]byte(`[{"method":"ping"},{"method":"presence"}]`),
+		[]byte(`[]`),
+		[]byte(`{"method":"join"}`),
+	})
+	assert.Equal(t, `[{"method":"message"},{"method":"ping"},{"method":"presence"},{"method":"join"}]`, string(joined))
+	var responses []clientResponse
+	assert.Equal(t, nil, json.Unmarshal(joined, &responses))
+}
+
+func TestProtobufJoinMessages(t *testing.T) {
+	ping := newClientResponse("ping")
+	ping.UID = "1"
+	ping.Body = &PingBody{Data: "hello"}
+	first, err := protobufClientEncoding.encodeResponse(ping)
+	assert.Equal(t, nil, err)
+	second, err := protobufClientEncoding.encodeResponses(multiClientResponse{ping, ping})
+	assert.Equal(t, nil, err)
+	replies := testDecodeProtobufReplies(t, protobufClientEncoding.joinMessages([][]byte{first, second}))
+	assert.Equal(t, 3, len(replies))
+	assert.Equal(t, "ping", replies[2].Method)
+}
@@ -1,13 +1,28 @@
 package libcentrifugo
 
-type historyOpts struct {
+import "github.com/FZambia/go-logger"
+
+// HistoryOptions define which page of channel history engine returns. Zero value
+// returns whole history from the newest message to the oldest.
+type HistoryOptions struct {
 	// Limit sets the max amount of messages that must be returned.
 	// 0 means no limit - i.e. return all history messages.
 	Limit int
+	// Since is a sequence number of message to page from. Only messages published
+	// after it (or before it when paging backward) are returned. 0 means paging
+	// starts from the newest message or from the oldest one in forward direction.
+	Since uint64
+	// Forward sets direction of paging: from older messages to newer. By default
+	// messages returned from the newest to the oldest.
+	Forward bool
 }
 
-type publishOpts struct {
-	// Message is Message being published
+// PublishOptions passed to engine when message must be saved into channel history.
+// Message saved only when options set and both HistorySize and HistoryLifetime
+// are positive.
+type PublishOptions struct {
+	// Message is decoded message being published, history stores keep it to assign
+	// sequence number and return it from History.
 	Message Message
 	// HistorySize is maximum size of channel history that engine must maintain.
 	HistorySize int
@@ -16,42 +31,142 @@ type publishOpts struct {
 	HistoryLifetime int
 	// HistoryDropInactive hints to the engine that there were no actual subscribers
 	// connected when message was published, and that it can skip saving if there is
-	// no unexpired history for the channel (i.e. no subscribers active within history_lifetime)
+	// no unexpired history for the channel (i.e. no subscribers active within history_lifetime).
+	// Engine which knows about subscribers on all nodes can check them itself,
+	// publishWithHistory asks broker before passing this hint to history store.
 	HistoryDropInactive bool
 }
 
+// subscribersChecker is implemented by brokers which know whether channel has
+// subscribers on any node.
+type subscribersChecker interface {
+	hasSubscribers(chID ChannelID) (bool, error)
+}
+
+// Broker is responsible for delivering published messages to all nodes subscribed
+// on channel – including this node, received messages must be passed into
+// Application.HandleMsg.
+type Broker interface {
+	// Name returns a name of concrete broker implementation.
+	Name() string
+
+	// Run called once just after engine set to application.
+	Run() error
+
+	// Publish allows to send message into channel. If broker also implements
+	// HistoryStore it can save message into history itself when opts provided
+	// (see publishWithHistory for reference behaviour), otherwise opts ignored.
+	// The returned value is channel in which we will send error as soon as broker
+	// finishes publish operation.
+	Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error
+
+	// Subscribe on channel.
+	Subscribe(chID ChannelID) error
+	// Unsubscribe from channel.
+	Unsubscribe(chID ChannelID) error
+	// Channels returns slice of currently active channels IDs (with one or more subscribers).
+	Channels() ([]ChannelID, error)
+}
+
+// HistoryStore keeps history of channel messages.
+type HistoryStore interface {
+	// AddHistory saves message from opts into channel history and returns sequence
+	// number and epoch assigned to it. Zero sequence number means message was not
+	// saved. HistoryDropInactive means that channel has no subscribers on any node
+	// so store can skip saving if channel has no history, it can be ignored by store.
+	AddHistory(chID ChannelID, opts *PublishOptions) (uint64, string, error)
+
+	// History returns a slice of history messages for channel. Options allow to
+	// page through history: limit sets maximum amount of history messages to
+	// return, since and direction set sequence number to page from.
+	History(chID ChannelID, opts HistoryOptions) ([]Message, error)
+}
+
+// PresenceStore keeps information about clients subscribed on channels.
+type PresenceStore interface {
+	// AddPresence sets or updates presence info for connection with uid.
+	AddPresence(chID ChannelID, uid ConnID, info ClientInfo) error
+	// RemovePresence removes presence information for connection with uid.
+	RemovePresence(chID ChannelID, uid ConnID) error
+	// Presence returns actual presence information for channel.
+	Presence(chID ChannelID) (map[ConnID]ClientInfo, error)
+}
+
 // Engine is an interface with all methods that can be used by client or
 // application to publish message, handle subscriptions, save or retrieve
-// presence and history data.
+// presence and history data. Use NewEngine to compose Engine from separate
+// parts. Engines can be implemented outside of this package, EngineConformance
+// allows to check that implementation behaves as Application expects.
 type Engine interface {
-	// name returns a name of concrete engine implementation.
-	name() string
+	Broker
+	HistoryStore
+	PresenceStore
+}
 
-	// run called once just after engine set to application.
-	run() error
+// engine is Engine composed from separate parts.
+type engine struct {
+	Broker
+	HistoryStore
+	PresenceStore
+}
 
-	// publish allows to send message into channel.
-	// If publishOpts is nil message must be just sent into provided channel
-	// and no additional work must be done.
-	// The returned value is channel in which we will send error as soon as engine
-	// finishes publish operation.
-	publish(chID ChannelID, message []byte, opts *publishOpts) <-chan error
-
-	// subscribe on channel.
-	subscribe(chID ChannelID) error
-	// unsubscribe from channel.
-	unsubscribe(chID ChannelID) error
-	// channels returns slice of currently active channels IDs (with one or more subscribers).
-	channels() ([]ChannelID, error)
-
-	// addPresence sets or updates presence info for connection with uid.
-	addPresence(chID ChannelID, uid ConnID, info ClientInfo) error
-	// removePresence removes presence information for connection with uid.
-	removePresence(chID ChannelID, uid ConnID) error
-	// presence returns actual presence information for channel.
-	presence(chID ChannelID) (map[ConnID]ClientInfo, error)
-
-	// history returns a slice of history messages for channel, limit sets maximum amount
-	// of history messages to return.
-	history(chID ChannelID, opts historyOpts) ([]Message, error)
+// NewEngine returns Engine which uses broker to deliver messages between nodes,
+// keeps history in historyStore and presence information in presenceStore. For
+// example RedisEngine can be used as presence store while MemoryBroker delivers
+// messages on single node. Parts used as stores only are not run.
+func NewEngine(broker Broker, historyStore HistoryStore, presenceStore PresenceStore) Engine {
+	return &engine{
+		Broker:        broker,
+		HistoryStore:  historyStore,
+		PresenceStore: presenceStore,
+	}
+}
+
+func (e *engine) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
+	return publishWithHistory(e.Broker, e.HistoryStore, chID, message, opts)
+}
+
+// publishWithHistory saves message into history store if history enabled in
+// opts and publishes it with sequence number and epoch set using broker. Failure
+// to save message into history is logged and message still delivered to current
+// subscribers, without sequence number. HistoryDropInactive passed to history
+// store only if broker tells that channel has no subscribers.
+func publishWithHistory(broker Broker, historyStore HistoryStore, chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
+	if opts != nil && opts.HistorySize > 0 && opts.HistoryLifetime > 0 {
+		if opts.HistoryDropInactive && !noSubscribers(broker, chID) {
+			activeOpts := *opts
+			activeOpts.HistoryDropInactive = false
+			opts = &activeOpts
+		}
+		seq, epoch, err := historyStore.AddHistory(chID, opts)
+		if err != nil {
+			logger.ERROR.Printf("can't save message into history of channel %s: %v\n", chID, err)
+		} else if seq > 0 {
+			msg := opts.Message
+			msg.Seq = seq
+			msg.Epoch = epoch
+			message, err = encodeClientMessage(msg)
+			if err != nil {
+				ch := make(chan error, 1)
+				ch <- err
+				return ch
+			}
+		}
+	}
+	return broker.Publish(chID, message, nil)
+}
+
+// noSubscribers returns true if broker knows that channel has no subscribers on
+// any node. Channel considered active when broker can't tell, so history is kept.
+func noSubscribers(broker Broker, chID ChannelID) bool {
+	checker, ok := broker.(subscribersChecker)
+	if !ok {
+		return false
+	}
+	active, err := checker.hasSubscribers(chID)
+	if err != nil {
+		logger.ERROR.Printf("can't check subscribers of channel %s: %v\n", chID, err)
+		return false
+	}
+	return !active
 }
@@ -1,49 +1,164 @@
 package libcentrifugo
 
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
 type testEngine struct{}
 
 func newTestEngine() *testEngine {
 	return &testEngine{}
 }
 
-func (e *testEngine) name() string {
+func (e *testEngine) Name() string {
 	return "test engine"
 }
 
-func (e *testEngine) run() error {
+func (e *testEngine) Run() error {
 	return nil
 }
 
-func (e *testEngine) publish(chID ChannelID, message []byte, opts *publishOpts) <-chan error {
+func (e *testEngine) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
 	ch := make(chan error, 1)
 	ch <- nil
 	return ch
 }
 
-func (e *testEngine) subscribe(chID ChannelID) error {
+func (e *testEngine) Subscribe(chID ChannelID) error {
 	return nil
 }
 
-func (e *testEngine) unsubscribe(chID ChannelID) error {
+func (e *testEngine) Unsubscribe(chID ChannelID) error {
 	return nil
 }
 
-func (e *testEngine) addPresence(chID ChannelID, uid ConnID, info ClientInfo) error {
+func (e *testEngine) AddPresence(chID ChannelID, uid ConnID, info ClientInfo) error {
 	return nil
 }
 
-func (e *testEngine) removePresence(chID ChannelID, uid ConnID) error {
+func (e *testEngine) RemovePresence(chID ChannelID, uid ConnID) error {
 	return nil
 }
 
-func (e *testEngine) presence(chID ChannelID) (map[ConnID]ClientInfo, error) {
+func (e *testEngine) Presence(chID ChannelID) (map[ConnID]ClientInfo, error) {
 	return map[ConnID]ClientInfo{}, nil
 }
 
-func (e *testEngine) history(chID ChannelID, opts historyOpts) ([]Message, error) {
+func (e *testEngine) AddHistory(chID ChannelID, opts *PublishOptions) (uint64, string, error) {
+	return 0, "", nil
+}
+
+func (e *testEngine) History(chID ChannelID, opts HistoryOptions) ([]Message, error) {
 	return []Message{}, nil
 }
 
-func (e *testEngine) channels() ([]ChannelID, error) {
+func (e *testEngine) Channels() ([]ChannelID, error) {
 	return []ChannelID{}, nil
 }
+
+// testHistorySeqs returns sequence numbers of history messages.
+func testHistorySeqs(messages []Message) []uint64 {
+	seqs := []uint64{}
+	for _, msg := range messages {
+		seqs = append(seqs, msg.Seq)
+	}
+	return seqs
+}
+
+// testBroker is a Broker which keeps published messages.
+type testBroker struct {
+	testEngine
+	messages [][]byte
+}
+
+func (b *testBroker) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
+	b.messages = append(b.messages, message)
+	return b.testEngine.Publish(chID, message, opts)
+}
+
+func TestNewEngine(t *testing.T) {
+	app := testApp()
+	broker := &testBroker{}
+	historyStore := NewMemoryHistoryStore(app)
+	presenceStore := NewMemoryPresenceStore()
+	e := NewEngine(broker, historyStore, presenceStore)
+	assert.Equal(t, "test engine", e.Name())
+
+	message := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	resp := newClientMessage()
+	resp.Body = message
+	data, _ := json.Marshal(resp)
+
+	// Message without history options published as is.
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, nil))
+	assert.Equal(t, data, broker.messages[0])
+
+	// History kept in history store, message published with sequence number.
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, &PublishOptions{message, 10, 60, false}))
+	h, err := historyStore.History(ChannelID("channel"), HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(h))
+	expected, _ := messageWithSeq(data, 1, h[0].Epoch)
+	assert.Equal(t, expected, broker.messages[1])
+	h, err = e.History(ChannelID("channel"), HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(h))
+
+	assert.Equal(t, nil, e.AddPresence(ChannelID("channel"), "uid", ClientInfo{}))
+	p, err := presenceStore.Presence(ChannelID("channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(p))
+}
+
+// testFailingHistoryStore is a HistoryStore which fails to save messages.
+type testFailingHistoryStore struct {
+	testEngine
+}
+
+func (s *testFailingHistoryStore) AddHistory(chID ChannelID, opts *PublishOptions) (uint64, string, error) {
+	return 0, "", errors.New("history store error")
+}
+
+func TestPublishWithHistoryError(t *testing.T) {
+	broker := &testBroker{}
+	e := NewEngine(broker, &testFailingHistoryStore{}, NewMemoryPresenceStore())
+	message := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	data, _ := encodeClientMessage(message)
+
+	// Message delivered to current subscribers without sequence number.
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, &PublishOptions{message, 10, 60, false}))
+	assert.Equal(t, [][]byte{data}, broker.messages)
+}
+
+func TestPublishWithHistoryDropInactive(t *testing.T) {
+	app := testMemoryApp()
+	message := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	data, _ := encodeClientMessage(message)
+	opts := &PublishOptions{message, 10, 60, true}
+
+	// Broker can't tell whether channel has subscribers on other nodes.
+	historyStore := NewMemoryHistoryStore(app)
+	e := NewEngine(&testBroker{}, historyStore, NewMemoryPresenceStore())
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, opts))
+	h, err := historyStore.History(ChannelID("channel"), HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, true, opts.HistoryDropInactive)
+
+	historyStore = NewMemoryHistoryStore(app)
+	e = NewEngine(NewMemoryBroker(app), historyStore, NewMemoryPresenceStore())
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, opts))
+	h, err = historyStore.History(ChannelID("channel"), HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(h))
+
+	app.clients.addSub(ChannelID("channel"), newTestUserCC())
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), data, opts))
+	h, err = historyStore.History(ChannelID("channel"), HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(h))
+}
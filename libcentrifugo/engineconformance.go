@@ -0,0 +1,274 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// EngineTestingT is a subset of testing.TB used by EngineConformance so
+// libcentrifugo does not depend on testing package.
+type EngineTestingT interface {
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// EngineConformance checks that Engine returned by newEngine behaves as
+// Application expects: delivers published messages to subscribed channels,
+// keeps channel history with sequence numbers and keeps presence information.
+// Third-party engines can call it from their tests:
+//
+//	func TestMyEngine(t *testing.T) {
+//		libcentrifugo.EngineConformance(t, func(app *libcentrifugo.Application) libcentrifugo.Engine {
+//			return NewMyEngine(app)
+//		})
+//	}
+//
+// Engine is created for new Application with default configuration and is
+// run by EngineConformance.
+func EngineConformance(t EngineTestingT, newEngine func(app *Application) Engine) {
+	conf := *DefaultConfig
+	app, err := NewApplication(&conf)
+	if err != nil {
+		t.Fatalf("error creating application: %v", err)
+	}
+	e := newEngine(app)
+	app.SetEngine(e)
+	err = e.Run()
+	if err != nil {
+		t.Fatalf("error running engine: %v", err)
+	}
+	if e.Name() == "" {
+		t.Errorf("engine name must not be empty")
+	}
+
+	chID := app.channelID(Channel("conformance"))
+	conn := newConformanceConn()
+	app.clients.addSub(chID, conn)
+	err = e.Subscribe(chID)
+	if err != nil {
+		t.Fatalf("error subscribing on channel: %v", err)
+	}
+
+	// Message published without history options delivered without sequence number.
+	message, data := conformanceMessage(t, Channel("conformance"))
+	err = <-e.Publish(chID, data, nil)
+	if err != nil {
+		t.Fatalf("error publishing message: %v", err)
+	}
+	received := conn.wait(t)
+	if received.UID != message.UID {
+		t.Errorf("expected message %s delivered, got %s", message.UID, received.UID)
+	}
+	if received.Seq != 0 {
+		t.Errorf("expected message published without history to have no seq, got %d", received.Seq)
+	}
+
+	// Messages published with history options saved into history and delivered
+	// with sequence numbers increasing one by one within the same epoch.
+	var published []Message
+	for i := 0; i < 3; i++ {
+		message, data := conformanceMessage(t, Channel("conformance"))
+		opts := &PublishOptions{
+			Message:         message,
+			HistorySize:     10,
+			HistoryLifetime: 60,
+		}
+		err = <-e.Publish(chID, data, opts)
+		if err != nil {
+			t.Fatalf("error publishing message with history: %v", err)
+		}
+		received := conn.wait(t)
+		if received.UID != message.UID {
+			t.Fatalf("expected message %s delivered, got %s", message.UID, received.UID)
+		}
+		if received.Seq != uint64(i+1) {
+			t.Errorf("expected message seq %d, got %d", i+1, received.Seq)
+		}
+		if received.Epoch == "" {
+			t.Errorf("expected message epoch set")
+		}
+		if i > 0 && received.Epoch != published[0].Epoch {
+			t.Errorf("expected epoch %s, got %s", published[0].Epoch, received.Epoch)
+		}
+		published = append(published, received)
+	}
+
+	history, err := e.History(chID, HistoryOptions{})
+	if err != nil {
+		t.Fatalf("error getting history: %v", err)
+	}
+	checkConformanceHistory(t, "full history", history, published[2], published[1], published[0])
+
+	history, err = e.History(chID, HistoryOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("error getting history with limit: %v", err)
+	}
+	checkConformanceHistory(t, "history with limit", history, published[2], published[1])
+
+	history, err = e.History(chID, HistoryOptions{Since: published[0].Seq, Forward: true})
+	if err != nil {
+		t.Fatalf("error getting history forward: %v", err)
+	}
+	checkConformanceHistory(t, "history forward", history, published[1], published[2])
+
+	history, err = e.History(chID, HistoryOptions{Since: published[2].Seq})
+	if err != nil {
+		t.Fatalf("error getting history backward: %v", err)
+	}
+	checkConformanceHistory(t, "history backward", history, published[1], published[0])
+
+	// History trimmed to HistorySize.
+	trimmedChID := app.channelID(Channel("conformance_trimmed"))
+	for i := 0; i < 3; i++ {
+		message, data := conformanceMessage(t, Channel("conformance_trimmed"))
+		opts := &PublishOptions{
+			Message:         message,
+			HistorySize:     2,
+			HistoryLifetime: 60,
+		}
+		err = <-e.Publish(trimmedChID, data, opts)
+		if err != nil {
+			t.Fatalf("error publishing message with history: %v", err)
+		}
+	}
+	history, err = e.History(trimmedChID, HistoryOptions{})
+	if err != nil {
+		t.Fatalf("error getting history: %v", err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected history trimmed to 2 messages, got %d", len(history))
+	}
+
+	// Presence.
+	info := ClientInfo{User: "conformance", Client: "conformance-uid"}
+	err = e.AddPresence(chID, "conformance-uid", info)
+	if err != nil {
+		t.Fatalf("error adding presence: %v", err)
+	}
+	presence, err := e.Presence(chID)
+	if err != nil {
+		t.Fatalf("error getting presence: %v", err)
+	}
+	if p, ok := presence["conformance-uid"]; !ok || p.User != info.User {
+		t.Errorf("expected presence for conformance-uid, got %v", presence)
+	}
+	err = e.RemovePresence(chID, "conformance-uid")
+	if err != nil {
+		t.Fatalf("error removing presence: %v", err)
+	}
+	presence, err = e.Presence(chID)
+	if err != nil {
+		t.Fatalf("error getting presence: %v", err)
+	}
+	if _, ok := presence["conformance-uid"]; ok {
+		t.Errorf("expected presence for conformance-uid removed")
+	}
+
+	// Channels.
+	channels, err := e.Channels()
+	if err != nil {
+		t.Fatalf("error getting channels: %v", err)
+	}
+	found := false
+	for _, ch := range channels {
+		if ch == chID {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected %s in active channels, got %v", chID, channels)
+	}
+
+	app.clients.removeSub(chID, conn)
+	err = e.Unsubscribe(chID)
+	if err != nil {
+		t.Fatalf("error unsubscribing from channel: %v", err)
+	}
+}
+
+// conformanceMessage returns new message and its JSON encoded client message
+// response as Application publishes them.
+func conformanceMessage(t EngineTestingT, ch Channel) (Message, []byte) {
+	message := newMessage(ch, []byte(`{"input":"conformance"}`), "", nil)
+	resp := newClientMessage()
+	resp.Body = message
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("error encoding message: %v", err)
+	}
+	return message, data
+}
+
+func checkConformanceHistory(t EngineTestingT, name string, history []Message, expected ...Message) {
+	if len(history) != len(expected) {
+		t.Errorf("%s: expected %d messages, got %d", name, len(expected), len(history))
+		return
+	}
+	for i, msg := range history {
+		if msg.UID != expected[i].UID || msg.Seq != expected[i].Seq {
+			t.Errorf("%s: expected message %s with seq %d at position %d, got %s with seq %d",
+				name, expected[i].UID, expected[i].Seq, i, msg.UID, msg.Seq)
+		}
+	}
+}
+
+// conformanceConn is a connection EngineConformance subscribes on channels to
+// receive messages delivered by engine.
+type conformanceConn struct {
+	sink chan []byte
+}
+
+func newConformanceConn() *conformanceConn {
+	return &conformanceConn{
+		sink: make(chan []byte, 16),
+	}
+}
+
+func (c *conformanceConn) uid() ConnID {
+	return "conformance"
+}
+
+func (c *conformanceConn) user() UserID {
+	return "conformance"
+}
+
+func (c *conformanceConn) channels() []Channel {
+	return nil
+}
+
+func (c *conformanceConn) encoding() clientEncoding {
+	return jsonClientEncoding
+}
+
+func (c *conformanceConn) send(message []byte) error {
+	c.sink <- message
+	return nil
+}
+
+func (c *conformanceConn) subscribe(ch Channel) error {
+	return nil
+}
+
+func (c *conformanceConn) unsubscribe(ch Channel) error {
+	return nil
+}
+
+func (c *conformanceConn) close(reason string) error {
+	return nil
+}
+
+// wait returns next message delivered to connection.
+func (c *conformanceConn) wait(t EngineTestingT) Message {
+	select {
+	case data := <-c.sink:
+		var resp clientMessageResponse
+		err := json.Unmarshal(data, &resp)
+		if err != nil {
+			t.Fatalf("error decoding delivered message: %v", err)
+		}
+		return resp.Body
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for message delivery")
+	}
+	return Message{}
+}
@@ -0,0 +1,351 @@
+package libcentrifugo
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FZambia/go-logger"
+)
+
+// diskHistoryFileExt is an extension of channel history log files.
+const diskHistoryFileExt = ".log"
+
+// DiskHistoryStore keeps channel history in process memory like MemoryHistoryStore
+// and additionally appends every saved message to per-channel log file on disk so
+// history survives node restart and clients can recover missed messages. Log files
+// are compacted to HistorySize messages and removed when history expires. Use it
+// with MemoryBroker and MemoryPresenceStore composed by NewEngine.
+type DiskHistoryStore struct {
+	// mu protects channels map only, changes of channel history and log file
+	// serialized by channel lock.
+	mu       sync.Mutex
+	app      *Application
+	config   *DiskHistoryStoreConfig
+	hub      *memoryHistoryHub
+	channels map[ChannelID]*diskHistoryChannel
+}
+
+// diskHistoryChannel is a state of channel log file.
+type diskHistoryChannel struct {
+	sync.Mutex
+	// file is log file opened for appending, nil until first append.
+	file *os.File
+	// size is a size of opened log file.
+	size int64
+	// records is a number of records in log file.
+	records int
+	// removed set when log file removed, channel state must be obtained again.
+	removed bool
+}
+
+// DiskHistoryStoreConfig is struct with DiskHistoryStore options.
+type DiskHistoryStoreConfig struct {
+	// Dir is a directory to keep history log files in. Created if not exists.
+	Dir string
+}
+
+// diskHistoryRecord is a line of channel history log file.
+type diskHistoryRecord struct {
+	Channel  ChannelID `json:"channel"`
+	Size     int       `json:"size"`
+	ExpireAt int64     `json:"expire_at"`
+	Message  Message   `json:"message"`
+}
+
+// NewDiskHistoryStore initializes DiskHistoryStore loading not expired history
+// from log files in configured directory.
+func NewDiskHistoryStore(app *Application, conf *DiskHistoryStoreConfig) (*DiskHistoryStore, error) {
+	err := os.MkdirAll(conf.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskHistoryStore{
+		app:      app,
+		config:   conf,
+		hub:      newMemoryHistoryHub(),
+		channels: make(map[ChannelID]*diskHistoryChannel),
+	}
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.hub.expired = s.removeExpired
+	s.hub.initialize()
+	return s, nil
+}
+
+func (s *DiskHistoryStore) AddHistory(chID ChannelID, opts *PublishOptions) (uint64, string, error) {
+	ch := s.lockChannel(chID)
+	defer ch.Unlock()
+
+	seq, epoch := s.hub.next(chID, opts.HistoryDropInactive)
+	if seq == 0 {
+		return 0, "", nil
+	}
+
+	message := opts.Message
+	message.Seq = seq
+	message.Epoch = epoch
+	record := diskHistoryRecord{
+		Channel:  chID,
+		Size:     opts.HistorySize,
+		ExpireAt: time.Now().Unix() + int64(opts.HistoryLifetime),
+		Message:  message,
+	}
+	if seq == 1 {
+		// History created from scratch – drop log of previous epoch if any.
+		ch.close()
+		ch.records = 0
+		os.Remove(s.path(chID))
+	}
+	// Message saved into history only after it was written into log so failed
+	// publish does not leave it in history.
+	err := ch.append(s.path(chID), record)
+	if err != nil {
+		return 0, "", err
+	}
+	s.hub.put(chID, message, addHistoryOpts{
+		Size:     opts.HistorySize,
+		Lifetime: opts.HistoryLifetime,
+	})
+	if ch.records > 2*opts.HistorySize {
+		err = s.compact(chID, ch, opts.HistorySize, record.ExpireAt)
+		if err != nil {
+			logger.ERROR.Println(err)
+		}
+	}
+	return seq, epoch, nil
+}
+
+func (s *DiskHistoryStore) History(chID ChannelID, opts HistoryOptions) ([]Message, error) {
+	return s.hub.get(chID, opts)
+}
+
+// path returns path to channel log file. Channel ID hashed as it can contain
+// symbols not allowed in file names and be longer than allowed file name.
+func (s *DiskHistoryStore) path(chID ChannelID) string {
+	sum := sha1.Sum([]byte(chID))
+	return filepath.Join(s.config.Dir, hex.EncodeToString(sum[:])+diskHistoryFileExt)
+}
+
+// lockChannel returns locked state of channel log file.
+func (s *DiskHistoryStore) lockChannel(chID ChannelID) *diskHistoryChannel {
+	for {
+		s.mu.Lock()
+		ch, ok := s.channels[chID]
+		if !ok {
+			ch = &diskHistoryChannel{}
+			s.channels[chID] = ch
+		}
+		s.mu.Unlock()
+		ch.Lock()
+		if !ch.removed {
+			return ch
+		}
+		ch.Unlock()
+	}
+}
+
+// append appends record to log file at path opening it if needed.
+func (ch *diskHistoryChannel) append(path string, record diskHistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if ch.file == nil {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		ch.file = f
+		ch.size = info.Size()
+	}
+	n, err := ch.file.Write(append(data, '\n'))
+	if err != nil {
+		// Record could be written partially, cut it off so records appended
+		// later are not lost when log loaded. File reopened on next append.
+		if n > 0 {
+			ch.file.Truncate(ch.size)
+		}
+		ch.close()
+		return err
+	}
+	ch.size += int64(n)
+	ch.records++
+	return nil
+}
+
+// close closes log file if it's open.
+func (ch *diskHistoryChannel) close() {
+	if ch.file == nil {
+		return
+	}
+	err := ch.file.Close()
+	if err != nil {
+		logger.ERROR.Println(err)
+	}
+	ch.file = nil
+}
+
+// compact rewrites channel log file so it only contains messages currently kept
+// in history. File replaced atomically so it's never left half written.
+func (s *DiskHistoryStore) compact(chID ChannelID, ch *diskHistoryChannel, size int, expireAt int64) error {
+	messages, err := s.hub.get(chID, HistoryOptions{})
+	if err != nil {
+		return err
+	}
+	path := s.path(chID)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	// Messages kept from the newest to the oldest, log starts with the oldest one.
+	for i := len(messages) - 1; i >= 0; i-- {
+		err = encoder.Encode(diskHistoryRecord{
+			Channel:  chID,
+			Size:     size,
+			ExpireAt: expireAt,
+			Message:  messages[i],
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	// Opened file must not be used after it's replaced.
+	ch.close()
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	ch.records = len(messages)
+	return nil
+}
+
+// removeExpired removes log file of channel which history expired.
+func (s *DiskHistoryStore) removeExpired(chID ChannelID) {
+	ch := s.lockChannel(chID)
+	defer ch.Unlock()
+	if s.hub.has(chID) {
+		// History was created again after expiration.
+		return
+	}
+	ch.close()
+	ch.removed = true
+	s.mu.Lock()
+	delete(s.channels, chID)
+	s.mu.Unlock()
+	err := os.Remove(s.path(chID))
+	if err != nil && !os.IsNotExist(err) {
+		logger.ERROR.Println(err)
+	}
+}
+
+// load restores history from log files replaying records in order they were
+// appended. Files with expired history removed, files with broken tail (for
+// example when node crashed while writing) compacted.
+func (s *DiskHistoryStore) load() error {
+	files, err := ioutil.ReadDir(s.config.Dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), diskHistoryFileExt) {
+			continue
+		}
+		path := filepath.Join(s.config.Dir, file.Name())
+		chID, item, size, records, broken, err := readDiskHistory(path)
+		if err != nil {
+			return err
+		}
+		if records == 0 || item.expireAt <= now {
+			os.Remove(path)
+			continue
+		}
+		s.hub.restore(chID, item)
+		ch := &diskHistoryChannel{records: records}
+		s.channels[chID] = ch
+		if broken || records > 2*size {
+			err = s.compact(chID, ch, size, item.expireAt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readDiskHistory reads channel history item from log file. It returns channel
+// ID, history item, last history size, number of records read and whether file
+// has broken records at the end.
+func readDiskHistory(path string) (ChannelID, historyItem, int, int, bool, error) {
+	var chID ChannelID
+	var item historyItem
+	var size, records int
+
+	f, err := os.Open(path)
+	if err != nil {
+		return chID, item, size, records, false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// Line without newline at the end was not written completely.
+			return chID, item, size, records, len(line) > 0, nil
+		}
+		if err != nil {
+			return chID, item, size, records, false, err
+		}
+		var record diskHistoryRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			logger.ERROR.Printf("broken history record in %s: %v\n", path, err)
+			return chID, item, size, records, true, nil
+		}
+		chID = record.Channel
+		size = record.Size
+		message := record.Message
+		if message.Epoch != item.epoch {
+			item.messages = nil
+		}
+		item.messages = append([]Message{message}, item.messages...)
+		if len(item.messages) > size {
+			item.messages = item.messages[:size]
+		}
+		item.seq = message.Seq
+		item.epoch = message.Epoch
+		item.expireAt = record.ExpireAt
+		records++
+	}
+}
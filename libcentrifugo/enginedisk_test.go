@@ -0,0 +1,248 @@
+package libcentrifugo
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDiskHistoryStore(t *testing.T, dir string) *DiskHistoryStore {
+	app := testMemoryApp()
+	s, err := NewDiskHistoryStore(app, &DiskHistoryStoreConfig{Dir: dir})
+	assert.Equal(t, nil, err)
+	return s
+}
+
+func testDiskHistoryDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "centrifugo-history")
+	assert.Equal(t, nil, err)
+	return dir
+}
+
+// testDiskHistoryRecords returns number of records in channel log file.
+func testDiskHistoryRecords(t *testing.T, s *DiskHistoryStore, chID ChannelID) int {
+	f, err := os.Open(s.path(chID))
+	assert.Equal(t, nil, err)
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestDiskHistoryStoreConformance(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	EngineConformance(t, func(app *Application) Engine {
+		s, err := NewDiskHistoryStore(app, &DiskHistoryStoreConfig{Dir: dir})
+		assert.Equal(t, nil, err)
+		return NewEngine(NewMemoryBroker(app), s, NewMemoryPresenceStore())
+	})
+}
+
+func TestDiskHistoryStoreRestart(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	for i := 0; i < 5; i++ {
+		msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+		seq, _, err := s.AddHistory(chID, &PublishOptions{msg, 3, 60, false})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint64(i+1), seq)
+	}
+	h, err := s.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+
+	// New store over the same directory restores history with sequence numbers
+	// and epoch so clients can recover messages after restart.
+	restored := testDiskHistoryStore(t, dir)
+	rh, err := restored.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, h, rh)
+	assert.Equal(t, []uint64{5, 4, 3}, testHistorySeqs(rh))
+
+	msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	seq, epoch, err := restored.AddHistory(chID, &PublishOptions{msg, 3, 60, false})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(6), seq)
+	assert.Equal(t, h[0].Epoch, epoch)
+}
+
+func TestDiskHistoryStoreCompaction(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	for i := 0; i < 10; i++ {
+		msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+		_, _, err := s.AddHistory(chID, &PublishOptions{msg, 2, 60, false})
+		assert.Equal(t, nil, err)
+	}
+	assert.True(t, testDiskHistoryRecords(t, s, chID) <= 4)
+
+	restored := testDiskHistoryStore(t, dir)
+	h, err := restored.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{10, 9}, testHistorySeqs(h))
+}
+
+func TestDiskHistoryStoreBrokenTail(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	for i := 0; i < 2; i++ {
+		msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+		_, _, err := s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+		assert.Equal(t, nil, err)
+	}
+
+	// Record not written completely.
+	f, err := os.OpenFile(s.path(chID), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Equal(t, nil, err)
+	f.Write([]byte(`{"channel":"channel","size":10`))
+	f.Close()
+
+	restored := testDiskHistoryStore(t, dir)
+	h, err := restored.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{2, 1}, testHistorySeqs(h))
+	assert.Equal(t, 2, testDiskHistoryRecords(t, restored, chID))
+}
+
+func TestDiskHistoryStoreExpired(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	record := diskHistoryRecord{
+		Channel:  chID,
+		Size:     10,
+		ExpireAt: time.Now().Unix() - 1,
+		Message:  Message{UID: "uid", Seq: 1, Epoch: "epoch"},
+	}
+	data, _ := json.Marshal(record)
+	err := ioutil.WriteFile(s.path(chID), append(data, '\n'), 0644)
+	assert.Equal(t, nil, err)
+
+	restored := testDiskHistoryStore(t, dir)
+	h, err := restored.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(h))
+	_, err = os.Stat(s.path(chID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskHistoryStoreRemoveExpired(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	_, _, err := s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+	assert.Equal(t, nil, err)
+
+	// Not removed while history exists.
+	s.removeExpired(chID)
+	_, err = os.Stat(s.path(chID))
+	assert.Equal(t, nil, err)
+
+	s.hub.Lock()
+	delete(s.hub.history, chID)
+	s.hub.Unlock()
+	s.removeExpired(chID)
+	_, err = os.Stat(s.path(chID))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDiskHistoryStoreAppendError(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	_, _, err := s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+	assert.Equal(t, nil, err)
+
+	// Writes into closed file fail.
+	ch := s.lockChannel(chID)
+	ch.file.Close()
+	ch.Unlock()
+	_, _, err = s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+	assert.NotEqual(t, nil, err)
+	h, err := s.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{1}, testHistorySeqs(h))
+
+	// File reopened so publish can be retried.
+	seq, _, err := s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(2), seq)
+	restored := testDiskHistoryStore(t, dir)
+	h, err = restored.History(chID, HistoryOptions{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{2, 1}, testHistorySeqs(h))
+}
+
+func TestDiskHistoryStoreNotSavedOnError(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	chID := ChannelID("channel")
+	// Log file can't be opened or removed.
+	err := os.Mkdir(s.path(chID), 0755)
+	assert.Equal(t, nil, err)
+	err = ioutil.WriteFile(filepath.Join(s.path(chID), "file"), nil, 0644)
+	assert.Equal(t, nil, err)
+	msg := newMessage(Channel("channel"), []byte("{}"), "", nil)
+	_, _, err = s.AddHistory(chID, &PublishOptions{msg, 10, 60, false})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, s.hub.has(chID))
+}
+
+func TestDiskHistoryStoreParallel(t *testing.T) {
+	dir := testDiskHistoryDir(t)
+	defer os.RemoveAll(dir)
+
+	s := testDiskHistoryStore(t, dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			chID := ChannelID("channel" + strconv.Itoa(i%2))
+			for j := 0; j < 50; j++ {
+				msg := newMessage(Channel(chID), []byte("{}"), "", nil)
+				_, _, err := s.AddHistory(chID, &PublishOptions{msg, 5, 60, false})
+				assert.Equal(t, nil, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	restored := testDiskHistoryStore(t, dir)
+	for i := 0; i < 2; i++ {
+		h, err := restored.History(ChannelID("channel"+strconv.Itoa(i)), HistoryOptions{})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []uint64{100, 99, 98, 97, 96}, testHistorySeqs(h))
+	}
+}
@@ -5,84 +5,126 @@ import (
 	"sync"
 	"time"
 
-	"github.com/FZambia/go-logger"
 	"github.com/centrifugal/centrifugo/libcentrifugo/priority"
 )
 
 // MemoryEngine allows to run Centrifugo without using Redis at all. All data managed inside process
 // memory. With this engine you can only run single Centrifugo node. If you need to scale you should
-// use Redis engine instead.
+// use Redis engine instead. MemoryEngine is a composition of MemoryBroker, MemoryHistoryStore and
+// MemoryPresenceStore – each of them can also be used separately with NewEngine.
 type MemoryEngine struct {
-	app         *Application
-	presenceHub *memoryPresenceHub
-	historyHub  *memoryHistoryHub
+	*MemoryBroker
+	*MemoryHistoryStore
+	*MemoryPresenceStore
 }
 
 // NewMemoryEngine initializes Memory Engine.
 func NewMemoryEngine(app *Application) *MemoryEngine {
-	e := &MemoryEngine{
-		app:         app,
-		presenceHub: newMemoryPresenceHub(),
-		historyHub:  newMemoryHistoryHub(),
+	return &MemoryEngine{
+		MemoryBroker:        NewMemoryBroker(app),
+		MemoryHistoryStore:  NewMemoryHistoryStore(app),
+		MemoryPresenceStore: NewMemoryPresenceStore(),
 	}
-	e.historyHub.initialize()
-	return e
 }
 
-func (e *MemoryEngine) name() string {
-	return "In memory – single node only"
+func (e *MemoryEngine) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
+	return publishWithHistory(e.MemoryBroker, e.MemoryHistoryStore, chID, message, opts)
 }
 
-func (e *MemoryEngine) run() error {
-	return nil
+// MemoryBroker delivers published messages to clients of this node only.
+type MemoryBroker struct {
+	app *Application
 }
 
-func (e *MemoryEngine) publish(chID ChannelID, message []byte, opts *publishOpts) <-chan error {
-	hasCurrentSubscribers := e.app.clients.hasSubscribers(chID)
-
-	if opts != nil && opts.HistorySize > 0 && opts.HistoryLifetime > 0 {
-		histOpts := addHistoryOpts{
-			Size:         opts.HistorySize,
-			Lifetime:     opts.HistoryLifetime,
-			DropInactive: (opts.HistoryDropInactive && !hasCurrentSubscribers),
-		}
-		err := e.historyHub.add(chID, opts.Message, histOpts)
-		if err != nil {
-			logger.ERROR.Println(err)
-		}
+// NewMemoryBroker initializes MemoryBroker.
+func NewMemoryBroker(app *Application) *MemoryBroker {
+	return &MemoryBroker{
+		app: app,
 	}
+}
 
+func (b *MemoryBroker) Name() string {
+	return "In memory – single node only"
+}
+
+func (b *MemoryBroker) Run() error {
+	return nil
+}
+
+func (b *MemoryBroker) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
 	ch := make(chan error, 1)
-	ch <- e.app.handleMsg(chID, message)
+	ch <- b.app.HandleMsg(chID, message)
 	return ch
 }
 
-func (e *MemoryEngine) subscribe(chID ChannelID) error {
+func (b *MemoryBroker) Subscribe(chID ChannelID) error {
 	return nil
 }
 
-func (e *MemoryEngine) unsubscribe(chID ChannelID) error {
+func (b *MemoryBroker) Unsubscribe(chID ChannelID) error {
 	return nil
 }
 
-func (e *MemoryEngine) addPresence(chID ChannelID, uid ConnID, info ClientInfo) error {
-	return e.presenceHub.add(chID, uid, info)
+func (b *MemoryBroker) Channels() ([]ChannelID, error) {
+	return b.app.clients.channels(), nil
 }
 
-func (e *MemoryEngine) removePresence(chID ChannelID, uid ConnID) error {
-	return e.presenceHub.remove(chID, uid)
+// hasSubscribers returns whether channel has subscribers, this node is the only one.
+func (b *MemoryBroker) hasSubscribers(chID ChannelID) (bool, error) {
+	return b.app.clients.hasSubscribers(chID), nil
 }
 
-func (e *MemoryEngine) presence(chID ChannelID) (map[ConnID]ClientInfo, error) {
-	return e.presenceHub.get(chID)
+// MemoryHistoryStore keeps channel history in process memory.
+type MemoryHistoryStore struct {
+	app *Application
+	hub *memoryHistoryHub
 }
 
-func (e *MemoryEngine) history(chID ChannelID, opts historyOpts) ([]Message, error) {
-	return e.historyHub.get(chID, opts)
+// NewMemoryHistoryStore initializes MemoryHistoryStore.
+func NewMemoryHistoryStore(app *Application) *MemoryHistoryStore {
+	s := &MemoryHistoryStore{
+		app: app,
+		hub: newMemoryHistoryHub(),
+	}
+	s.hub.initialize()
+	return s
 }
 
-func (e *MemoryEngine) channels() ([]ChannelID, error) {
-	return e.app.clients.channels(), nil
+func (s *MemoryHistoryStore) AddHistory(chID ChannelID, opts *PublishOptions) (uint64, string, error) {
+	histOpts := addHistoryOpts{
+		Size:         opts.HistorySize,
+		Lifetime:     opts.HistoryLifetime,
+		DropInactive: opts.HistoryDropInactive,
+	}
+	return s.hub.add(chID, opts.Message, histOpts)
+}
+
+func (s *MemoryHistoryStore) History(chID ChannelID, opts HistoryOptions) ([]Message, error) {
+	return s.hub.get(chID, opts)
+}
+
+// MemoryPresenceStore keeps presence information in process memory.
+type MemoryPresenceStore struct {
+	hub *memoryPresenceHub
+}
+
+// NewMemoryPresenceStore initializes MemoryPresenceStore.
+func NewMemoryPresenceStore() *MemoryPresenceStore {
+	return &MemoryPresenceStore{
+		hub: newMemoryPresenceHub(),
+	}
+}
+
+func (s *MemoryPresenceStore) AddPresence(chID ChannelID, uid ConnID, info ClientInfo) error {
+	return s.hub.add(chID, uid, info)
+}
+
+func (s *MemoryPresenceStore) RemovePresence(chID ChannelID, uid ConnID) error {
+	return s.hub.remove(chID, uid)
+}
+
+func (s *MemoryPresenceStore) Presence(chID ChannelID) (map[ConnID]ClientInfo, error) {
+	return s.hub.get(chID)
 }
 
 type memoryPresenceHub struct {
@@ -148,8 +190,13 @@ func (h *memoryPresenceHub) get(chID ChannelID) (map[ConnID]ClientInfo, error) {
 }
 
 type historyItem struct {
+	// messages are kept from the newest to the oldest.
 	messages []Message
 	expireAt int64
+	// seq is a sequence number of last message added.
+	seq uint64
+	// epoch is generated when history item created.
+	epoch string
 }
 
 func (i historyItem) isExpired() bool {
@@ -161,6 +208,8 @@ type memoryHistoryHub struct {
 	history   map[ChannelID]historyItem
 	queue     priority.Queue
 	nextCheck int64
+	// expired called without hub lock held for channels which history expired.
+	expired func(chID ChannelID)
 }
 
 func newMemoryHistoryHub() *memoryHistoryHub {
@@ -197,6 +246,7 @@ func (h *memoryHistoryHub) expire() {
 			continue
 		}
 		nextCheck = 0
+		var expired []ChannelID
 		for h.queue.Len() > 0 {
 			item := heap.Pop(&h.queue).(*priority.Item)
 			expireAt := item.Priority
@@ -208,55 +258,117 @@ func (h *memoryHistoryHub) expire() {
 			chID := ChannelID(item.Value)
 			hItem, ok := h.history[chID]
 			if !ok {
+				expired = append(expired, chID)
 				continue
 			}
 			if hItem.expireAt <= expireAt {
 				delete(h.history, chID)
+				expired = append(expired, chID)
 			}
 		}
 		h.nextCheck = nextCheck
 		h.Unlock()
+		if h.expired != nil {
+			for _, chID := range expired {
+				h.expired(chID)
+			}
+		}
 	}
 }
 
-func (h *memoryHistoryHub) add(chID ChannelID, message Message, opts addHistoryOpts) error {
+// restore sets channel history item as is, used to load history saved outside
+// of hub.
+func (h *memoryHistoryHub) restore(chID ChannelID, item historyItem) {
 	h.Lock()
 	defer h.Unlock()
 
+	h.history[chID] = item
+	heap.Push(&h.queue, &priority.Item{Value: string(chID), Priority: item.expireAt})
+	if h.nextCheck == 0 || h.nextCheck > item.expireAt {
+		h.nextCheck = item.expireAt
+	}
+}
+
+// has returns whether hub has history for channel.
+func (h *memoryHistoryHub) has(chID ChannelID) bool {
+	h.RLock()
+	defer h.RUnlock()
 	_, ok := h.history[chID]
+	return ok
+}
 
-	if opts.DropInactive && !ok {
-		// No active history for this channel so don't bother storing at all
-		return nil
+// add saves message into channel history and returns sequence number and
+// history epoch assigned to it. Zero sequence number returned if message was
+// not saved.
+func (h *memoryHistoryHub) add(chID ChannelID, message Message, opts addHistoryOpts) (uint64, string, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	seq, epoch := h.nextLocked(chID, opts.DropInactive)
+	if seq == 0 {
+		return 0, "", nil
 	}
+	message.Seq = seq
+	message.Epoch = epoch
+	h.putLocked(chID, message, opts)
+	return seq, epoch, nil
+}
 
-	expireAt := time.Now().Unix() + int64(opts.Lifetime)
-	heap.Push(&h.queue, &priority.Item{Value: string(chID), Priority: expireAt})
+// next returns sequence number and history epoch message added into channel
+// history next gets. Zero sequence number returned if message must not be saved.
+// Callers which save message outside of hub first must not add messages into
+// channel history concurrently.
+func (h *memoryHistoryHub) next(chID ChannelID, dropInactive bool) (uint64, string) {
+	h.RLock()
+	defer h.RUnlock()
+	return h.nextLocked(chID, dropInactive)
+}
+
+func (h *memoryHistoryHub) nextLocked(chID ChannelID, dropInactive bool) (uint64, string) {
+	hItem, ok := h.history[chID]
 	if !ok {
-		h.history[chID] = historyItem{
-			messages: []Message{message},
-			expireAt: expireAt,
-		}
-	} else {
-		messages := h.history[chID].messages
-		messages = append([]Message{message}, messages...)
-		if len(messages) > opts.Size {
-			messages = messages[0:opts.Size]
-		}
-		h.history[chID] = historyItem{
-			messages: messages,
-			expireAt: expireAt,
+		if dropInactive {
+			// No active history for this channel so don't bother storing at all
+			return 0, ""
 		}
+		return 1, newEpoch()
+	}
+	return hItem.seq + 1, hItem.epoch
+}
+
+// put saves message with sequence number and epoch returned by next into
+// channel history.
+func (h *memoryHistoryHub) put(chID ChannelID, message Message, opts addHistoryOpts) {
+	h.Lock()
+	defer h.Unlock()
+	h.putLocked(chID, message, opts)
+}
+
+func (h *memoryHistoryHub) putLocked(chID ChannelID, message Message, opts addHistoryOpts) {
+	expireAt := time.Now().Unix() + int64(opts.Lifetime)
+	heap.Push(&h.queue, &priority.Item{Value: string(chID), Priority: expireAt})
+
+	var messages []Message
+	if hItem, ok := h.history[chID]; ok && hItem.epoch == message.Epoch {
+		messages = hItem.messages
+	}
+	messages = append([]Message{message}, messages...)
+	if len(messages) > opts.Size {
+		messages = messages[0:opts.Size]
+	}
+	h.history[chID] = historyItem{
+		messages: messages,
+		expireAt: expireAt,
+		seq:      message.Seq,
+		epoch:    message.Epoch,
 	}
 
 	if h.nextCheck == 0 || h.nextCheck > expireAt {
 		h.nextCheck = expireAt
 	}
-
-	return nil
 }
 
-func (h *memoryHistoryHub) get(chID ChannelID, opts historyOpts) ([]Message, error) {
+func (h *memoryHistoryHub) get(chID ChannelID, opts HistoryOptions) ([]Message, error) {
 	h.RLock()
 	defer h.RUnlock()
 
@@ -270,9 +382,37 @@ func (h *memoryHistoryHub) get(chID ChannelID, opts historyOpts) ([]Message, err
 		delete(h.history, chID)
 		return []Message{}, nil
 	}
-	if opts.Limit == 0 || opts.Limit >= len(hItem.messages) {
-		return hItem.messages, nil
-	} else {
+	if opts.Since == 0 && !opts.Forward {
+		if opts.Limit == 0 || opts.Limit >= len(hItem.messages) {
+			return hItem.messages, nil
+		}
 		return hItem.messages[:opts.Limit], nil
 	}
+	return pageMessages(hItem.messages, opts), nil
+}
+
+// pageMessages returns a page of messages according to history options, messages
+// must be sorted from the newest to the oldest.
+func pageMessages(messages []Message, opts HistoryOptions) []Message {
+	page := []Message{}
+	n := len(messages)
+	for i := 0; i < n; i++ {
+		if opts.Limit > 0 && len(page) >= opts.Limit {
+			break
+		}
+		var msg Message
+		if opts.Forward {
+			msg = messages[n-1-i]
+			if msg.Seq <= opts.Since {
+				continue
+			}
+		} else {
+			msg = messages[i]
+			if opts.Since > 0 && msg.Seq >= opts.Since {
+				continue
+			}
+		}
+		page = append(page, msg)
+	}
+	return page
 }
@@ -31,9 +31,15 @@ func (t *TestConn) user() UserID {
 func (t *TestConn) channels() []Channel {
 	return t.Channels
 }
+func (t *TestConn) encoding() clientEncoding {
+	return jsonClientEncoding
+}
 func (t *TestConn) send(message []byte) error {
 	return nil
 }
+func (t *TestConn) subscribe(ch Channel) error {
+	return nil
+}
 func (t *TestConn) unsubscribe(ch Channel) error {
 	return nil
 }
@@ -43,16 +49,16 @@ func (t *TestConn) close(reason string) error {
 
 func TestMemoryEngine(t *testing.T) {
 	e := testMemoryEngine()
-	err := e.run()
+	err := e.Run()
 	assert.Equal(t, nil, err)
-	assert.NotEqual(t, nil, e.historyHub)
-	assert.NotEqual(t, nil, e.presenceHub)
-	assert.NotEqual(t, e.name(), "")
+	assert.NotEqual(t, nil, e.MemoryHistoryStore.hub)
+	assert.NotEqual(t, nil, e.MemoryPresenceStore.hub)
+	assert.NotEqual(t, e.Name(), "")
 
-	err = <-e.publish(ChannelID("channel"), []byte("{}"), nil)
+	err = <-e.Publish(ChannelID("channel"), []byte("{}"), nil)
 	assert.Equal(t, nil, err)
 
-	assert.Equal(t, nil, e.subscribe(ChannelID("channel")))
+	assert.Equal(t, nil, e.Subscribe(ChannelID("channel")))
 
 	// Memory engine is actually tightly coupled to application hubs in implementation
 	// so calling subscribe on the engine alone is actually a no-op since Application already
@@ -60,65 +66,87 @@ func TestMemoryEngine(t *testing.T) {
 	// In order to test publish works after subscription is added, we actually need to inject a
 	// fake subscription into the Application hub
 	fakeConn := &TestConn{"test", "test", []Channel{"channel"}}
-	e.app.clients.addSub(ChannelID("channel"), fakeConn)
+	e.MemoryBroker.app.clients.addSub(ChannelID("channel"), fakeConn)
 
 	// Now we've subscribed...
-	err = <-e.publish(ChannelID("channel"), []byte("{}"), nil)
+	err = <-e.Publish(ChannelID("channel"), []byte("{}"), nil)
 	assert.Equal(t, nil, err)
 
-	assert.Equal(t, nil, e.unsubscribe(ChannelID("channel")))
+	assert.Equal(t, nil, e.Unsubscribe(ChannelID("channel")))
 
 	// Same dance to manually remove sub from app hub
-	e.app.clients.removeSub(ChannelID("channel"), fakeConn)
+	e.MemoryBroker.app.clients.removeSub(ChannelID("channel"), fakeConn)
 
-	assert.Equal(t, nil, e.addPresence(ChannelID("channel"), "uid", ClientInfo{}))
-	p, err := e.presence(ChannelID("channel"))
+	assert.Equal(t, nil, e.AddPresence(ChannelID("channel"), "uid", ClientInfo{}))
+	p, err := e.Presence(ChannelID("channel"))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(p))
-	err = e.removePresence(ChannelID("channel"), "uid")
+	err = e.RemovePresence(ChannelID("channel"), "uid")
 	assert.Equal(t, nil, err)
 
 	msg := Message{UID: MessageID("test UID")}
 	msgJSON, _ := json.Marshal(msg)
 
 	// test adding history
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	h, err := e.history(ChannelID("channel"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	h, err := e.History(ChannelID("channel"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(h))
 	assert.Equal(t, h[0].UID, MessageID("test UID"))
 
 	// test history limit
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	h, err = e.history(ChannelID("channel"), historyOpts{Limit: 2})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	h, err = e.History(ChannelID("channel"), HistoryOptions{Limit: 2})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(h))
 
 	// test history limit greater than history size
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	h, err = e.history(ChannelID("channel"), historyOpts{Limit: 2})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	h, err = e.History(ChannelID("channel"), HistoryOptions{Limit: 2})
+
+	// test history paging with sequence numbers
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, nil, <-e.Publish(ChannelID("channel-3"), msgJSON, &PublishOptions{msg, 10, 5, false}))
+	}
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{5, 4}, testHistorySeqs(h))
+	assert.NotEqual(t, "", h[0].Epoch)
+	assert.Equal(t, h[0].Epoch, h[1].Epoch)
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2, Since: 4})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{3, 2}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{1, 2}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Since: 3, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{4, 5}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Since: 5, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(h))
 
 	// HistoryDropInactive tests - new channel to avoid conflicts with test above
 	// 1. add history with DropInactive = true should be a no-op if history is empty
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, true}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, true}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(h))
 
 	// 2. add history with DropInactive = false should always work
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, false}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, false}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(h))
 
 	// 3. add with DropInactive = true should work immediately since there should be something in history
 	// for 5 seconds from above
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, true}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, true}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(h))
 }
@@ -164,23 +192,23 @@ func TestMemoryHistoryHub(t *testing.T) {
 	h.add(ch1, Message{}, addHistoryOpts{1, 1, false})
 	h.add(ch2, Message{}, addHistoryOpts{2, 1, false})
 	h.add(ch2, Message{}, addHistoryOpts{2, 1, true}) // Test that adding only if active works when it's active
-	hist, err := h.get(ch1, historyOpts{})
+	hist, err := h.get(ch1, HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(hist))
-	hist, err = h.get(ch2, historyOpts{})
+	hist, err = h.get(ch2, HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(hist))
 	time.Sleep(2 * time.Second)
 
 	// test that history cleaned up by periodic task
 	assert.Equal(t, 0, len(h.history))
-	hist, err = h.get(ch1, historyOpts{})
+	hist, err = h.get(ch1, HistoryOptions{})
 	assert.Equal(t, 0, len(hist))
 
 	// Now test adding history for inactive channel is a no-op if OnlySaveIfActvie is true
 	h.add(ch2, Message{}, addHistoryOpts{2, 10, true})
 	assert.Equal(t, 0, len(h.history))
-	hist, err = h.get(ch2, historyOpts{})
+	hist, err = h.get(ch2, HistoryOptions{})
 	assert.Equal(t, 0, len(hist))
 
 	// test history messages limit
@@ -188,25 +216,32 @@ func TestMemoryHistoryHub(t *testing.T) {
 	h.add(ch1, Message{}, addHistoryOpts{10, 1, false})
 	h.add(ch1, Message{}, addHistoryOpts{10, 1, false})
 	h.add(ch1, Message{}, addHistoryOpts{10, 1, false})
-	hist, err = h.get(ch1, historyOpts{})
+	hist, err = h.get(ch1, HistoryOptions{})
 	assert.Equal(t, 4, len(hist))
-	hist, err = h.get(ch1, historyOpts{Limit: 1})
+	hist, err = h.get(ch1, HistoryOptions{Limit: 1})
 	assert.Equal(t, 1, len(hist))
 
 	// test history limit greater than history size
 	h.add(ch1, Message{}, addHistoryOpts{1, 1, false})
 	h.add(ch1, Message{}, addHistoryOpts{1, 1, false})
-	hist, err = h.get(ch1, historyOpts{Limit: 2})
+	hist, err = h.get(ch1, HistoryOptions{Limit: 2})
 	assert.Equal(t, 1, len(hist))
+	assert.Equal(t, uint64(6), hist[0].Seq)
 }
 
 func TestMemoryChannels(t *testing.T) {
 	app := testMemoryApp()
-	channels, err := app.engine.channels()
+	channels, err := app.engine.Channels()
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(channels))
 	createTestClients(app, 10, 1, nil)
-	channels, err = app.engine.channels()
+	channels, err = app.engine.Channels()
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 10, len(channels))
 }
+
+func TestMemoryEngineConformance(t *testing.T) {
+	EngineConformance(t, func(app *Application) Engine {
+		return NewMemoryEngine(app)
+	})
+}
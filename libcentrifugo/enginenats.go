@@ -0,0 +1,137 @@
+package libcentrifugo
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/FZambia/go-logger"
+	"github.com/nats-io/go-nats"
+)
+
+// natsSubjectPrefix is a prefix of NATS subjects channels are mapped to.
+const natsSubjectPrefix = "centrifugo."
+
+// NatsBroker uses NATS subjects for PUB/SUB so Centrifugo nodes connected to the
+// same NATS server (or cluster) can exchange messages. NATS does not keep any data
+// so NatsBroker must be composed with history and presence stores using NewEngine.
+// Note that memory stores are not shared between nodes.
+type NatsBroker struct {
+	sync.Mutex
+	app    *Application
+	config *NatsBrokerConfig
+	conn   *nats.Conn
+	subs   map[ChannelID]*nats.Subscription
+}
+
+// NatsBrokerConfig is struct with NATS Broker options.
+type NatsBrokerConfig struct {
+	// URL is NATS server URL, several comma separated URLs of NATS cluster
+	// servers can be provided.
+	URL string
+	// ConnectTimeout is a timeout on connect operation.
+	ConnectTimeout time.Duration
+}
+
+// NewNatsBroker initializes NATS Broker.
+func NewNatsBroker(app *Application, conf *NatsBrokerConfig) *NatsBroker {
+	return &NatsBroker{
+		app:    app,
+		config: conf,
+		subs:   make(map[ChannelID]*nats.Subscription),
+	}
+}
+
+func (b *NatsBroker) Name() string {
+	return "NATS"
+}
+
+func (b *NatsBroker) Run() error {
+	options := []nats.Option{
+		nats.Name("centrifugo"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(300 * time.Millisecond),
+		nats.DisconnectHandler(func(_ *nats.Conn) {
+			logger.ERROR.Println("NatsBroker disconnected from NATS")
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			logger.INFO.Printf("NatsBroker reconnected to %s\n", conn.ConnectedUrl())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, sub *nats.Subscription, err error) {
+			if sub != nil {
+				logger.ERROR.Printf("NatsBroker error on subject %s: %v\n", sub.Subject, err)
+				return
+			}
+			logger.ERROR.Printf("NatsBroker error: %v\n", err)
+		}),
+	}
+	if b.config.ConnectTimeout > 0 {
+		options = append(options, nats.Timeout(b.config.ConnectTimeout))
+	}
+	conn, err := nats.Connect(b.config.URL, options...)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.conn = conn
+	b.Unlock()
+
+	b.app.RLock()
+	adminChannel := b.app.config.AdminChannel
+	controlChannel := b.app.config.ControlChannel
+	b.app.RUnlock()
+
+	err = b.Subscribe(adminChannel)
+	if err != nil {
+		return err
+	}
+	return b.Subscribe(controlChannel)
+}
+
+// natsSubject returns NATS subject for channel. Channel ID encoded as NATS subjects
+// can't contain whitespaces and wildcard tokens which are allowed in channel names.
+func natsSubject(chID ChannelID) string {
+	return natsSubjectPrefix + base64.RawURLEncoding.EncodeToString([]byte(chID))
+}
+
+func (b *NatsBroker) Publish(chID ChannelID, message []byte, opts *PublishOptions) <-chan error {
+	eChan := make(chan error, 1)
+	// NATS delivers message back to this node too, like Redis PUB/SUB does.
+	eChan <- b.conn.Publish(natsSubject(chID), message)
+	return eChan
+}
+
+func (b *NatsBroker) Subscribe(chID ChannelID) error {
+	logger.DEBUG.Println("subscribe on NATS subject for channel", chID)
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.subs[chID]; ok {
+		return nil
+	}
+	sub, err := b.conn.Subscribe(natsSubject(chID), func(msg *nats.Msg) {
+		b.app.HandleMsg(chID, msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	b.subs[chID] = sub
+	return nil
+}
+
+func (b *NatsBroker) Unsubscribe(chID ChannelID) error {
+	logger.DEBUG.Println("unsubscribe from NATS subject for channel", chID)
+	b.Lock()
+	defer b.Unlock()
+	sub, ok := b.subs[chID]
+	if !ok {
+		return nil
+	}
+	delete(b.subs, chID)
+	return sub.Unsubscribe()
+}
+
+// channels returns channels of this node only as NATS does not provide a way
+// to list active subjects.
+func (b *NatsBroker) Channels() ([]ChannelID, error) {
+	return b.app.clients.channels(), nil
+}
@@ -0,0 +1,113 @@
+//go:build nats
+
+// NATS engine tests need running NATS server, run them with:
+// go test -tags nats -run Nats
+// NATS_URL environment variable sets server URL, nats://127.0.0.1:4222 by default.
+
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testNatsURL returns URL of NATS server used in tests.
+func testNatsURL() string {
+	if url := os.Getenv("NATS_URL"); url != "" {
+		return url
+	}
+	return "nats://127.0.0.1:4222"
+}
+
+func testNatsApp(t *testing.T) (*Application, *NatsBroker) {
+	c := newTestConfig()
+	app, _ := NewApplication(&c)
+	broker := NewNatsBroker(app, &NatsBrokerConfig{
+		URL:            testNatsURL(),
+		ConnectTimeout: time.Second,
+	})
+	e := NewEngine(broker, NewMemoryHistoryStore(app), NewMemoryPresenceStore())
+	app.SetEngine(e)
+	err := e.Run()
+	assert.Equal(t, nil, err)
+	return app, broker
+}
+
+// testNatsMessage waits for client message from sink skipping other responses.
+func testNatsMessage(t *testing.T, sink chan []byte) Message {
+	for {
+		select {
+		case data := <-sink:
+			var resp clientMessageResponse
+			err := json.Unmarshal(data, &resp)
+			assert.Equal(t, nil, err)
+			if resp.Method == "message" {
+				return resp.Body
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for message from NATS")
+		}
+	}
+}
+
+func TestNatsBroker(t *testing.T) {
+	app1, _ := testNatsApp(t)
+	app2, broker2 := testNatsApp(t)
+	assert.Equal(t, "NATS", app1.engine.Name())
+
+	sink := make(chan []byte, 16)
+	createTestClients(app2, 1, 1, sink)
+	// Make sure NATS server processed subscription of second node.
+	err := broker2.conn.Flush()
+	assert.Equal(t, nil, err)
+
+	// Message published on one node delivered to client of another node.
+	err = app1.Publish(Channel("channel-0"), []byte(`{"input":"test"}`), "", nil)
+	assert.Equal(t, nil, err)
+	msg := testNatsMessage(t, sink)
+	assert.Equal(t, Channel("channel-0"), msg.Channel)
+	assert.Equal(t, `{"input":"test"}`, string(*msg.Data))
+	assert.Equal(t, uint64(1), msg.Seq)
+
+	// History and presence kept in stores composed with broker.
+	h, err := app1.History(Channel("channel-0"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, msg.UID, h[0].UID)
+	assert.Equal(t, msg.Epoch, h[0].Epoch)
+
+	chID := app2.channelID("channel-0")
+	assert.Equal(t, nil, app2.engine.AddPresence(chID, "uid", ClientInfo{}))
+	p, err := app2.engine.Presence(chID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(p))
+
+	channels, err := app2.engine.Channels()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ChannelID{chID}, channels)
+
+	assert.Equal(t, nil, app2.engine.Unsubscribe(chID))
+	assert.Equal(t, nil, app2.engine.Unsubscribe(chID))
+}
+
+func TestNatsSubject(t *testing.T) {
+	subject := natsSubject(ChannelID("centrifugo.channel.a b.*.>"))
+	assert.True(t, strings.HasPrefix(subject, natsSubjectPrefix))
+	token := strings.TrimPrefix(subject, natsSubjectPrefix)
+	assert.False(t, strings.ContainsAny(token, " .*>"))
+}
+
+func TestNatsBrokerConformance(t *testing.T) {
+	EngineConformance(t, func(app *Application) Engine {
+		broker := NewNatsBroker(app, &NatsBrokerConfig{
+			URL:            testNatsURL(),
+			ConnectTimeout: time.Second,
+		})
+		return NewEngine(broker, NewMemoryHistoryStore(app), NewMemoryPresenceStore())
+	})
+}
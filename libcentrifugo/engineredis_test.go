@@ -1,10 +1,23 @@
 package libcentrifugo
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -87,71 +100,93 @@ func TestRedisEngine(t *testing.T) {
 	defer c.close()
 	app := testApp()
 	e := testRedisEngine(app)
-	err := e.run()
+	err := e.Run()
 	assert.Equal(t, nil, err)
 	app.SetEngine(e)
-	assert.Equal(t, e.name(), "Redis")
+	assert.Equal(t, e.Name(), "Redis")
 
-	err = <-e.publish(ChannelID("channel"), []byte("{}"), nil)
+	err = <-e.Publish(ChannelID("channel"), []byte("{}"), nil)
 	assert.Equal(t, nil, err)
-	assert.Equal(t, nil, e.subscribe(ChannelID("channel")))
+	assert.Equal(t, nil, e.Subscribe(ChannelID("channel")))
 	// Now we've subscribed...
-	err = <-e.publish(ChannelID("channel"), []byte("{}"), nil)
-	assert.Equal(t, nil, e.unsubscribe(ChannelID("channel")))
+	err = <-e.Publish(ChannelID("channel"), []byte("{}"), nil)
+	assert.Equal(t, nil, e.Unsubscribe(ChannelID("channel")))
 
 	// test adding presence
-	assert.Equal(t, nil, e.addPresence(ChannelID("channel"), "uid", ClientInfo{}))
+	assert.Equal(t, nil, e.AddPresence(ChannelID("channel"), "uid", ClientInfo{}))
 
 	// test getting presence
-	p, err := e.presence(ChannelID("channel"))
+	p, err := e.Presence(ChannelID("channel"))
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(p))
 
 	// test removing presence
-	err = e.removePresence(ChannelID("channel"), "uid")
+	err = e.RemovePresence(ChannelID("channel"), "uid")
 	assert.Equal(t, nil, err)
 
 	msg := Message{UID: MessageID("test UID")}
 	msgJSON, _ := json.Marshal(msg)
 
 	// test adding history
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	h, err := e.history(ChannelID("channel"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	h, err := e.History(ChannelID("channel"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(h))
 	assert.Equal(t, h[0].UID, MessageID("test UID"))
 
 	// test history limit
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 4, 1, false}))
-	h, err = e.history(ChannelID("channel"), historyOpts{Limit: 2})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 4, 1, false}))
+	h, err = e.History(ChannelID("channel"), HistoryOptions{Limit: 2})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(h))
 
 	// test history limit greater than history size
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel"), msgJSON, &publishOpts{msg, 1, 1, false}))
-	h, err = e.history(ChannelID("channel"), historyOpts{Limit: 2})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel"), msgJSON, &PublishOptions{msg, 1, 1, false}))
+	h, err = e.History(ChannelID("channel"), HistoryOptions{Limit: 2})
+
+	// test history paging with sequence numbers
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, nil, <-e.Publish(ChannelID("channel-3"), msgJSON, &PublishOptions{msg, 10, 5, false}))
+	}
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{5, 4}, testHistorySeqs(h))
+	assert.NotEqual(t, "", h[0].Epoch)
+	assert.Equal(t, h[0].Epoch, h[1].Epoch)
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2, Since: 4})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{3, 2}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Limit: 2, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{1, 2}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Since: 3, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []uint64{4, 5}, testHistorySeqs(h))
+	h, err = e.History(ChannelID("channel-3"), HistoryOptions{Since: 5, Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(h))
 
 	// HistoryDropInactive tests - new channel to avoid conflicts with test above
 	// 1. add history with DropInactive = true should be a no-op if history is empty
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, true}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, true}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(h))
 
 	// 2. add history with DropInactive = false should always work
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, false}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, false}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 1, len(h))
 
 	// 3. add with DropInactive = true should work immediately since there should be something in history
 	// for 5 seconds from above
-	assert.Equal(t, nil, <-e.publish(ChannelID("channel-2"), msgJSON, &publishOpts{msg, 2, 5, true}))
-	h, err = e.history(ChannelID("channel-2"), historyOpts{})
+	assert.Equal(t, nil, <-e.Publish(ChannelID("channel-2"), msgJSON, &PublishOptions{msg, 2, 5, true}))
+	h, err = e.History(ChannelID("channel-2"), HistoryOptions{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 2, len(h))
 
@@ -168,17 +203,258 @@ func TestRedisEngine(t *testing.T) {
 	}
 }
 
+func TestRedisSubscribeRecover(t *testing.T) {
+	c := dial()
+	defer c.close()
+	app := testRedisApp()
+	err := app.engine.Run()
+	assert.Equal(t, nil, err)
+	testSubscribeRecover(t, app)
+}
+
 func TestRedisChannels(t *testing.T) {
 	c := dial()
 	defer c.close()
 	app := testRedisApp()
 	err := app.Run()
 	assert.Nil(t, err)
-	channels, err := app.engine.channels()
+	channels, err := app.engine.Channels()
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 0, len(channels))
 	createTestClients(app, 10, 1, nil)
-	channels, err = app.engine.channels()
+	channels, err = app.engine.Channels()
 	assert.Equal(t, nil, err)
 	assert.Equal(t, 10, len(channels))
 }
+
+func TestRedisMigrateHistory(t *testing.T) {
+	c := dial()
+	defer c.close()
+	app := testRedisApp()
+	e := app.engine.(*RedisEngine)
+	chID := app.channelID("channel")
+	listKey := app.config.ChannelPrefix + ".history.list." + string(chID)
+	for _, data := range []string{"1", "2"} {
+		messageJSON, _ := json.Marshal(newMessage(Channel("channel"), []byte(data), "", nil))
+		_, err := c.Conn.Do("LPUSH", listKey, messageJSON)
+		assert.Equal(t, nil, err)
+	}
+	_, err := c.Conn.Do("EXPIRE", listKey, 60)
+	assert.Equal(t, nil, err)
+
+	e.migrateHistory(e.shards[0])
+	exists, _ := redis.Bool(c.Conn.Do("EXISTS", listKey))
+	assert.Equal(t, false, exists)
+	ttl, _ := redis.Int(c.Conn.Do("TTL", e.getHistoryKey(chID)))
+	assert.True(t, ttl > 0 && ttl <= 60)
+	msgs, err := e.History(chID, HistoryOptions{Forward: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "1", string(*msgs[0].Data))
+	assert.Equal(t, uint64(1), msgs[0].Seq)
+	assert.Equal(t, "2", string(*msgs[1].Data))
+	assert.Equal(t, uint64(2), msgs[1].Seq)
+	assert.Equal(t, msgs[0].Epoch, msgs[1].Epoch)
+
+	// List dropped when history already kept in stream.
+	_, err = c.Conn.Do("LPUSH", listKey, "{}")
+	assert.Equal(t, nil, err)
+	e.migrateHistory(e.shards[0])
+	exists, _ = redis.Bool(c.Conn.Do("EXISTS", listKey))
+	assert.Equal(t, false, exists)
+	msgs, _ = e.History(chID, HistoryOptions{})
+	assert.Equal(t, 2, len(msgs))
+}
+
+func TestRedisEngineConformance(t *testing.T) {
+	c := dial()
+	defer c.close()
+	EngineConformance(t, func(app *Application) Engine {
+		return testRedisEngine(app)
+	})
+}
+
+func TestDecodeRedisPayload(t *testing.T) {
+	data, _ := encodeClientMessage(newMessage(Channel("test"), []byte(`{"input":"test"}`), "", nil))
+
+	// Messages published without history passed as is.
+	decoded, err := decodeRedisPayload(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, data, decoded)
+
+	decoded, err = decodeRedisPayload(append([]byte("__seq:42:epoch:"), data...))
+	assert.Equal(t, nil, err)
+	expected, _ := messageWithSeq(data, 42, "epoch")
+	assert.Equal(t, string(expected), string(decoded))
+
+	_, err = decodeRedisPayload([]byte("__seq:42"))
+	assert.NotEqual(t, nil, err)
+	_, err = decodeRedisPayload(append([]byte("__seq:x:epoch:"), data...))
+	assert.NotEqual(t, nil, err)
+}
+
+func TestJumpConsistentHash(t *testing.T) {
+	moved := 0
+	for i := uint64(0); i < 10000; i++ {
+		b5 := jumpConsistentHash(i, 5)
+		b6 := jumpConsistentHash(i, 6)
+		assert.True(t, b5 >= 0 && b5 < 5)
+		assert.Equal(t, b5, jumpConsistentHash(i, 5))
+		if b5 != b6 {
+			// Keys can only move to the new bucket.
+			assert.Equal(t, 5, b6)
+			moved++
+		}
+	}
+	// About 1/6 of keys must move to the new bucket.
+	assert.True(t, moved > 1000 && moved < 2400)
+	assert.Equal(t, 0, jumpConsistentHash(42, 1))
+}
+
+func TestShardedRedisEngineShard(t *testing.T) {
+	app := testApp()
+	confs := []*RedisEngineConfig{
+		{Host: testRedisHost, Port: "6379", PoolSize: testRedisPoolSize},
+		{Host: testRedisHost, Port: "6380", PoolSize: testRedisPoolSize},
+		{Host: testRedisHost, Port: "6381", PoolSize: testRedisPoolSize},
+	}
+	e := NewShardedRedisEngine(app, confs)
+	assert.Equal(t, 3, len(e.shards))
+
+	// Internal channels pinned to the first shard.
+	assert.Equal(t, e.shards[0], e.shard(app.config.ControlChannel))
+	assert.Equal(t, e.shards[0], e.shard(app.config.AdminChannel))
+
+	used := make(map[*redisShard]int)
+	for i := 0; i < 300; i++ {
+		chID := app.channelID(Channel(fmt.Sprintf("channel-%d", i)))
+		shard := e.shard(chID)
+		assert.Equal(t, shard, e.shard(chID))
+		used[shard]++
+	}
+	assert.Equal(t, 3, len(used))
+	for _, shard := range e.shards {
+		assert.True(t, used[shard] > 50)
+	}
+}
+
+// testTLSRedisServer starts TLS server with self-signed certificate for 127.0.0.1
+// which answers +OK to any command and sends received commands into commands
+// channel. Returns server address and path to PEM file with its certificate.
+func testTLSRedisServer(t *testing.T, commands chan []string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+
+	dir, err := ioutil.TempDir("", "centrifugo-redis-tls")
+	assert.Equal(t, nil, err)
+	caFile := filepath.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	assert.Equal(t, nil, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.Equal(t, nil, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					// Commands are sent as arrays of bulk strings.
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					cmd := make([]string, n)
+					for i := range cmd {
+						var size int
+						if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+							return
+						}
+						buf := make([]byte, size+2)
+						if _, err := io.ReadFull(r, buf); err != nil {
+							return
+						}
+						cmd[i] = string(buf[:size])
+					}
+					commands <- cmd
+					conn.Write([]byte("+OK\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		os.RemoveAll(dir)
+	})
+	return ln.Addr().String(), caFile
+}
+
+func TestRedisTLSConfig(t *testing.T) {
+	tlsConfig, err := redisTLSConfig(&RedisEngineConfig{}, false)
+	assert.Equal(t, nil, err)
+	assert.True(t, tlsConfig == nil)
+
+	tlsConfig, err = redisTLSConfig(&RedisEngineConfig{TLSSkipVerify: true}, true)
+	assert.Equal(t, nil, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+
+	_, err = redisTLSConfig(&RedisEngineConfig{TLSCAFile: "/nonexistent/ca.pem"}, true)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestNewPoolTLSWithUser(t *testing.T) {
+	commands := make(chan []string, 16)
+	addr, caFile := testTLSRedisServer(t, commands)
+
+	pool := newPool(&RedisEngineConfig{
+		URL:            "rediss://user:pass@" + addr + "/2",
+		TLSCAFile:      caFile,
+		PoolSize:       1,
+		ConnectTimeout: time.Second,
+		ReadTimeout:    time.Second,
+		WriteTimeout:   time.Second,
+	})
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "AUTH user pass", strings.Join(<-commands, " "))
+	assert.Equal(t, "SELECT 2", strings.Join(<-commands, " "))
+	assert.Equal(t, "PING", strings.Join(<-commands, " "))
+}
+
+func TestNewPoolTLSUnknownAuthority(t *testing.T) {
+	commands := make(chan []string, 16)
+	addr, _ := testTLSRedisServer(t, commands)
+	host, port, _ := net.SplitHostPort(addr)
+
+	pool := newPool(&RedisEngineConfig{
+		Host:           host,
+		Port:           port,
+		UseTLS:         true,
+		PoolSize:       1,
+		ConnectTimeout: time.Second,
+	})
+	conn := pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PING")
+	assert.NotEqual(t, nil, err)
+}
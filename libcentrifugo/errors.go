@@ -9,6 +9,8 @@ var (
 	ErrInvalidMessage = errors.New("invalid message")
 	// ErrInvalidToken means that client sent invalid token.
 	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired means that client sent token which is already expired.
+	ErrTokenExpired = errors.New("token expired")
 	// ErrUnauthorized means unauthorized access.
 	ErrUnauthorized = errors.New("unauthorized")
 	// ErrMethodNotFound means that method sent in command does not exist.
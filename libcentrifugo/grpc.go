@@ -0,0 +1,363 @@
+package libcentrifugo
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FZambia/go-logger"
+	"github.com/centrifugal/centrifugo/libcentrifugo/protobuf"
+)
+
+// GRPCAPIPath is a path prefix of gRPC API service methods described in api.proto.
+const GRPCAPIPath = "/libcentrifugo.API/"
+
+// grpcMaxMessageSize is a maximum size of gRPC API request message.
+const grpcMaxMessageSize = 4 << 20
+
+// gRPC status codes used by API service.
+const (
+	grpcStatusOK               = 0
+	grpcStatusCanceled         = 1
+	grpcStatusInvalidArgument  = 3
+	grpcStatusDeadlineExceeded = 4
+	grpcStatusUnimplemented    = 12
+	grpcStatusInternal         = 13
+	grpcStatusUnauthenticated  = 16
+)
+
+// grpcStatus is an error finishing gRPC call with non OK status.
+type grpcStatus struct {
+	code    int
+	message string
+}
+
+func (s *grpcStatus) Error() string {
+	return s.message
+}
+
+// grpcUnaryMethods maps gRPC API service unary methods to API command methods.
+var grpcUnaryMethods = map[string]string{
+	"Publish":     "publish",
+	"Broadcast":   "broadcast",
+	"Subscribe":   "subscribe",
+	"Unsubscribe": "unsubscribe",
+	"Disconnect":  "disconnect",
+	"Presence":    "presence",
+	"History":     "history",
+	"Channels":    "channels",
+	"Stats":       "stats",
+	"Node":        "node",
+}
+
+// GRPCAPIHandler serves server API as gRPC service over HTTP/2. Methods have the
+// same semantics as HTTP API commands – command errors returned in response
+// message error field while gRPC status reports transport and auth problems.
+// PublishStream method accepts stream of publish requests and answers with
+// response to each of them in the same order. Every call must be authorized with
+// "authorization: apikey <KEY>" metadata unless insecure API mode is on. Call
+// finished with DEADLINE_EXCEEDED status when grpc-timeout passed.
+func (app *Application) GRPCAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "Unsupported Media Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.ProtoMajor != 2 {
+		http.Error(w, "HTTP/2 required", http.StatusHTTPVersionNotSupported)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	err := app.grpcCall(w, r)
+	code, message := grpcStatusOK, ""
+	if err != nil {
+		code, message = grpcStatusInternal, ErrInternalServerError.Error()
+		if status, ok := err.(*grpcStatus); ok {
+			code, message = status.code, status.message
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEncodeMessage(message))
+	}
+}
+
+func (app *Application) grpcCall(w http.ResponseWriter, r *http.Request) error {
+	err := app.checkGRPCAuth(r)
+	if err != nil {
+		return err
+	}
+
+	ctx := r.Context()
+	if value := r.Header.Get("Grpc-Timeout"); value != "" {
+		timeout, err := parseGRPCTimeout(value)
+		if err != nil {
+			return &grpcStatus{grpcStatusInternal, err.Error()}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, GRPCAPIPath)
+
+	if name == "PublishStream" {
+		return app.grpcPublishStream(ctx, w, r)
+	}
+
+	method, ok := grpcUnaryMethods[name]
+	if !ok {
+		return &grpcStatus{grpcStatusUnimplemented, ErrMethodNotFound.Error()}
+	}
+
+	app.metrics.NumAPIRequests.Inc()
+
+	// Command executed in separate goroutine so call finished on deadline, its
+	// response is dropped then.
+	type result struct {
+		resp *response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		params, err := readGRPCMessage(r.Body)
+		if err != nil {
+			if err == io.EOF {
+				err = &grpcStatus{grpcStatusInvalidArgument, ErrInvalidMessage.Error()}
+			}
+			done <- result{nil, err}
+			return
+		}
+		resp, err := app.decodeAPICmd(method, params, decodeProtobufParams)
+		if err == ErrInvalidMessage {
+			err = &grpcStatus{grpcStatusInvalidArgument, err.Error()}
+		}
+		done <- result{resp, err}
+	}()
+
+	var res result
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		return grpcContextStatus(ctx.Err())
+	}
+	if res.err != nil {
+		return res.err
+	}
+	return app.writeGRPCResponse(w, res.resp)
+}
+
+// parseGRPCTimeout parses grpc-timeout header value: positive integer of at
+// most 8 digits followed by time unit.
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("malformed grpc-timeout: %q", value)
+	}
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, fmt.Errorf("malformed grpc-timeout: %q", value)
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout: %q", value)
+	}
+	if n > int64(math.MaxInt64/unit) {
+		// Too large to fit into time.Duration – effectively no timeout.
+		n = int64(math.MaxInt64 / unit)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// grpcContextStatus returns status of call finished because its context done.
+func grpcContextStatus(err error) error {
+	if err == context.DeadlineExceeded {
+		return &grpcStatus{grpcStatusDeadlineExceeded, "deadline exceeded"}
+	}
+	return &grpcStatus{grpcStatusCanceled, "canceled"}
+}
+
+// grpcEncodeMessage percent-encodes grpc-message value as gRPC protocol requires:
+// bytes outside of printable ASCII range and percent sign itself encoded.
+func grpcEncodeMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// checkGRPCAuth checks API key provided in call metadata.
+func (app *Application) checkGRPCAuth(r *http.Request) error {
+	app.RLock()
+	insecure := app.config.InsecureAPI
+	key := app.config.GRPCAPIKey
+	app.RUnlock()
+	if insecure {
+		return nil
+	}
+	if key == "" {
+		logger.ERROR.Println("no gRPC API key set in config")
+		return &grpcStatus{grpcStatusUnauthenticated, ErrUnauthorized.Error()}
+	}
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "apikey ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) != 1 {
+		return &grpcStatus{grpcStatusUnauthenticated, ErrUnauthorized.Error()}
+	}
+	return nil
+}
+
+// grpcPublishStream handles stream of publish requests. Requests published
+// asynchronously so backend does not need to wait for response before sending
+// next request, responses are written in order requests came. Stream finished
+// when ctx done.
+func (app *Application) grpcPublishStream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	pending := make(chan (<-chan error), 256)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(pending)
+		for {
+			params, err := readGRPCMessage(r.Body)
+			if err != nil {
+				if err != io.EOF {
+					readErr <- err
+				}
+				return
+			}
+			app.metrics.NumAPIRequests.Inc()
+			var cmd publishAPICommand
+			err = decodeProtobufParams(params, &cmd)
+			if err != nil {
+				readErr <- &grpcStatus{grpcStatusInvalidArgument, ErrInvalidMessage.Error()}
+				return
+			}
+			pending <- app.publishAsync(cmd.Channel, cmd.Data, cmd.Client, nil, false)
+		}
+	}()
+
+	// drain lets reader goroutine finish.
+	drain := func() {
+		go func() {
+			for range pending {
+			}
+		}()
+	}
+
+	for {
+		var errCh <-chan error
+		var ok bool
+		select {
+		case errCh, ok = <-pending:
+		case <-ctx.Done():
+			drain()
+			return grpcContextStatus(ctx.Err())
+		}
+		if !ok {
+			break
+		}
+		resp := newResponse("publish")
+		if err := <-errCh; err != nil {
+			resp.Err(err)
+		}
+		err := app.writeGRPCResponse(w, resp)
+		if err != nil {
+			drain()
+			return err
+		}
+	}
+
+	select {
+	case err := <-readErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (app *Application) writeGRPCResponse(w http.ResponseWriter, resp *response) error {
+	msg := protobuf.NewBuffer(nil)
+	if resp.Error != nil {
+		msg.EncodeString(1, *resp.Error)
+	}
+	if resp.Body != nil {
+		body, err := encodeBody(resp.Body)
+		if err != nil {
+			logger.ERROR.Println(err)
+			return err
+		}
+		msg.EncodeMessage(2, body)
+	}
+	err := writeGRPCMessage(w, msg.Bytes())
+	if err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// readGRPCMessage reads length-prefixed gRPC message. It returns io.EOF if
+// there are no more messages in stream.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, &grpcStatus{grpcStatusInvalidArgument, ErrInvalidMessage.Error()}
+		}
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcStatus{grpcStatusUnimplemented, "compression not supported"}
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > grpcMaxMessageSize {
+		return nil, &grpcStatus{grpcStatusInvalidArgument, ErrLimitExceeded.Error()}
+	}
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, &grpcStatus{grpcStatusInvalidArgument, ErrInvalidMessage.Error()}
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(msg)))
+	copy(frame[5:], msg)
+	_, err := w.Write(frame)
+	return err
+}
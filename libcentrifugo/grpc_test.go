@@ -0,0 +1,210 @@
+package libcentrifugo
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func testGRPCServer(app *Application) *httptest.Server {
+	server := httptest.NewUnstartedServer(DefaultMux(app, MuxOptions{HandlerFlags: HandlerGRPCAPI}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+func testGRPCCall(t *testing.T, server *httptest.Server, method, key string, body io.Reader) (*http.Response, [][]byte) {
+	req, _ := http.NewRequest("POST", server.URL+GRPCAPIPath+method, body)
+	req.Header.Set("Content-Type", "application/grpc")
+	if key != "" {
+		req.Header.Set("Authorization", "apikey "+key)
+	}
+	resp, err := server.Client().Do(req)
+	assert.Equal(t, nil, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	var msgs [][]byte
+	r := bytes.NewReader(data)
+	for {
+		msg, err := readGRPCMessage(r)
+		if err == io.EOF {
+			break
+		}
+		assert.Equal(t, nil, err)
+		msgs = append(msgs, msg)
+	}
+	return resp, msgs
+}
+
+func testGRPCMessage(msgs ...[]byte) io.Reader {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		writeGRPCMessage(&buf, msg)
+	}
+	return &buf
+}
+
+func testGRPCPublishRequest(ch, data string) []byte {
+	b := protobuf.NewBuffer(nil)
+	b.EncodeString(1, ch)
+	b.EncodeBytes(2, []byte(data))
+	return b.Bytes()
+}
+
+func TestGRPCAPIAuth(t *testing.T) {
+	app := testMemoryApp()
+	server := testGRPCServer(app)
+	defer server.Close()
+
+	resp, _ := testGRPCCall(t, server, "Publish", "", testGRPCMessage(testGRPCPublishRequest("channel", "{}")))
+	assert.Equal(t, "16", resp.Trailer.Get("Grpc-Status"))
+
+	app.Lock()
+	app.config.GRPCAPIKey = "key"
+	app.Unlock()
+	resp, _ = testGRPCCall(t, server, "Publish", "wrong", testGRPCMessage(testGRPCPublishRequest("channel", "{}")))
+	assert.Equal(t, "16", resp.Trailer.Get("Grpc-Status"))
+
+	resp, msgs := testGRPCCall(t, server, "Publish", "key", testGRPCMessage(testGRPCPublishRequest("channel", "{}")))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, 0, len(msgs[0]))
+
+	app.Lock()
+	app.config.GRPCAPIKey = ""
+	app.config.InsecureAPI = true
+	app.Unlock()
+	resp, _ = testGRPCCall(t, server, "Publish", "", testGRPCMessage(testGRPCPublishRequest("channel", "{}")))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestGRPCAPIHandler(t *testing.T) {
+	app := testMemoryApp()
+	app.config.GRPCAPIKey = "key"
+	server := testGRPCServer(app)
+	defer server.Close()
+
+	resp, _ := testGRPCCall(t, server, "Unknown", "key", testGRPCMessage(nil))
+	assert.Equal(t, "12", resp.Trailer.Get("Grpc-Status"))
+
+	resp, _ = testGRPCCall(t, server, "Publish", "key", testGRPCMessage([]byte{0xff}))
+	assert.Equal(t, "3", resp.Trailer.Get("Grpc-Status"))
+
+	// data is opaque for Protocol Buffers.
+	resp, _ = testGRPCCall(t, server, "Publish", "key", testGRPCMessage(testGRPCPublishRequest("channel", "not JSON")))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+
+	// command error returned in response message.
+	resp, msgs := testGRPCCall(t, server, "Broadcast", "key", testGRPCMessage(nil))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, ErrInvalidMessage.Error(), string(testDecodeProtobufFields(t, msgs[0])[1]))
+
+	createTestClients(app, 2, 1, nil)
+	resp, msgs = testGRPCCall(t, server, "Channels", "key", testGRPCMessage(nil))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	result := testDecodeProtobufFields(t, msgs[0])[2]
+	var channels []string
+	d := protobuf.NewDecoder(result)
+	for d.Next() {
+		channels = append(channels, d.String())
+	}
+	assert.Equal(t, 2, len(channels))
+
+	app.pubPing()
+	resp, msgs = testGRPCCall(t, server, "Node", "key", testGRPCMessage(nil))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	node := testDecodeProtobufFields(t, testDecodeProtobufFields(t, msgs[0])[2])[1]
+	d = protobuf.NewDecoder(node)
+	var uid string
+	for d.Next() {
+		if d.Field() == 1 {
+			uid = d.String()
+		} else {
+			d.Skip()
+		}
+	}
+	assert.Equal(t, nil, d.Err())
+	assert.Equal(t, app.uid, uid)
+}
+
+func TestGRPCAPIPublishStream(t *testing.T) {
+	app := testMemoryApp()
+	app.config.GRPCAPIKey = "key"
+	server := testGRPCServer(app)
+	defer server.Close()
+
+	body := testGRPCMessage(
+		testGRPCPublishRequest("channel", `{"n": 1}`),
+		testGRPCPublishRequest("", `{"n": 2}`),
+		testGRPCPublishRequest("channel", `{"n": 3}`),
+	)
+	resp, msgs := testGRPCCall(t, server, "PublishStream", "key", body)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, 0, len(msgs[0]))
+	assert.Equal(t, ErrInvalidMessage.Error(), string(testDecodeProtobufFields(t, msgs[1])[1]))
+	assert.Equal(t, 0, len(msgs[2]))
+}
+
+func TestGRPCAPIDeadline(t *testing.T) {
+	app := testMemoryApp()
+	app.config.InsecureAPI = true
+	server := testGRPCServer(app)
+	defer server.Close()
+
+	// Stream of publish requests which never ends.
+	body, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	req, _ := http.NewRequest("POST", server.URL+GRPCAPIPath+"PublishStream", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "50m")
+	resp, err := server.Client().Do(req)
+	assert.Equal(t, nil, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "4", resp.Trailer.Get("Grpc-Status"))
+
+	req, _ = http.NewRequest("POST", server.URL+GRPCAPIPath+"Publish", testGRPCMessage(testGRPCPublishRequest("channel", "{}")))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "1x")
+	resp, err = server.Client().Do(req)
+	assert.Equal(t, nil, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "13", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, `malformed grpc-timeout: "1x"`, resp.Trailer.Get("Grpc-Message"))
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	timeout, err := parseGRPCTimeout("100m")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 100*time.Millisecond, timeout)
+	timeout, err = parseGRPCTimeout("2S")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2*time.Second, timeout)
+	timeout, err = parseGRPCTimeout("99999999H")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, time.Duration(math.MaxInt64/time.Hour)*time.Hour, timeout)
+	_, err = parseGRPCTimeout("1")
+	assert.NotEqual(t, nil, err)
+	_, err = parseGRPCTimeout("123456789S")
+	assert.NotEqual(t, nil, err)
+	_, err = parseGRPCTimeout("-1S")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGRPCEncodeMessage(t *testing.T) {
+	assert.Equal(t, "invalid message", grpcEncodeMessage("invalid message"))
+	assert.Equal(t, "100%25 d%C3%A9j%C3%A0%0A", grpcEncodeMessage("100% déjà\n"))
+}
@@ -1,11 +1,16 @@
 package libcentrifugo
 
 import (
+	"bufio"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/FZambia/go-logger"
@@ -28,18 +33,34 @@ const (
 	HandlerAdmin
 	// HandlerDebug enables debug handlers.
 	HandlerDebug
+	// HandlerGRPCAPI enables gRPC API handler. gRPC requires HTTP/2 so server
+	// must accept HTTP/2 connections – over TLS or unencrypted (h2c).
+	HandlerGRPCAPI
+	// HandlerPrometheus enables Prometheus metrics handler.
+	HandlerPrometheus
+	// HandlerSSE enables Server-Sent Events handler.
+	HandlerSSE
+	// HandlerHTTPStream enables HTTP streaming handler.
+	HandlerHTTPStream
+	// HandlerHTTPPoll enables HTTP long-polling handler.
+	HandlerHTTPPoll
 )
 
 var handlerText = map[HandlerFlag]string{
-	HandlerRawWS:  "raw websocket",
-	HandlerSockJS: "SockJS",
-	HandlerAPI:    "API",
-	HandlerAdmin:  "admin",
-	HandlerDebug:  "debug",
+	HandlerRawWS:      "raw websocket",
+	HandlerSockJS:     "SockJS",
+	HandlerSSE:        "SSE",
+	HandlerHTTPStream: "HTTP stream",
+	HandlerHTTPPoll:   "HTTP poll",
+	HandlerAPI:        "API",
+	HandlerAdmin:      "admin",
+	HandlerDebug:      "debug",
+	HandlerGRPCAPI:    "gRPC API",
+	HandlerPrometheus: "Prometheus metrics",
 }
 
 func (flags HandlerFlag) String() string {
-	flagsOrdered := []HandlerFlag{HandlerRawWS, HandlerSockJS, HandlerAPI, HandlerAdmin, HandlerDebug}
+	flagsOrdered := []HandlerFlag{HandlerRawWS, HandlerSockJS, HandlerSSE, HandlerHTTPStream, HandlerHTTPPoll, HandlerAPI, HandlerGRPCAPI, HandlerAdmin, HandlerDebug, HandlerPrometheus}
 	endpoints := []string{}
 	for _, flag := range flagsOrdered {
 		text, ok := handlerText[flag]
@@ -90,11 +111,31 @@ func DefaultMux(app *Application, muxOpts MuxOptions) *http.ServeMux {
 		mux.Handle(prefix+"/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 	}
 
+	if flags&HandlerPrometheus != 0 {
+		// register Prometheus metrics endpoint, not logged as scraped periodically.
+		mux.Handle(prefix+"/metrics", http.HandlerFunc(app.PrometheusHandler))
+	}
+
 	if flags&HandlerRawWS != 0 {
 		// register raw Websocket endpoint.
 		mux.Handle(prefix+"/connection/websocket", app.Logged(app.WrapShutdown(http.HandlerFunc(app.RawWebsocketHandler))))
 	}
 
+	if flags&HandlerSSE != 0 {
+		// register Server-Sent Events endpoint.
+		mux.Handle(prefix+"/connection/sse", app.Logged(app.WrapShutdown(http.HandlerFunc(app.SSEHandler))))
+	}
+
+	if flags&HandlerHTTPStream != 0 {
+		// register HTTP streaming endpoint.
+		mux.Handle(prefix+"/connection/http_stream", app.Logged(app.WrapShutdown(http.HandlerFunc(app.HTTPStreamHandler))))
+	}
+
+	if flags&HandlerHTTPPoll != 0 {
+		// register HTTP long-polling endpoint.
+		mux.Handle(prefix+"/connection/http_poll", app.Logged(app.WrapShutdown(NewHTTPPollHandler(app))))
+	}
+
 	if flags&HandlerSockJS != 0 {
 		// register SockJS endpoints.
 		sjsh := NewSockJSHandler(app, prefix+"/connection", muxOpts.SockjsOptions)
@@ -106,6 +147,11 @@ func DefaultMux(app *Application, muxOpts MuxOptions) *http.ServeMux {
 		mux.Handle(prefix+"/api/", app.Logged(app.WrapShutdown(http.HandlerFunc(app.APIHandler))))
 	}
 
+	if flags&HandlerGRPCAPI != 0 {
+		// register gRPC API service, gRPC clients can't use path prefix.
+		mux.Handle(GRPCAPIPath, app.Logged(app.WrapShutdown(http.HandlerFunc(app.GRPCAPIHandler))))
+	}
+
 	if admin && flags&HandlerAdmin != 0 {
 		// register admin websocket endpoint.
 		mux.Handle(prefix+"/socket", app.Logged(http.HandlerFunc(app.AdminWebsocketHandler)))
@@ -133,7 +179,100 @@ func DefaultMux(app *Application, muxOpts MuxOptions) *http.ServeMux {
 // SockJS handler has several handlers inside responsible for various tasks
 // according to SockJS protocol.
 func NewSockJSHandler(app *Application, sockjsPrefix string, sockjsOpts sockjs.Options) http.Handler {
-	return sockjs.NewHandler(sockjsPrefix, sockjsOpts, app.sockJSHandler)
+	h := &sockjsHeaderHandler{
+		prefix:  sockjsPrefix,
+		headers: make(map[string]*sockjsHeader),
+	}
+	h.handler = sockjs.NewHandler(sockjsPrefix, sockjsOpts, func(s sockjs.Session) {
+		header := h.claim(s.ID())
+		defer h.remove(s.ID())
+		app.sockJSHandler(s, header)
+	})
+	return h
+}
+
+// sockjsHeaderTimeout is a time headers of request kept for SockJS session
+// which is not started yet.
+const sockjsHeaderTimeout = 10 * time.Second
+
+type sockjsHeader struct {
+	header  http.Header
+	claimed bool
+}
+
+// sockjsHeaderHandler keeps headers of HTTP request SockJS session started
+// with as sockjs.Session does not give access to request. Headers are needed
+// to forward them to connect proxy.
+type sockjsHeaderHandler struct {
+	sync.Mutex
+	prefix  string
+	handler http.Handler
+	headers map[string]*sockjsHeader
+}
+
+func (h *sockjsHeaderHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if sessionID := h.sessionID(r.URL.Path); sessionID != "" && h.add(sessionID, r.Header) {
+		// Session handler claims headers almost immediately, headers of requests
+		// which did not start session removed after timeout.
+		time.AfterFunc(sockjsHeaderTimeout, func() {
+			h.expire(sessionID)
+		})
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// sessionID extracts SockJS session ID from URL path which looks like
+// prefix/server/session/transport. It returns empty string if path does not
+// belong to session.
+func (h *sockjsHeaderHandler) sessionID(path string) string {
+	if !strings.HasPrefix(path, h.prefix+"/") {
+		return ""
+	}
+	parts := strings.Split(path[len(h.prefix)+1:], "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || strings.Contains(parts[0]+parts[1], ".") {
+		return ""
+	}
+	return parts[1]
+}
+
+// add saves headers for session if there are no headers for it yet, it returns
+// whether headers were saved.
+func (h *sockjsHeaderHandler) add(sessionID string, header http.Header) bool {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.headers[sessionID]; ok {
+		return false
+	}
+	h.headers[sessionID] = &sockjsHeader{header: header}
+	return true
+}
+
+// claim returns headers of request session started with and keeps them until
+// session is removed.
+func (h *sockjsHeaderHandler) claim(sessionID string) http.Header {
+	h.Lock()
+	defer h.Unlock()
+	sh, ok := h.headers[sessionID]
+	if !ok {
+		return nil
+	}
+	sh.claimed = true
+	return sh.header
+}
+
+// expire removes headers if session did not claim them.
+func (h *sockjsHeaderHandler) expire(sessionID string) {
+	h.Lock()
+	defer h.Unlock()
+	if sh, ok := h.headers[sessionID]; ok && !sh.claimed {
+		delete(h.headers, sessionID)
+	}
+}
+
+func (h *sockjsHeaderHandler) remove(sessionID string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.headers, sessionID)
 }
 
 type sockjsConn struct {
@@ -161,17 +300,19 @@ func (conn *sockjsConn) Close(status uint32, reason string) error {
 	return conn.sess.Close(status, reason)
 }
 
-// sockJSHandler called when new client connection comes to SockJS endpoint.
-func (app *Application) sockJSHandler(s sockjs.Session) {
+// sockJSHandler called when new client connection comes to SockJS endpoint,
+// header contains headers of request session started with.
+func (app *Application) sockJSHandler(s sockjs.Session, header http.Header) {
 
 	conn := newSockjsConn(s)
 	defer close(conn.closeCh)
 
-	c, err := newClient(app, conn)
+	c, err := newClient(app, conn, jsonClientEncoding)
 	if err != nil {
 		logger.ERROR.Println(err)
 		return
 	}
+	c.header = header
 	defer c.clean()
 	logger.INFO.Printf("New SockJS session established with uid %s\n", c.uid())
 
@@ -196,13 +337,28 @@ type wsConn struct {
 	closeCh      chan struct{}
 	pingInterval time.Duration
 	pingTimer    *time.Timer
+	frameType    int
+	// compression set when permessage-deflate compression enabled for connection.
+	compression *wsCompression
+}
+
+// wsCompression contains permessage-deflate compression state of connection.
+type wsCompression struct {
+	// minSize is a minimal size of message in bytes to compress.
+	minSize int
+	// netConn counts payload bytes actually written into connection to
+	// calculate how many bytes compression saved.
+	netConn *wsCountingConn
+	metrics *metricsRegistry
 }
 
-func newWSConn(ws *websocket.Conn, pingInterval time.Duration) *wsConn {
+func newWSConn(ws *websocket.Conn, pingInterval time.Duration, frameType int, compression *wsCompression) *wsConn {
 	conn := &wsConn{
 		ws:           ws,
 		closeCh:      make(chan struct{}),
 		pingInterval: pingInterval,
+		frameType:    frameType,
+		compression:  compression,
 	}
 	conn.pingTimer = time.AfterFunc(conn.pingInterval, conn.ping)
 	return conn
@@ -229,19 +385,226 @@ func (conn *wsConn) Send(message []byte) error {
 	case <-conn.closeCh:
 		return nil
 	default:
-		return conn.ws.WriteMessage(websocket.TextMessage, message)
+		if conn.compression != nil {
+			return conn.writeCompressed(message)
+		}
+		return conn.ws.WriteMessage(conn.frameType, message)
+	}
+}
+
+// newWSPreparedFrame prepares websocket frame of message for wsConn.SendPrepared.
+func newWSPreparedFrame(frameType int, data []byte) (preparedFrame, error) {
+	return websocket.NewPreparedMessage(frameType, data)
+}
+
+// SendPrepared sends message frame prepared once for all connections message
+// broadcast to. Frame type of prepared message matches connection encoding.
+// Message sent as is if frame was not prepared by newWSPreparedFrame.
+func (conn *wsConn) SendPrepared(message []byte, prepared preparedFrame) error {
+	pm, ok := prepared.(*websocket.PreparedMessage)
+	if !ok {
+		return conn.Send(message)
+	}
+	select {
+	case <-conn.closeCh:
+		return nil
+	default:
+		if conn.compression != nil {
+			return conn.writePreparedCompressed(message, pm)
+		}
+		return conn.ws.WritePreparedMessage(pm)
+	}
+}
+
+// writeCompressed writes message compressing it if message is not smaller than
+// configured minimal size. Compression only applied if client negotiated
+// permessage-deflate extension, bytes saved only counted if compression helped.
+func (conn *wsConn) writeCompressed(message []byte) error {
+	return conn.compression.write(conn.ws, len(message), func() error {
+		return conn.ws.WriteMessage(conn.frameType, message)
+	})
+}
+
+// writePreparedCompressed is the same as writeCompressed for prepared message,
+// compressed frame built once for all connections using the same compression
+// level.
+func (conn *wsConn) writePreparedCompressed(message []byte, prepared *websocket.PreparedMessage) error {
+	return conn.compression.write(conn.ws, len(message), func() error {
+		return conn.ws.WritePreparedMessage(prepared)
+	})
+}
+
+// write calls write function enabling compression for messages not smaller than
+// minimal size and counts bytes compression saved.
+func (c *wsCompression) write(ws *websocket.Conn, size int, write func() error) error {
+	compress := size >= c.minSize
+	ws.EnableWriteCompression(compress)
+	if !compress {
+		return write()
+	}
+	written := c.netConn.written()
+	err := write()
+	if err != nil {
+		return err
+	}
+	saved := int64(size) - (c.netConn.written() - written)
+	if saved > 0 {
+		c.metrics.BytesCompressionSaved.Add(saved)
+	}
+	return nil
+}
+
+// wsCountingConn is a net.Conn which counts payload bytes of websocket data
+// frames written into it. Frame headers and control frames (pings written from
+// another goroutine, close) are not counted so only compressed message payload
+// is compared with message size.
+type wsCountingConn struct {
+	net.Conn
+	mu sync.Mutex
+	// framing set after handshake, bytes written before are not frames.
+	framing bool
+	// header is a part of frame header written so far.
+	header []byte
+	// remaining is a number of payload bytes of current frame not written yet.
+	remaining uint64
+	// data set when current frame is data frame.
+	data bool
+	n    int64
+}
+
+func (c *wsCountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.count(p[:n])
+	return n, err
+}
+
+// startFraming starts counting frames written into connection, must be called
+// when websocket handshake done.
+func (c *wsCountingConn) startFraming() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.framing = true
+}
+
+// count parses frames written into connection. Frames can be split over several
+// writes but frames are never interleaved as websocket connection serializes them.
+func (c *wsCountingConn) count(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.framing {
+		return
+	}
+	for len(p) > 0 {
+		if c.remaining > 0 {
+			k := uint64(len(p))
+			if k > c.remaining {
+				k = c.remaining
+			}
+			if c.data {
+				c.n += int64(k)
+			}
+			c.remaining -= k
+			p = p[k:]
+			continue
+		}
+		c.header = append(c.header, p[0])
+		p = p[1:]
+		length, ok := wsFramePayloadLength(c.header)
+		if !ok {
+			continue
+		}
+		// Opcodes of control frames have high bit set.
+		c.data = c.header[0]&0x08 == 0
+		c.remaining = length
+		c.header = c.header[:0]
+	}
+}
+
+// wsFramePayloadLength returns payload length of frame if header is complete.
+// Frames written by server are not masked.
+func wsFramePayloadLength(header []byte) (uint64, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	switch length := header[1] & 0x7f; length {
+	case 126:
+		if len(header) < 4 {
+			return 0, false
+		}
+		return uint64(binary.BigEndian.Uint16(header[2:4])), true
+	case 127:
+		if len(header) < 10 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint64(header[2:10]), true
+	default:
+		return uint64(length), true
 	}
 }
 
+// written returns number of payload bytes of data frames written.
+func (c *wsCountingConn) written() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// wsCountingResponseWriter wraps http.ResponseWriter so connection hijacked by
+// websocket upgrader counts bytes written into it.
+type wsCountingResponseWriter struct {
+	http.ResponseWriter
+	netConn *wsCountingConn
+}
+
+func (w *wsCountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	netConn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.netConn = &wsCountingConn{Conn: netConn}
+	return w.netConn, brw, nil
+}
+
 func (conn *wsConn) Close(status uint32, reason string) error {
 	conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(int(status), reason), time.Now().Add(time.Second))
 	return conn.ws.Close()
 }
 
 // RawWebsocketHandler called when new client connection comes to raw Websocket endpoint.
+// Connection uses JSON client protocol by default, binary Protocol Buffers protocol
+// used when client requests ProtobufSubprotocol or sets format=protobuf URL parameter.
+// When WebsocketCompression enabled permessage-deflate extension negotiated with
+// clients supporting it.
 func (app *Application) RawWebsocketHandler(w http.ResponseWriter, r *http.Request) {
 
-	ws, err := websocket.Upgrade(w, r, nil, sockjs.WebSocketReadBufSize, sockjs.WebSocketWriteBufSize)
+	enc, responseHeader := rawWSEncoding(r)
+
+	app.RLock()
+	pingInterval := app.config.PingInterval
+	compression := app.config.WebsocketCompression
+	compressionLevel := app.config.WebsocketCompressionLevel
+	compressionMinSize := app.config.WebsocketCompressionMinSize
+	app.RUnlock()
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    sockjs.WebSocketReadBufSize,
+		WriteBufferSize:   sockjs.WebSocketWriteBufSize,
+		EnableCompression: compression,
+		// Origin not checked and handshake errors handled below.
+		CheckOrigin: func(r *http.Request) bool { return true },
+		Error:       func(w http.ResponseWriter, r *http.Request, status int, reason error) {},
+	}
+	var countingWriter *wsCountingResponseWriter
+	if compression {
+		countingWriter = &wsCountingResponseWriter{ResponseWriter: w}
+		w = countingWriter
+	}
+
+	ws, err := upgrader.Upgrade(w, r, responseHeader)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, `Can "Upgrade" only to "WebSocket".`, http.StatusBadRequest)
 		return
@@ -250,20 +613,34 @@ func (app *Application) RawWebsocketHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	defer ws.Close()
+	if countingWriter != nil {
+		countingWriter.netConn.startFraming()
+	}
 
-	app.RLock()
-	pingInterval := app.config.PingInterval
-	app.RUnlock()
 	pongWait := pingInterval * 10 / 9 // https://github.com/gorilla/websocket/blob/master/examples/chat/conn.go#L22
 
-	conn := newWSConn(ws, pingInterval)
+	var wsCompressionState *wsCompression
+	if compression {
+		err = ws.SetCompressionLevel(compressionLevel)
+		if err != nil {
+			logger.ERROR.Println(err)
+		}
+		wsCompressionState = &wsCompression{
+			minSize: compressionMinSize,
+			netConn: countingWriter.netConn,
+			metrics: app.metrics,
+		}
+	}
+
+	conn := newWSConn(ws, pingInterval, enc.frameType(), wsCompressionState)
 	defer close(conn.closeCh)
 
-	c, err := newClient(app, conn)
+	c, err := newClient(app, conn, enc)
 	if err != nil {
 		return
 	}
-	logger.INFO.Printf("New raw Websocket session established with uid %s\n", c.uid())
+	c.header = r.Header
+	logger.INFO.Printf("New raw Websocket session established with uid %s (%s)\n", c.uid(), enc.name())
 	defer c.clean()
 
 	ws.SetReadDeadline(time.Now().Add(pongWait))
@@ -371,7 +748,6 @@ func (app *Application) APIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	app.RLock()
-	secret := app.config.Secret
 	insecure := app.config.InsecureAPI
 	app.RUnlock()
 
@@ -388,12 +764,14 @@ func (app *Application) APIHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !insecure {
-		if secret == "" {
+		if len(app.secrets()) == 0 {
 			logger.ERROR.Println("no secret set in config")
 			http.Error(w, "Bad Request", http.StatusBadRequest)
 			return
 		}
-		isValid := auth.CheckApiSign(secret, data, sign)
+		isValid := app.checkSecrets(func(secret string) bool {
+			return auth.CheckApiSign(secret, data, sign)
+		})
 		if !isValid {
 			logger.ERROR.Println("invalid sign")
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
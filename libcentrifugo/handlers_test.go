@@ -2,14 +2,19 @@ package libcentrifugo
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/centrifugal/centrifugo/libcentrifugo/protobuf"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
@@ -42,6 +47,27 @@ func TestMuxWithDebugFlag(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
 
+func TestMuxWithPrometheusFlag(t *testing.T) {
+	app := testApp()
+	opts := DefaultMuxOptions
+	opts.HandlerFlags |= HandlerPrometheus
+	mux := DefaultMux(app, opts)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(t, strings.Contains(string(body), "centrifugo_num_clients 0\n"))
+
+	mux = DefaultMux(app, DefaultMuxOptions)
+	server = httptest.NewServer(mux)
+	defer server.Close()
+	resp, err = http.Get(server.URL + "/metrics")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
 func TestHandlerFlagString(t *testing.T) {
 	var flag HandlerFlag
 	flag |= HandlerAPI
@@ -120,6 +146,66 @@ func TestSockJSHandler(t *testing.T) {
 	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
 }
 
+func TestSockJSHandlerConnectProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Cookie") != "session=abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(ConnectProxyReply{User: "user1"})
+	}))
+	defer proxy.Close()
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = proxy.URL
+	server := httptest.NewServer(DefaultMux(app, DefaultMuxOptions))
+	defer server.Close()
+	header := http.Header{}
+	header.Set("Cookie", "session=abc")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[4:]+"/connection/220/fi0pbfvm/websocket", header)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	_, p, err := conn.ReadMessage()
+	assert.Equal(t, "o", string(p))
+
+	frame, _ := json.Marshal([]string{`{"method":"connect","params":{}}`})
+	err = conn.WriteMessage(websocket.TextMessage, frame)
+	assert.Equal(t, nil, err)
+	_, p, err = conn.ReadMessage()
+	assert.Equal(t, nil, err)
+	var messages []string
+	err = json.Unmarshal(p[1:], &messages)
+	assert.Equal(t, nil, err)
+	var replies []clientResponse
+	err = json.Unmarshal([]byte(messages[0]), &replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "", replies[0].Error)
+	assert.NotEqual(t, "", replies[0].Body.(map[string]interface{})["client"])
+}
+
+func TestSockJSHeaderHandler(t *testing.T) {
+	h := &sockjsHeaderHandler{prefix: "/connection", headers: make(map[string]*sockjsHeader)}
+	assert.Equal(t, "fi0pbfvm", h.sessionID("/connection/220/fi0pbfvm/xhr"))
+	assert.Equal(t, "", h.sessionID("/connection/info"))
+	assert.Equal(t, "", h.sessionID("/connection/iframe.html"))
+	assert.Equal(t, "", h.sessionID("/other/220/fi0pbfvm/xhr"))
+
+	header := http.Header{"Cookie": []string{"session=abc"}}
+	assert.Equal(t, true, h.add("s1", header))
+	assert.Equal(t, false, h.add("s1", http.Header{}))
+	assert.Equal(t, header, h.claim("s1"))
+	// Claimed headers kept until session removed.
+	h.expire("s1")
+	assert.Equal(t, header, h.claim("s1"))
+	h.remove("s1")
+	assert.Equal(t, http.Header(nil), h.claim("s1"))
+
+	h.add("s2", header)
+	h.expire("s2")
+	assert.Equal(t, 0, len(h.headers))
+}
+
 func TestRawWSHandler(t *testing.T) {
 	app := testApp()
 	opts := DefaultMuxOptions
@@ -144,6 +230,43 @@ func TestRawWSHandler(t *testing.T) {
 	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
 }
 
+func TestRawWSHandlerProtobuf(t *testing.T) {
+	app := testApp()
+	mux := DefaultMux(app, DefaultMuxOptions)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	url := "ws" + server.URL[4:]
+	dialer := &websocket.Dialer{Subprotocols: []string{ProtobufSubprotocol}}
+	conn, resp, err := dialer.Dial(url+"/connection/websocket", nil)
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Equal(t, ProtobufSubprotocol, resp.Header.Get("Sec-Websocket-Protocol"))
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	connect := protobuf.NewBuffer(nil)
+	connect.EncodeString(1, "user1")
+	connect.EncodeString(2, timestamp)
+	connect.EncodeString(4, auth.GenerateClientToken("secret", "user1", timestamp, ""))
+	ping := protobuf.NewBuffer(nil)
+	ping.EncodeString(1, "hello")
+	err = conn.WriteMessage(websocket.BinaryMessage, testProtobufCommands(
+		clientCommand{UID: "1", Method: "connect", Params: connect.Bytes()},
+		clientCommand{UID: "2", Method: "ping", Params: ping.Bytes()},
+	))
+	assert.Equal(t, nil, err)
+
+	frameType, data, err := conn.ReadMessage()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	replies := testDecodeProtobufReplies(t, data)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "", replies[0].Error)
+	assert.Equal(t, "ping", replies[1].Method)
+	assert.Equal(t, "2", replies[1].UID)
+	assert.Equal(t, "hello", string(testDecodeProtobufFields(t, replies[1].Body)[1]))
+}
+
 func BenchmarkAPIHandler(b *testing.B) {
 	nChannels := 1
 	nClients := 1000
@@ -237,6 +360,18 @@ func TestAPIHandler(t *testing.T) {
 	app.APIHandler(rec, req)
 	assert.Equal(t, http.StatusOK, rec.Code)
 
+	// request signed with previous secret during rotation
+	app.Lock()
+	app.config.Secret = "new secret"
+	app.config.Secrets = []auth.Secret{{Key: "secret"}}
+	app.Unlock()
+	rec = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", server.URL+"/api/test1", bytes.NewBuffer([]byte(data)))
+	req.Header.Add("X-API-Sign", sign)
+	req.Header.Add("Content-Type", "application/json")
+	app.APIHandler(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
 	// request with unknown method
 	rec = httptest.NewRecorder()
 	values = url.Values{}
@@ -288,3 +423,112 @@ func TestAuthHandler(t *testing.T) {
 	body, _ = ioutil.ReadAll(r.Body)
 	assert.Equal(t, true, strings.Contains(string(body), "token"))
 }
+
+// testRawWSCompressionConn returns authenticated raw websocket connection which
+// asks server to use permessage-deflate compression.
+func testRawWSCompressionConn(t *testing.T, server *httptest.Server) (*websocket.Conn, *http.Response) {
+	dialer := &websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+server.URL[4:]+"/connection/websocket", nil)
+	assert.Equal(t, nil, err)
+	err = conn.WriteJSON(testConnectJWTCmd(auth.ClientClaims{User: "user1"}))
+	assert.Equal(t, nil, err)
+	var replies []clientResponse
+	err = conn.ReadJSON(&replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "connect", replies[0].Method)
+	return conn, resp
+}
+
+func TestRawWSHandlerCompression(t *testing.T) {
+	app := testApp()
+	app.config.WebsocketCompression = true
+	app.config.WebsocketCompressionMinSize = 1024
+	server := httptest.NewServer(DefaultMux(app, DefaultMuxOptions))
+	defer server.Close()
+	conn, resp := testRawWSCompressionConn(t, server)
+	defer conn.Close()
+	assert.True(t, strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
+	// Connect reply is smaller than minimal size so not compressed.
+	assert.Equal(t, int64(0), app.metrics.BytesCompressionSaved.LoadRaw())
+
+	data := strings.Repeat("compressible ", 1000)
+	err := conn.WriteJSON(map[string]interface{}{
+		"method": "ping",
+		"params": PingBody{Data: data},
+	})
+	assert.Equal(t, nil, err)
+	var replies []clientResponse
+	err = conn.ReadJSON(&replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ping", replies[0].Method)
+	assert.Equal(t, data, replies[0].Body.(map[string]interface{})["data"])
+	assert.True(t, app.metrics.BytesCompressionSaved.LoadRaw() > int64(len(data)/2))
+}
+
+func TestWSCountingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	conn := &wsCountingConn{Conn: server}
+
+	// handshake not counted.
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n\r\n"))
+	conn.startFraming()
+
+	// text frame with 5 bytes payload.
+	conn.Write([]byte{0x81, 5, 'h', 'e', 'l', 'l', 'o'})
+	assert.Equal(t, int64(5), conn.written())
+	// ping frames not counted.
+	conn.Write([]byte{0x89, 4, 'p', 'i', 'n', 'g'})
+	assert.Equal(t, int64(5), conn.written())
+	// frame with 16 bit length split over writes.
+	payload := make([]byte, 300)
+	conn.Write([]byte{0x82, 126})
+	conn.Write(append([]byte{0x01, 0x2c}, payload[:100]...))
+	conn.Write(payload[100:])
+	assert.Equal(t, int64(305), conn.written())
+	conn.Write([]byte{0x81, 0})
+	assert.Equal(t, int64(305), conn.written())
+}
+
+func TestRawWSHandlerCompressionDisabled(t *testing.T) {
+	app := testApp()
+	server := httptest.NewServer(DefaultMux(app, DefaultMuxOptions))
+	defer server.Close()
+	conn, resp := testRawWSCompressionConn(t, server)
+	defer conn.Close()
+	assert.Equal(t, "", resp.Header.Get("Sec-Websocket-Extensions"))
+}
+
+func TestRawWSHandlerBroadcastCompression(t *testing.T) {
+	app := testMemoryApp()
+	app.config.WebsocketCompression = true
+	server := httptest.NewServer(DefaultMux(app, DefaultMuxOptions))
+	defer server.Close()
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _ := testRawWSCompressionConn(t, server)
+		defer conn.Close()
+		err := conn.WriteJSON(testSubscribeCmd("test:channel"))
+		assert.Equal(t, nil, err)
+		var replies []clientResponse
+		err = conn.ReadJSON(&replies)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "subscribe", replies[0].Method)
+		conns = append(conns, conn)
+	}
+
+	// Message frame prepared and compressed once for both connections.
+	data := `{"text":"` + strings.Repeat("compressible ", 100) + `"}`
+	err := app.Publish(Channel("test:channel"), []byte(data), "", nil)
+	assert.Equal(t, nil, err)
+	for _, conn := range conns {
+		var msg clientMessageResponse
+		err = conn.ReadJSON(&msg)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "message", msg.Method)
+		assert.Equal(t, data, string(*msg.Body.Data))
+	}
+	assert.True(t, app.metrics.BytesCompressionSaved.LoadRaw() > int64(len(data)))
+}
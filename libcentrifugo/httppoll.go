@@ -0,0 +1,333 @@
+package libcentrifugo
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FZambia/go-logger"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// httpPollTimeout is a maximum time poll request waits for messages.
+	httpPollTimeout = 25 * time.Second
+	// httpPollSessionTimeout is a time long-polling session kept without poll
+	// requests, client closed after it.
+	httpPollSessionTimeout = 10 * time.Second
+	// httpPollBufferSize is a maximum amount of messages waiting for poll request
+	// in long-polling session.
+	httpPollBufferSize = 256
+	// httpPollSessionHeader is a response header with ID of long-polling session
+	// created by request without session parameter.
+	httpPollSessionHeader = "X-Centrifugo-Session"
+)
+
+var (
+	errPollSessionClosed = errors.New("poll session closed")
+	errPollInProgress    = errors.New("poll already in progress")
+)
+
+// pollConn is a struct to fit session interface for unidirectional HTTP
+// long-polling connections. Connection outlives requests: messages kept in
+// bounded buffer until poll request takes them, Send blocks only when buffer
+// is full so messages then stay in client queue and client queue limits apply.
+// Connection closed when there were no poll requests during session timeout,
+// messages left in buffer on close can still be polled until then.
+type pollConn struct {
+	mu             sync.Mutex
+	messages       [][]byte
+	ready          chan struct{}
+	space          chan struct{}
+	polling        bool
+	closed         bool
+	closeCh        chan struct{}
+	finished       bool
+	doneCh         chan struct{}
+	sessionTimeout time.Duration
+	expireTimer    *time.Timer
+}
+
+func newPollConn(sessionTimeout time.Duration) *pollConn {
+	conn := &pollConn{
+		ready:          make(chan struct{}, 1),
+		space:          make(chan struct{}, 1),
+		closeCh:        make(chan struct{}),
+		doneCh:         make(chan struct{}),
+		sessionTimeout: sessionTimeout,
+	}
+	conn.expireTimer = time.AfterFunc(sessionTimeout, conn.expire)
+	return conn
+}
+
+// notify wakes up goroutine waiting on ch if any.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Send puts message into buffer, it only blocks while buffer is full.
+func (conn *pollConn) Send(message []byte) error {
+	for {
+		conn.mu.Lock()
+		if conn.closed {
+			conn.mu.Unlock()
+			return errPollSessionClosed
+		}
+		if len(conn.messages) < httpPollBufferSize {
+			conn.messages = append(conn.messages, message)
+			conn.mu.Unlock()
+			notify(conn.ready)
+			return nil
+		}
+		conn.mu.Unlock()
+		select {
+		case <-conn.space:
+		case <-conn.closeCh:
+		}
+	}
+}
+
+// Close closes connection, client can't be told about close status and reason
+// here – disconnect message already sent to client when required.
+func (conn *pollConn) Close(status uint32, reason string) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.close()
+	return nil
+}
+
+// close must be called with mu held. Session finished at once if there is
+// nothing left to poll.
+func (conn *pollConn) close() {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	close(conn.closeCh)
+	if !conn.polling && len(conn.messages) == 0 {
+		conn.finish()
+	}
+}
+
+// finish must be called with mu held. Session can't be polled after it.
+func (conn *pollConn) finish() {
+	if conn.finished {
+		return
+	}
+	conn.finished = true
+	conn.expireTimer.Stop()
+	close(conn.doneCh)
+}
+
+// expire closes connection and finishes session if poll request did not come
+// in time.
+func (conn *pollConn) expire() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.polling {
+		return
+	}
+	conn.close()
+	conn.finish()
+}
+
+// startPoll marks connection as polled so it does not expire. Only one poll
+// request can wait for messages at a time.
+func (conn *pollConn) startPoll() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.finished {
+		return errPollSessionClosed
+	}
+	if conn.polling {
+		return errPollInProgress
+	}
+	conn.polling = true
+	conn.expireTimer.Stop()
+	return nil
+}
+
+// endPoll starts waiting for next poll request, session of closed connection
+// finished when all messages polled.
+func (conn *pollConn) endPoll() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.polling = false
+	if conn.finished {
+		return
+	}
+	if conn.closed && len(conn.messages) == 0 {
+		conn.finish()
+		return
+	}
+	conn.expireTimer = time.AfterFunc(conn.sessionTimeout, conn.expire)
+}
+
+// poll waits for messages up to timeout. It returns as soon as there are some
+// messages, empty slice returned on timeout, when connection closed or when done
+// closed.
+func (conn *pollConn) poll(timeout time.Duration, done <-chan struct{}) [][]byte {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		conn.mu.Lock()
+		messages := conn.messages
+		conn.messages = nil
+		closed := conn.closed
+		conn.mu.Unlock()
+		if len(messages) > 0 {
+			notify(conn.space)
+			return messages
+		}
+		if closed {
+			return nil
+		}
+		select {
+		case <-conn.ready:
+		case <-conn.closeCh:
+		case <-timer.C:
+			return nil
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// requeue returns messages which were not delivered to poll response back into
+// buffer so next poll request gets them first.
+func (conn *pollConn) requeue(messages [][]byte) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.messages = append(messages, conn.messages...)
+}
+
+// httpPollHandler serves HTTP long-polling connections keeping their sessions
+// between requests.
+type httpPollHandler struct {
+	app            *Application
+	pollTimeout    time.Duration
+	sessionTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*pollConn
+}
+
+// NewHTTPPollHandler returns handler of unidirectional HTTP long-polling
+// connections. Request without session parameter creates new session: connection
+// parameters passed as for streaming connections (see serveStream) and session ID
+// returned in X-Centrifugo-Session response header. Requests with session parameter
+// poll for messages of that session. Poll response contains client responses and
+// messages as newline delimited JSON, it's empty if there were no messages during
+// poll timeout. Not Found status returned when session does not exist anymore so
+// client must create new one.
+func NewHTTPPollHandler(app *Application) http.Handler {
+	return newHTTPPollHandler(app, httpPollTimeout, httpPollSessionTimeout)
+}
+
+func newHTTPPollHandler(app *Application, pollTimeout, sessionTimeout time.Duration) *httpPollHandler {
+	return &httpPollHandler{
+		app:            app,
+		pollTimeout:    pollTimeout,
+		sessionTimeout: sessionTimeout,
+		sessions:       make(map[string]*pollConn),
+	}
+}
+
+func (h *httpPollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var conn *pollConn
+	if sessionID := r.Form.Get("session"); sessionID != "" {
+		h.mu.Lock()
+		conn = h.sessions[sessionID]
+		h.mu.Unlock()
+		if conn == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	} else {
+		commands, err := streamCommands(r.Form)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sessionID, newConn, err := h.connect(r, commands)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		conn = newConn
+		w.Header().Set(httpPollSessionHeader, sessionID)
+	}
+
+	err = conn.startPoll()
+	if err == errPollSessionClosed {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	defer conn.endPoll()
+
+	messages := conn.poll(h.pollTimeout, r.Context().Done())
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, message := range messages {
+		_, err := w.Write(httpStreamFrame(message))
+		if err != nil {
+			// Client can't tell which messages it got, so all of them sent again.
+			logger.ERROR.Println("error writing poll response:", err)
+			conn.requeue(messages)
+			return
+		}
+	}
+}
+
+// connect creates new long-polling session and client which executes commands
+// from connection request. Commands executed in background as replies are only
+// sent to client when polled.
+func (h *httpPollHandler) connect(r *http.Request, commands []byte) (string, *pollConn, error) {
+	conn := newPollConn(h.sessionTimeout)
+	c, err := newClient(h.app, conn, jsonClientEncoding)
+	if err != nil {
+		conn.Close(CloseStatus, "")
+		return "", nil, err
+	}
+	c.header = r.Header
+	sessionID := uuid.NewV4().String()
+	h.mu.Lock()
+	h.sessions[sessionID] = conn
+	h.mu.Unlock()
+	logger.INFO.Printf("New HTTP poll session established with uid %s\n", c.uid())
+
+	go func() {
+		<-conn.closeCh
+		c.clean()
+		<-conn.doneCh
+		h.mu.Lock()
+		delete(h.sessions, sessionID)
+		h.mu.Unlock()
+	}()
+	go func() {
+		err := c.message(commands)
+		if err != nil {
+			conn.Close(CloseStatus, "")
+		}
+	}()
+	return sessionID, conn, nil
+}
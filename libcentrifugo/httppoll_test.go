@@ -0,0 +1,188 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPPollHandler(t *testing.T) {
+	app := testMemoryApp()
+	// Messages published between polls must not time out.
+	app.config.MessageSendTimeout = time.Millisecond
+	opts := DefaultMuxOptions
+	opts.HandlerFlags |= HandlerHTTPPoll
+	server := httptest.NewServer(DefaultMux(app, opts))
+	defer server.Close()
+
+	token, _ := auth.GenerateClientJWT("secret", auth.ClientClaims{User: "user1"})
+	connect, _ := json.Marshal(ConnectClientCommand{Token: token})
+	params := url.Values{}
+	params.Set("connect", string(connect))
+	params.Add("channel", "test:channel")
+	resp, err := http.PostForm(server.URL+"/connection/http_poll", params)
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	session := resp.Header.Get(httpPollSessionHeader)
+	assert.NotEqual(t, "", session)
+
+	var replies []clientResponse
+	err = json.NewDecoder(resp.Body).Decode(&replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "", replies[0].Error)
+	assert.Equal(t, "subscribe", replies[1].Method)
+	assert.Equal(t, "", replies[1].Error)
+
+	err = app.Publish(Channel("test:channel"), []byte(`{"input":"test"}`), "", nil)
+	assert.Equal(t, nil, err)
+	time.Sleep(10 * time.Millisecond)
+	resp, err = http.Get(server.URL + "/connection/http_poll?session=" + session)
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var msg clientMessageResponse
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "message", msg.Method)
+	assert.Equal(t, `{"input":"test"}`, string(*msg.Body.Data))
+}
+
+func TestHTTPPollHandlerTimeout(t *testing.T) {
+	app := testMemoryApp()
+	app.config.Insecure = true
+	h := newHTTPPollHandler(app, 10*time.Millisecond, time.Second)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	session := resp.Header.Get(httpPollSessionHeader)
+
+	resp, err = http.Get(server.URL + "?session=" + session)
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(0), resp.ContentLength)
+}
+
+func TestHTTPPollHandlerSessionExpired(t *testing.T) {
+	app := testMemoryApp()
+	app.config.Insecure = true
+	h := newHTTPPollHandler(app, time.Second, 10*time.Millisecond)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	session := resp.Header.Get(httpPollSessionHeader)
+
+	h.mu.Lock()
+	conn := h.sessions[session]
+	h.mu.Unlock()
+	<-conn.doneCh
+	resp, err = http.Get(server.URL + "?session=" + session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestHTTPPollHandlerConflict(t *testing.T) {
+	app := testMemoryApp()
+	app.config.Insecure = true
+	h := newHTTPPollHandler(app, 10*time.Millisecond, time.Second)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	session := resp.Header.Get(httpPollSessionHeader)
+
+	h.mu.Lock()
+	conn := h.sessions[session]
+	h.mu.Unlock()
+	err = conn.startPoll()
+	assert.Equal(t, nil, err)
+	resp, err = http.Get(server.URL + "?session=" + session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	conn.endPoll()
+}
+
+func TestHTTPPollHandlerBadRequest(t *testing.T) {
+	app := testMemoryApp()
+	server := httptest.NewServer(NewHTTPPollHandler(app))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?connect=" + url.QueryEscape("{"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "?session=unknown")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, _ := http.NewRequest("DELETE", server.URL, nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestPollConn(t *testing.T) {
+	conn := newPollConn(time.Second)
+	// Messages buffered until polled.
+	assert.Equal(t, nil, conn.Send([]byte("1")))
+	assert.Equal(t, nil, conn.Send([]byte("2")))
+	assert.Equal(t, nil, conn.startPoll())
+	messages := conn.poll(time.Second, nil)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2")}, messages)
+
+	// Undelivered messages polled again before new ones.
+	conn.requeue(messages)
+	assert.Equal(t, nil, conn.Send([]byte("3")))
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2"), []byte("3")}, conn.poll(time.Second, nil))
+	conn.endPoll()
+
+	// Messages sent before close can still be polled.
+	assert.Equal(t, nil, conn.Send([]byte("disconnect")))
+	conn.Close(CloseStatus, "")
+	assert.Equal(t, errPollSessionClosed, conn.Send([]byte("4")))
+	assert.Equal(t, nil, conn.startPoll())
+	assert.Equal(t, [][]byte{[]byte("disconnect")}, conn.poll(time.Second, nil))
+	conn.endPoll()
+	<-conn.doneCh
+	assert.Equal(t, errPollSessionClosed, conn.startPoll())
+}
+
+func TestPollConnBufferFull(t *testing.T) {
+	conn := newPollConn(time.Second)
+	for i := 0; i < httpPollBufferSize; i++ {
+		assert.Equal(t, nil, conn.Send([]byte("message")))
+	}
+	sent := make(chan error)
+	go func() {
+		sent <- conn.Send([]byte("last"))
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send must block while buffer is full")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, nil, conn.startPoll())
+	assert.Equal(t, httpPollBufferSize, len(conn.poll(time.Second, nil)))
+	assert.Equal(t, nil, <-sent)
+	assert.Equal(t, [][]byte{[]byte("last")}, conn.poll(time.Second, nil))
+	conn.endPoll()
+	conn.Close(CloseStatus, "")
+}
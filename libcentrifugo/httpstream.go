@@ -0,0 +1,204 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/FZambia/go-logger"
+)
+
+// streamConn is a struct to fit session interface for unidirectional HTTP
+// streaming connections (Server-Sent Events, HTTP streaming). Every message
+// sent written to chunked response as separate frame and flushed.
+type streamConn struct {
+	mu           sync.Mutex
+	w            http.ResponseWriter
+	flusher      http.Flusher
+	frame        func([]byte) []byte
+	pingFrame    []byte
+	batch        bool
+	closed       bool
+	closeCh      chan struct{}
+	pingInterval time.Duration
+	pingTimer    *time.Timer
+}
+
+func newStreamConn(w http.ResponseWriter, flusher http.Flusher, frame func([]byte) []byte, pingFrame []byte, batch bool, pingInterval time.Duration) *streamConn {
+	conn := &streamConn{
+		w:            w,
+		flusher:      flusher,
+		frame:        frame,
+		pingFrame:    pingFrame,
+		batch:        batch,
+		closeCh:      make(chan struct{}),
+		pingInterval: pingInterval,
+	}
+	conn.pingTimer = time.AfterFunc(conn.pingInterval, conn.ping)
+	return conn
+}
+
+// ping writes ping frame so proxies do not close idle connection.
+func (conn *streamConn) ping() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.closed {
+		return
+	}
+	_, err := conn.w.Write(conn.pingFrame)
+	if err != nil {
+		conn.close()
+		return
+	}
+	conn.flusher.Flush()
+	conn.pingTimer = time.AfterFunc(conn.pingInterval, conn.ping)
+}
+
+func (conn *streamConn) Send(message []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.closed {
+		return nil
+	}
+	_, err := conn.w.Write(conn.frame(message))
+	if err != nil {
+		conn.close()
+		return err
+	}
+	conn.flusher.Flush()
+	return nil
+}
+
+func (conn *streamConn) batchMessages() bool {
+	return conn.batch
+}
+
+// Close finishes response, client can't be told about close status and reason
+// here – disconnect message already sent to client when required.
+func (conn *streamConn) Close(status uint32, reason string) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.close()
+	return nil
+}
+
+// close must be called with mu held. No writes to response allowed after it
+// as handler can return at any moment.
+func (conn *streamConn) close() {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	conn.pingTimer.Stop()
+	close(conn.closeCh)
+}
+
+// streamCommands returns commands client asks to execute in streaming connection
+// request: connect command with JSON encoded parameters from connect parameter and
+// subscribe command for every channel parameter.
+func streamCommands(form url.Values) ([]byte, error) {
+	connectParams := form.Get("connect")
+	if connectParams == "" {
+		// Connection can still be authenticated by connect proxy or in insecure mode.
+		connectParams = "{}"
+	}
+	commands := []clientCommand{
+		{
+			Method: "connect",
+			Params: json.RawMessage(connectParams),
+		},
+	}
+	for _, ch := range form["channel"] {
+		params, err := json.Marshal(SubscribeClientCommand{Channel: Channel(ch)})
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, clientCommand{
+			Method: "subscribe",
+			Params: params,
+		})
+	}
+	return json.Marshal(commands)
+}
+
+// serveStream serves unidirectional streaming connection. Connect parameters (JSON
+// object as in connect command) passed in connect URL parameter and channels to
+// subscribe on in channel URL parameters, both can also be given in POST form.
+// Connection handled as if client sent connect and subscribe commands, after that
+// server only pushes messages to client using JSON client protocol. Private channels
+// can't be subscribed on as subscribe command has no sign here, use subscribe proxy
+// instead. Several messages joined into one frame when batching enabled only if
+// batch is true.
+func (app *Application) serveStream(w http.ResponseWriter, r *http.Request, name string, contentType string, frame func([]byte) []byte, pingFrame []byte, batch bool) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	commands, err := streamCommands(r.Form)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	app.RLock()
+	pingInterval := app.config.PingInterval
+	app.RUnlock()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Disable response buffering in Nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn := newStreamConn(w, flusher, frame, pingFrame, batch, pingInterval)
+	defer conn.Close(CloseStatus, "")
+
+	c, err := newClient(app, conn, jsonClientEncoding)
+	if err != nil {
+		return
+	}
+	c.header = r.Header
+	logger.INFO.Printf("New %s session established with uid %s\n", name, c.uid())
+	defer c.clean()
+
+	err = c.message(commands)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-conn.closeCh:
+	case <-r.Context().Done():
+	}
+}
+
+// httpStreamFrame returns newline delimited JSON frame with encoded client
+// response.
+func httpStreamFrame(message []byte) []byte {
+	frame := make([]byte, 0, len(message)+1)
+	frame = append(frame, message...)
+	return append(frame, '\n')
+}
+
+// HTTPStreamHandler called when new client connection comes to HTTP streaming
+// endpoint. Server pushes client responses and messages as newline delimited JSON
+// in chunked response so it can be consumed by any HTTP client (curl for example),
+// empty lines sent periodically to keep connection alive. See serveStream for how
+// connection parameters passed.
+func (app *Application) HTTPStreamHandler(w http.ResponseWriter, r *http.Request) {
+	app.serveStream(w, r, "HTTP stream", "application/x-ndjson", httpStreamFrame, []byte("\n"), true)
+}
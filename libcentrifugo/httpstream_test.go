@@ -0,0 +1,86 @@
+package libcentrifugo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStreamHandler(t *testing.T) {
+	app := testMemoryApp()
+	opts := DefaultMuxOptions
+	opts.HandlerFlags |= HandlerHTTPStream
+	server := httptest.NewServer(DefaultMux(app, opts))
+	defer server.Close()
+
+	token, _ := auth.GenerateClientJWT("secret", auth.ClientClaims{User: "user1"})
+	connect, _ := json.Marshal(ConnectClientCommand{Token: token})
+	params := url.Values{}
+	params.Set("connect", string(connect))
+	params.Add("channel", "test:channel")
+	resp, err := http.Get(server.URL + "/connection/http_stream?" + params.Encode())
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	decoder := json.NewDecoder(resp.Body)
+	var replies []clientResponse
+	err = decoder.Decode(&replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "", replies[0].Error)
+	assert.Equal(t, "subscribe", replies[1].Method)
+	assert.Equal(t, "", replies[1].Error)
+
+	err = app.Publish(Channel("test:channel"), []byte(`{"input":"test"}`), "", nil)
+	assert.Equal(t, nil, err)
+	var msg clientMessageResponse
+	err = decoder.Decode(&msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "message", msg.Method)
+	assert.Equal(t, `{"input":"test"}`, string(*msg.Body.Data))
+}
+
+func TestHTTPStreamHandlerPing(t *testing.T) {
+	app := testMemoryApp()
+	app.config.PingInterval = 10 * time.Millisecond
+	app.config.Insecure = true
+	server := httptest.NewServer(http.HandlerFunc(app.HTTPStreamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, byte('['), line[0])
+	line, err = r.ReadString('\n')
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "\n", line)
+}
+
+func TestHTTPStreamHandlerBadRequest(t *testing.T) {
+	app := testMemoryApp()
+	server := httptest.NewServer(http.HandlerFunc(app.HTTPStreamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?connect=" + url.QueryEscape("{"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, _ := http.NewRequest("DELETE", server.URL, nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
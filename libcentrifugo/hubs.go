@@ -182,13 +182,41 @@ func (h *clientHub) broadcast(chID ChannelID, message []byte) error {
 		return nil
 	}
 
+	// message converted for connections which use encoding other than JSON,
+	// converted once per encoding on first such connection. Websocket frames
+	// prepared once per encoding too and shared between connections.
+	var encoded map[clientEncoding]*broadcastMessage
+
 	// iterate over them and send message individually
 	for uid := range channelSubscriptions {
 		c, ok := h.conns[uid]
 		if !ok {
 			continue
 		}
-		err := c.send(message)
+		enc := c.encoding()
+		if encoded == nil {
+			encoded = make(map[clientEncoding]*broadcastMessage)
+		}
+		msg, ok := encoded[enc]
+		if !ok {
+			data := message
+			if enc != jsonClientEncoding {
+				var err error
+				data, err = enc.encodeBroadcast(message)
+				if err != nil {
+					logger.ERROR.Println(err)
+					continue
+				}
+			}
+			msg = &broadcastMessage{data: data, frameType: enc.frameType()}
+			encoded[enc] = msg
+		}
+		var err error
+		if pc, ok := c.(preparedConn); ok {
+			err = pc.sendPrepared(msg)
+		} else {
+			err = c.send(msg.data)
+		}
 		if err != nil {
 			logger.ERROR.Println(err)
 		}
@@ -196,6 +224,29 @@ func (h *clientHub) broadcast(chID ChannelID, message []byte) error {
 	return nil
 }
 
+// broadcastMessage is a message encoded for connections using the same encoding.
+type broadcastMessage struct {
+	data      []byte
+	frameType int
+	prepared  preparedFrame
+}
+
+// preparedMessage returns websocket frame of message, built on first call so
+// only when message broadcast to websocket connections. Compressed frames built
+// on first send to connection with compression negotiated.
+// Not safe for concurrent use, it's called from broadcast loop only.
+func (m *broadcastMessage) preparedMessage() preparedFrame {
+	if m.prepared == nil {
+		prepared, err := newWSPreparedFrame(m.frameType, m.data)
+		if err != nil {
+			logger.ERROR.Println(err)
+			return nil
+		}
+		m.prepared = prepared
+	}
+	return m.prepared
+}
+
 // nClients returns total number of client connections.
 func (h *clientHub) nClients() int {
 	h.RLock()
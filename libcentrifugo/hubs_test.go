@@ -1,10 +1,17 @@
 package libcentrifugo
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -12,6 +19,7 @@ type testClientConn struct {
 	CID      ConnID
 	UID      UserID
 	Channels []Channel
+	Encoding clientEncoding
 
 	Messages [][]byte
 	Closed   bool
@@ -37,11 +45,23 @@ func (c *testClientConn) channels() []Channel {
 	return c.Channels
 }
 
+func (c *testClientConn) encoding() clientEncoding {
+	if c.Encoding == nil {
+		return jsonClientEncoding
+	}
+	return c.Encoding
+}
+
 func (c *testClientConn) send(message []byte) error {
 	c.Messages = append(c.Messages, message)
 	return nil
 }
 
+func (c *testClientConn) subscribe(channel Channel) error {
+	c.Channels = append(c.Channels, channel)
+	return nil
+}
+
 func (c *testClientConn) unsubscribe(channel Channel) error {
 	for i, ch := range c.Channels {
 		if ch == channel {
@@ -115,6 +135,63 @@ func TestSubHub(t *testing.T) {
 	assert.False(t, h.hasSubscribers(ChannelID("test2")))
 }
 
+func TestSubHubBroadcastEncoding(t *testing.T) {
+	h := newClientHub()
+	c1 := newTestUserCC()
+	c2 := newTestUserCC()
+	c2.CID = "test uid 2"
+	c2.Encoding = protobufClientEncoding
+	h.addSub("test", c1)
+	h.addSub("test", c2)
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("test"), []byte(`{}`), "", nil)
+	message, _ := json.Marshal(resp)
+	err := h.broadcast("test", message)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, [][]byte{message}, c1.Messages)
+	assert.Equal(t, 1, len(c2.Messages))
+	assert.Equal(t, "message", testDecodeProtobufReplies(t, c2.Messages[0])[0].Method)
+}
+
+// testPreparedConn records broadcast messages it was asked to send.
+type testPreparedConn struct {
+	*testClientConn
+	Prepared []*broadcastMessage
+}
+
+func (c *testPreparedConn) sendPrepared(msg *broadcastMessage) error {
+	c.Prepared = append(c.Prepared, msg)
+	return c.send(msg.data)
+}
+
+func TestSubHubBroadcastPrepared(t *testing.T) {
+	h := newClientHub()
+	c1 := &testPreparedConn{testClientConn: newTestUserCC()}
+	c2 := &testPreparedConn{testClientConn: newTestUserCC()}
+	c2.CID = "test uid 2"
+	c3 := &testPreparedConn{testClientConn: newTestUserCC()}
+	c3.CID = "test uid 3"
+	c3.Encoding = protobufClientEncoding
+	h.addSub("test", c1)
+	h.addSub("test", c2)
+	h.addSub("test", c3)
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("test"), []byte(`{}`), "", nil)
+	message, _ := json.Marshal(resp)
+	err := h.broadcast("test", message)
+	assert.Equal(t, nil, err)
+
+	// Connections using the same encoding share prepared frame.
+	assert.Equal(t, 1, len(c1.Prepared))
+	assert.Equal(t, [][]byte{message}, c1.Messages)
+	prepared := c1.Prepared[0].preparedMessage()
+	assert.NotNil(t, prepared)
+	assert.True(t, prepared == c2.Prepared[0].preparedMessage())
+	assert.Equal(t, websocket.TextMessage, c1.Prepared[0].frameType)
+	assert.Equal(t, websocket.BinaryMessage, c3.Prepared[0].frameType)
+	assert.False(t, prepared == c3.Prepared[0].preparedMessage())
+}
+
 func TestAdminHub(t *testing.T) {
 	h := newAdminHub()
 	c := newTestUserCC()
@@ -169,3 +246,119 @@ func BenchmarkSubHubBroadCast(b *testing.B) {
 		b.Logf("%d messages/sec", total*int(time.Second)/int(dur))
 	}
 }
+
+// testDiscardConn is a net.Conn which discards everything written into it.
+type testDiscardConn struct{}
+
+func (c testDiscardConn) Read(b []byte) (int, error)         { return 0, errors.New("not readable") }
+func (c testDiscardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c testDiscardConn) Close() error                       { return nil }
+func (c testDiscardConn) LocalAddr() net.Addr                { return nil }
+func (c testDiscardConn) RemoteAddr() net.Addr               { return nil }
+func (c testDiscardConn) SetDeadline(t time.Time) error      { return nil }
+func (c testDiscardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c testDiscardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testHijackWriter is a http.ResponseWriter websocket upgrader can hijack
+// testDiscardConn from.
+type testHijackWriter struct {
+	header http.Header
+}
+
+func (w *testHijackWriter) Header() http.Header         { return w.header }
+func (w *testHijackWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testHijackWriter) WriteHeader(int)             {}
+
+func (w *testHijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn := testDiscardConn{}
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+// testDiscardWSConn returns websocket connection writing frames into nowhere,
+// with permessage-deflate negotiated if compression is true.
+func testDiscardWSConn(b *testing.B, compression bool) *wsConn {
+	r, _ := http.NewRequest("GET", "/connection/websocket", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-Websocket-Version", "13")
+	r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if compression {
+		r.Header.Set("Sec-Websocket-Extensions", "permessage-deflate")
+	}
+	w := &wsCountingResponseWriter{ResponseWriter: &testHijackWriter{header: http.Header{}}}
+	upgrader := websocket.Upgrader{EnableCompression: compression}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var wsCompressionState *wsCompression
+	if compression {
+		wsCompressionState = &wsCompression{netConn: w.netConn, metrics: newMetricsRegistry()}
+	}
+	return newWSConn(ws, time.Hour, websocket.TextMessage, wsCompressionState)
+}
+
+// testWSClientConn sends messages into websocket connection synchronously.
+type testWSClientConn struct {
+	*testClientConn
+	ws *wsConn
+}
+
+func (c *testWSClientConn) send(message []byte) error {
+	return c.ws.Send(message)
+}
+
+// testPreparedWSClientConn sends prepared websocket frames of broadcast messages.
+type testPreparedWSClientConn struct {
+	*testWSClientConn
+}
+
+func (c *testPreparedWSClientConn) sendPrepared(msg *broadcastMessage) error {
+	return c.ws.SendPrepared(msg.data, msg.preparedMessage())
+}
+
+func benchmarkSubHubBroadcastWebsocket(b *testing.B, prepared bool, compression bool) {
+	h := newClientHub()
+	for i := 0; i < 1000; i++ {
+		cc := newTestUserCC()
+		cc.CID = ConnID(fmt.Sprintf("cid-%d", i))
+		ws := testDiscardWSConn(b, compression)
+		defer close(ws.closeCh)
+		c := &testWSClientConn{testClientConn: cc, ws: ws}
+		if prepared {
+			h.addSub("test", &testPreparedWSClientConn{c})
+		} else {
+			h.addSub("test", c)
+		}
+	}
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("test"), []byte(`{"text":"`+strings.Repeat("hello world ", 80)+`"}`), "", nil)
+	message, _ := json.Marshal(resp)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := h.broadcast("test", message)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Broadcast of 1KB message into channel with 1000 websocket subscribers. Prepared
+// frames build message frame (and compress it) once for all subscribers.
+func BenchmarkSubHubBroadcastWebsocket(b *testing.B) {
+	benchmarkSubHubBroadcastWebsocket(b, false, false)
+}
+
+func BenchmarkSubHubBroadcastWebsocketPrepared(b *testing.B) {
+	benchmarkSubHubBroadcastWebsocket(b, true, false)
+}
+
+func BenchmarkSubHubBroadcastWebsocketCompression(b *testing.B) {
+	benchmarkSubHubBroadcastWebsocket(b, false, true)
+}
+
+func BenchmarkSubHubBroadcastWebsocketPreparedCompression(b *testing.B) {
+	benchmarkSubHubBroadcastWebsocket(b, true, true)
+}
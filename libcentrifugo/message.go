@@ -16,16 +16,59 @@ type Message struct {
 	Channel   Channel          `json:"channel"`
 	Data      *json.RawMessage `json:"data"`
 	Client    ConnID           `json:"client,omitempty"`
+	// Binary is data which is not valid JSON, Protocol Buffers clients can
+	// publish any bytes. Data is nil then and JSON clients get Binary base64
+	// encoded.
+	Binary []byte `json:"binary,omitempty"`
+	// Seq is a sequence number of message in channel history. It increases
+	// monotonically with every message saved into history and allows to page
+	// through history. Messages not saved into history have no sequence number.
+	Seq uint64 `json:"seq,omitempty"`
+	// Epoch is generated by engine every time channel history created from
+	// scratch (for example after history expired). Sequence numbers can only be
+	// compared within the same epoch.
+	Epoch string `json:"epoch,omitempty"`
 }
 
 func newMessage(ch Channel, data []byte, client ConnID, info *ClientInfo) Message {
-	raw := json.RawMessage(data)
-	return Message{
+	msg := Message{
 		UID:       MessageID(nuid.Next()),
 		Timestamp: strconv.FormatInt(time.Now().Unix(), 10),
 		Info:      info,
 		Channel:   ch,
-		Data:      &raw,
 		Client:    client,
 	}
+	if json.Valid(data) {
+		raw := json.RawMessage(data)
+		msg.Data = &raw
+	} else {
+		msg.Binary = data
+	}
+	return msg
+}
+
+// encodeClientMessage returns JSON encoded client message response with message
+// as body.
+func encodeClientMessage(message Message) ([]byte, error) {
+	resp := newClientMessage()
+	resp.Body = message
+	return json.Marshal(resp)
+}
+
+// messageWithSeq sets sequence number and epoch into JSON encoded client message
+// response. Used when sequence number assigned after message was encoded.
+func messageWithSeq(data []byte, seq uint64, epoch string) ([]byte, error) {
+	var resp clientMessageResponse
+	err := json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Seq = seq
+	resp.Body.Epoch = epoch
+	return json.Marshal(resp)
+}
+
+// newEpoch generates new channel history epoch.
+func newEpoch() string {
+	return nuid.Next()
 }
@@ -20,6 +20,44 @@ func TestMessage(t *testing.T) {
 	assert.Equal(t, true, strings.Contains(string(msgBytes), "\"uid\":"))
 }
 
+func TestMessageBinary(t *testing.T) {
+	msg := newMessage(Channel("test"), []byte{0xff, 0x00}, "", nil)
+	assert.Equal(t, (*json.RawMessage)(nil), msg.Data)
+	assert.Equal(t, []byte{0xff, 0x00}, msg.Binary)
+	msgBytes, err := json.Marshal(msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, strings.Contains(string(msgBytes), "\"data\":null"))
+	assert.Equal(t, true, strings.Contains(string(msgBytes), "\"binary\":\"/wA=\""))
+}
+
+func TestMessageWithSeq(t *testing.T) {
+	resp := newClientMessage()
+	resp.Body = newMessage(Channel("test"), []byte(`{"input":"test"}`), "client", nil)
+	msgBytes, err := json.Marshal(resp)
+	assert.Equal(t, nil, err)
+
+	data, err := messageWithSeq(msgBytes, 42, "epoch")
+	assert.Equal(t, nil, err)
+	var decoded clientMessageResponse
+	err = json.Unmarshal(data, &decoded)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint64(42), decoded.Body.Seq)
+	assert.Equal(t, "epoch", decoded.Body.Epoch)
+	assert.Equal(t, resp.Body.UID, decoded.Body.UID)
+	assert.Equal(t, ConnID("client"), decoded.Body.Client)
+
+	resp.Body.Seq = 42
+	resp.Body.Epoch = "epoch"
+	expected, _ := json.Marshal(resp)
+	assert.Equal(t, string(expected), string(data))
+	encoded, err := encodeClientMessage(resp.Body)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, string(expected), string(encoded))
+
+	_, err = messageWithSeq([]byte("broken"), 42, "epoch")
+	assert.NotEqual(t, nil, err)
+}
+
 func BenchmarkMsgMarshal(b *testing.B) {
 	msg := newMessage(Channel("test"), []byte("{}"), "", nil)
 	b.ResetTimer()
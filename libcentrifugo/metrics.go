@@ -3,6 +3,7 @@ package libcentrifugo
 import (
 	"bytes"
 	"errors"
+	"math"
 	"os"
 	"os/exec"
 	"runtime"
@@ -10,6 +11,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/FZambia/go-logger"
 )
@@ -38,16 +40,25 @@ type Metrics struct {
 	// BytesClientOut shows amount of data in bytes coming out if client API.
 	BytesClientOut int64 `json:"bytes_client_out"`
 
-	// TimeAPIMean shows mean response time in nanoseconds to API requests. DEPRECATED!
+	// BytesCompressionSaved shows amount of data in bytes websocket compression
+	// saved when sending messages to clients: difference between message size and
+	// size of its compressed payload, frame headers not included.
+	BytesCompressionSaved int64 `json:"bytes_compression_saved"`
+
+	// TimeAPIMean shows mean response time in nanoseconds to API requests over
+	// last metrics interval. DEPRECATED! Use TimeAPI.
 	TimeAPIMean int64 `json:"time_api_mean"`
 
-	// TimeClientMean shows mean response time in nanoseconds to client requests. DEPRECATED!
+	// TimeClientMean shows mean response time in nanoseconds to client requests over
+	// last metrics interval. DEPRECATED! Use TimeClient.
 	TimeClientMean int64 `json:"time_client_mean"`
 
-	// TimeAPIMax shows maximum response time to API request. DEPRECATED!
+	// TimeAPIMax shows maximum response time to API request over last metrics
+	// interval. DEPRECATED! Use TimeAPI.
 	TimeAPIMax int64 `json:"time_api_max"`
 
-	// TimeClientMax shows maximum response time to client request. DEPRECATED!
+	// TimeClientMax shows maximum response time to client request over last
+	// metrics interval. DEPRECATED! Use TimeClient.
 	TimeClientMax int64 `json:"time_client_max"`
 
 	// MemSys shows system memory usage in bytes.
@@ -55,6 +66,24 @@ type Metrics struct {
 
 	// CPU shows cpu usage in percents.
 	CPU int64 `json:"cpu_usage"`
+
+	// TimeClient shows processing time of client commands by method over last
+	// metrics interval. Methods without commands in interval omitted.
+	TimeClient map[string]TimeQuantiles `json:"time_client,omitempty"`
+
+	// TimeAPI shows processing time of API commands by method over last
+	// metrics interval. Methods without commands in interval omitted.
+	TimeAPI map[string]TimeQuantiles `json:"time_api,omitempty"`
+}
+
+// TimeQuantiles describes distribution of command processing time, all
+// times are in microseconds.
+type TimeQuantiles struct {
+	Count int64 `json:"count"`
+	P50   int64 `json:"p50"`
+	P90   int64 `json:"p90"`
+	P99   int64 `json:"p99"`
+	Max   int64 `json:"max"`
 }
 
 // metricsRegistry contains various Centrifugo statistic and metric information aggregated
@@ -68,24 +97,250 @@ type Metrics struct {
 // Add any new members to the END of this struct unless they can guarantee 64 bit alignment
 // (i.e. (u)int64 or 2 x (u)int32 etc.)
 type metricsRegistry struct {
-	NumMsgPublished   metricCounter
-	NumMsgQueued      metricCounter
-	NumMsgSent        metricCounter
-	NumAPIRequests    metricCounter
-	NumClientRequests metricCounter
-	BytesClientIn     metricCounter
-	BytesClientOut    metricCounter
-	TimeAPIMean       int64 // Deprecated
-	TimeClientMean    int64 // Deprecated
-	TimeAPIMax        int64 // Deprecated
-	TimeClientMax     int64 // Deprecated
-	MemSys            int64
-	CPU               int64
+	NumMsgPublished       metricCounter
+	NumMsgQueued          metricCounter
+	NumMsgSent            metricCounter
+	NumAPIRequests        metricCounter
+	NumClientRequests     metricCounter
+	BytesClientIn         metricCounter
+	BytesClientOut        metricCounter
+	BytesCompressionSaved metricCounter
+	MemSys                int64
+	CPU                   int64
 
 	// mu protects from multiple processes updating snapshot values at once
 	// but raw counters may still increment atomically while held so it's not a strict
 	// point-in-time snapshot of all values.
 	mu sync.Mutex
+
+	// ClientCommandTimes keeps processing time of client commands by method.
+	ClientCommandTimes metricHistogramVec
+	// APICommandTimes keeps processing time of API commands by method.
+	APICommandTimes metricHistogramVec
+}
+
+// clientMethods are client protocol methods we collect processing time for.
+var clientMethods = []string{
+	"connect", "refresh", "subscribe", "unsubscribe", "publish", "ping", "presence", "history",
+}
+
+// apiMethods are server API methods we collect processing time for.
+var apiMethods = []string{
+	"publish", "broadcast", "subscribe", "unsubscribe", "disconnect", "presence", "history",
+	"channels", "stats", "node",
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		ClientCommandTimes: newMetricHistogramVec(clientMethods),
+		APICommandTimes:    newMetricHistogramVec(apiMethods),
+	}
+}
+
+// latencyBuckets are upper bounds of histogram buckets in seconds.
+var latencyBuckets = [...]float64{
+	0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+const (
+	// hdrSubBuckets is a number of linear sub-buckets in every power of two range
+	// of values, this gives about 3% precision of recorded values.
+	hdrSubBuckets = 32
+	// hdrMaxValue is the largest time in microseconds (about 67 seconds) recorded
+	// precisely, larger values are recorded into the last bucket.
+	hdrMaxValue = 1<<26 - 1
+	// hdrBuckets is enough to keep values up to hdrMaxValue – 32 linear buckets for
+	// values below 32 plus 32 sub-buckets for each power of two from 2^5 to 2^25.
+	hdrBuckets = 22 * hdrSubBuckets
+)
+
+// hdrIndex returns index of HDR bucket for value.
+func hdrIndex(v int64) int {
+	if v < 0 {
+		v = 0
+	}
+	if v > hdrMaxValue {
+		v = hdrMaxValue
+	}
+	if v < hdrSubBuckets {
+		return int(v)
+	}
+	exp := 0
+	for v >= 2*hdrSubBuckets {
+		v >>= 1
+		exp++
+	}
+	return (exp+1)*hdrSubBuckets + int(v) - hdrSubBuckets
+}
+
+// hdrValue returns the largest value recorded into HDR bucket with index i.
+func hdrValue(i int) int64 {
+	if i < hdrSubBuckets {
+		return int64(i)
+	}
+	exp := uint(i/hdrSubBuckets - 1)
+	sub := int64(i%hdrSubBuckets + hdrSubBuckets)
+	return (sub+1)<<exp - 1
+}
+
+// metricHistogram counts observed durations in fixed latencyBuckets to export them
+// in Prometheus format and in HDR buckets to calculate quantiles over last metrics
+// interval. Bucket counts are not cumulative, count and sum (in nanoseconds) are
+// kept separately. Counters are operated atomically so histogram must be allocated
+// separately to keep 64 bit alignment.
+type metricHistogram struct {
+	count   int64
+	sum     int64
+	max     int64 // in microseconds, reset every metrics interval.
+	buckets [len(latencyBuckets)]int64
+	hdr     [hdrBuckets]int64
+
+	// Fields below only used under metricsRegistry mutex.
+	lastHdr       [hdrBuckets]int64
+	lastCount     int64
+	lastSum       int64
+	intervalCount int64
+	intervalSum   int64
+	quantiles     TimeQuantiles
+}
+
+// Observe adds duration into histogram.
+func (h *metricHistogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			atomic.AddInt64(&h.buckets[i], 1)
+			break
+		}
+	}
+	us := int64(d / time.Microsecond)
+	atomic.AddInt64(&h.hdr[hdrIndex(us)], 1)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if us <= max || atomic.CompareAndSwapInt64(&h.max, max, us) {
+			break
+		}
+	}
+	atomic.AddInt64(&h.sum, int64(d))
+	atomic.AddInt64(&h.count, 1)
+}
+
+// updateQuantiles calculates quantiles of values observed since previous call.
+func (h *metricHistogram) updateQuantiles() {
+	var counts [hdrBuckets]int64
+	var total int64
+	for i := range h.hdr {
+		now := atomic.LoadInt64(&h.hdr[i])
+		counts[i] = now - h.lastHdr[i]
+		h.lastHdr[i] = now
+		total += counts[i]
+	}
+	count := atomic.LoadInt64(&h.count)
+	sum := atomic.LoadInt64(&h.sum)
+	h.intervalCount, h.intervalSum = count-h.lastCount, sum-h.lastSum
+	h.lastCount, h.lastSum = count, sum
+	max := atomic.SwapInt64(&h.max, 0)
+	h.quantiles = TimeQuantiles{
+		Count: total,
+		P50:   hdrQuantile(&counts, total, 0.5, max),
+		P90:   hdrQuantile(&counts, total, 0.9, max),
+		P99:   hdrQuantile(&counts, total, 0.99, max),
+		Max:   max,
+	}
+}
+
+// hdrQuantile returns value at quantile q from HDR bucket counts. Bucket values
+// are upper bounds so result limited by max value observed.
+func hdrQuantile(counts *[hdrBuckets]int64, total int64, q float64, max int64) int64 {
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	var seen int64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank {
+			v := hdrValue(i)
+			if max > 0 && v > max {
+				v = max
+			}
+			return v
+		}
+	}
+	return max
+}
+
+// metricHistogramVec is a set of histograms labeled by command method. Set of
+// methods is fixed on creation so histograms for unknown methods sent by clients
+// never created.
+type metricHistogramVec struct {
+	histograms map[string]*metricHistogram
+}
+
+func newMetricHistogramVec(methods []string) metricHistogramVec {
+	histograms := make(map[string]*metricHistogram, len(methods))
+	for _, method := range methods {
+		histograms[method] = &metricHistogram{}
+	}
+	return metricHistogramVec{histograms: histograms}
+}
+
+// ObserveSince adds time passed since started into histogram for method.
+// Observations for unknown methods are ignored.
+func (v metricHistogramVec) ObserveSince(method string, started time.Time) {
+	h, ok := v.histograms[method]
+	if !ok {
+		return
+	}
+	h.Observe(time.Since(started))
+}
+
+func (v metricHistogramVec) updateQuantiles() {
+	for _, h := range v.histograms {
+		h.updateQuantiles()
+	}
+}
+
+// quantiles returns quantiles over last metrics interval for methods which
+// had observations.
+func (v metricHistogramVec) quantiles() map[string]TimeQuantiles {
+	var quantiles map[string]TimeQuantiles
+	for method, h := range v.histograms {
+		if h.quantiles.Count == 0 {
+			continue
+		}
+		if quantiles == nil {
+			quantiles = make(map[string]TimeQuantiles)
+		}
+		quantiles[method] = h.quantiles
+	}
+	return quantiles
+}
+
+// mean returns mean processing time of commands over last metrics interval
+// in nanoseconds.
+func (v metricHistogramVec) mean() int64 {
+	var count, sum int64
+	for _, h := range v.histograms {
+		count += h.intervalCount
+		sum += h.intervalSum
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / count
+}
+
+// max returns maximum processing time of commands over last metrics interval
+// in nanoseconds.
+func (v metricHistogramVec) max() int64 {
+	var max int64
+	for _, h := range v.histograms {
+		if h.quantiles.Max > max {
+			max = h.quantiles.Max
+		}
+	}
+	return max * int64(time.Microsecond)
 }
 
 // metricCounter is a wrapper around a set of int64s that count things.
@@ -161,23 +416,34 @@ func (m *metricsRegistry) UpdateSnapshot() {
 	m.NumClientRequests.updateDelta()
 	m.BytesClientIn.updateDelta()
 	m.BytesClientOut.updateDelta()
+	m.BytesCompressionSaved.updateDelta()
+	m.ClientCommandTimes.updateQuantiles()
+	m.APICommandTimes.updateQuantiles()
 }
 
-// GetRawMetrics returns a read-only copy of the raw counter values.
+// GetRawMetrics returns a read-only copy of the raw counter values. Command
+// times are always calculated over last metrics interval.
 func (m *metricsRegistry) GetRawMetrics() *Metrics {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	return &Metrics{
-		NumMsgPublished:   m.NumMsgPublished.LoadRaw(),
-		NumMsgQueued:      m.NumMsgQueued.LoadRaw(),
-		NumMsgSent:        m.NumMsgSent.LoadRaw(),
-		NumAPIRequests:    m.NumAPIRequests.LoadRaw(),
-		NumClientRequests: m.NumClientRequests.LoadRaw(),
-		BytesClientIn:     m.BytesClientIn.LoadRaw(),
-		BytesClientOut:    m.BytesClientOut.LoadRaw(),
-		MemSys:            atomic.LoadInt64(&m.MemSys),
-		CPU:               atomic.LoadInt64(&m.CPU),
+		NumMsgPublished:       m.NumMsgPublished.LoadRaw(),
+		NumMsgQueued:          m.NumMsgQueued.LoadRaw(),
+		NumMsgSent:            m.NumMsgSent.LoadRaw(),
+		NumAPIRequests:        m.NumAPIRequests.LoadRaw(),
+		NumClientRequests:     m.NumClientRequests.LoadRaw(),
+		BytesClientIn:         m.BytesClientIn.LoadRaw(),
+		BytesClientOut:        m.BytesClientOut.LoadRaw(),
+		BytesCompressionSaved: m.BytesCompressionSaved.LoadRaw(),
+		MemSys:                atomic.LoadInt64(&m.MemSys),
+		CPU:                   atomic.LoadInt64(&m.CPU),
+		TimeAPIMean:           m.APICommandTimes.mean(),
+		TimeClientMean:        m.ClientCommandTimes.mean(),
+		TimeAPIMax:            m.APICommandTimes.max(),
+		TimeClientMax:         m.ClientCommandTimes.max(),
+		TimeClient:            m.ClientCommandTimes.quantiles(),
+		TimeAPI:               m.APICommandTimes.quantiles(),
 	}
 }
 
@@ -188,15 +454,22 @@ func (m *metricsRegistry) GetSnapshotMetrics() *Metrics {
 	defer m.mu.Unlock()
 
 	return &Metrics{
-		NumMsgPublished:   m.NumMsgPublished.LastIn(),
-		NumMsgQueued:      m.NumMsgQueued.LastIn(),
-		NumMsgSent:        m.NumMsgSent.LastIn(),
-		NumAPIRequests:    m.NumAPIRequests.LastIn(),
-		NumClientRequests: m.NumClientRequests.LastIn(),
-		BytesClientIn:     m.BytesClientIn.LastIn(),
-		BytesClientOut:    m.BytesClientOut.LastIn(),
-		MemSys:            atomic.LoadInt64(&m.MemSys),
-		CPU:               atomic.LoadInt64(&m.CPU),
+		NumMsgPublished:       m.NumMsgPublished.LastIn(),
+		NumMsgQueued:          m.NumMsgQueued.LastIn(),
+		NumMsgSent:            m.NumMsgSent.LastIn(),
+		NumAPIRequests:        m.NumAPIRequests.LastIn(),
+		NumClientRequests:     m.NumClientRequests.LastIn(),
+		BytesClientIn:         m.BytesClientIn.LastIn(),
+		BytesClientOut:        m.BytesClientOut.LastIn(),
+		BytesCompressionSaved: m.BytesCompressionSaved.LastIn(),
+		MemSys:                atomic.LoadInt64(&m.MemSys),
+		CPU:                   atomic.LoadInt64(&m.CPU),
+		TimeAPIMean:           m.APICommandTimes.mean(),
+		TimeClientMean:        m.ClientCommandTimes.mean(),
+		TimeAPIMax:            m.APICommandTimes.max(),
+		TimeClientMax:         m.ClientCommandTimes.max(),
+		TimeClient:            m.ClientCommandTimes.quantiles(),
+		TimeAPI:               m.APICommandTimes.quantiles(),
 	}
 }
 
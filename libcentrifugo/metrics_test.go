@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -83,6 +85,7 @@ func TestJSONMarshal(t *testing.T) {
 		`"num_client_requests":42,`+
 		`"bytes_client_in":42,`+
 		`"bytes_client_out":42,`+
+		`"bytes_compression_saved":0,`+
 		// Timers are deprecated but still in output to avoid breaking assumptions
 		`"time_api_mean":0,`+
 		`"time_client_mean":0,`+
@@ -123,6 +126,7 @@ func TestJSONMarshal(t *testing.T) {
 		`"num_client_requests":84,`+
 		`"bytes_client_in":84,`+
 		`"bytes_client_out":42,`+
+		`"bytes_compression_saved":0,`+
 		// Timers are deprecated but still in output to avoid breaking assumptions
 		`"time_api_mean":0,`+
 		`"time_client_mean":0,`+
@@ -151,6 +155,7 @@ func TestJSONMarshal(t *testing.T) {
 		`"num_client_requests":42,`+
 		`"bytes_client_in":42,`+
 		`"bytes_client_out":0,`+
+		`"bytes_compression_saved":0,`+
 		// Timers are deprecated but still in output to avoid breaking assumptions
 		`"time_api_mean":0,`+
 		`"time_client_mean":0,`+
@@ -177,6 +182,7 @@ func TestJSONMarshal(t *testing.T) {
 		`"num_client_requests":84,`+
 		`"bytes_client_in":84,`+
 		`"bytes_client_out":42,`+
+		`"bytes_compression_saved":0,`+
 		// Timers are deprecated but still in output to avoid breaking assumptions
 		`"time_api_mean":0,`+
 		`"time_client_mean":0,`+
@@ -241,3 +247,89 @@ func BenchmarkAtomicCounterWithPad(b *testing.B) {
 	}
 	wg.Wait()
 }
+
+func TestMetricHistogramVec(t *testing.T) {
+	vec := newMetricHistogramVec([]string{"publish"})
+	vec.ObserveSince("publish", time.Now())
+	vec.ObserveSince("unknown", time.Now())
+	h := vec.histograms["publish"]
+	assert.Equal(t, int64(1), h.count)
+	_, ok := vec.histograms["unknown"]
+	assert.False(t, ok)
+
+	h.Observe(20 * time.Second)
+	assert.Equal(t, int64(2), h.count)
+	var inBuckets int64
+	for _, n := range h.buckets {
+		inBuckets += n
+	}
+	// Observation over the largest bucket bound only counted in +Inf bucket.
+	assert.Equal(t, int64(1), inBuckets)
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	app := testApp()
+	app.metrics.NumMsgPublished.Add(42)
+	app.metrics.APICommandTimes.histograms["publish"].Observe(3 * time.Millisecond)
+
+	var buf bytes.Buffer
+	app.writePrometheusMetrics(&buf)
+	out := buf.String()
+	assert.True(t, strings.Contains(out, "# TYPE centrifugo_num_msg_published_total counter\ncentrifugo_num_msg_published_total 42\n"))
+	assert.True(t, strings.Contains(out, `centrifugo_api_command_duration_seconds_bucket{method="publish",le="0.0025"} 0`+"\n"))
+	assert.True(t, strings.Contains(out, `centrifugo_api_command_duration_seconds_bucket{method="publish",le="0.005"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `centrifugo_api_command_duration_seconds_bucket{method="publish",le="+Inf"} 1`+"\n"))
+	assert.True(t, strings.Contains(out, `centrifugo_api_command_duration_seconds_sum{method="publish"} 0.003`+"\n"))
+	assert.True(t, strings.Contains(out, `centrifugo_client_command_duration_seconds_count{method="connect"} 0`+"\n"))
+}
+
+func TestHDRBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 31, 32, 33, 63, 64, 65, 1000, 123456, hdrMaxValue} {
+		i := hdrIndex(v)
+		assert.True(t, i < hdrBuckets)
+		upper := hdrValue(i)
+		assert.True(t, upper >= v)
+		// Values recorded with about 3% precision.
+		assert.True(t, float64(upper-v) <= float64(v)/hdrSubBuckets)
+		if i > 0 {
+			assert.True(t, hdrValue(i-1) < v)
+		}
+	}
+	assert.Equal(t, hdrBuckets-1, hdrIndex(hdrMaxValue))
+	assert.Equal(t, hdrBuckets-1, hdrIndex(hdrMaxValue*10))
+	assert.Equal(t, 0, hdrIndex(-1))
+}
+
+func TestTimeQuantiles(t *testing.T) {
+	m := newMetricsRegistry()
+	h := m.ClientCommandTimes.histograms["publish"]
+	for i := 1; i <= 100; i++ {
+		h.Observe(time.Duration(i) * time.Millisecond)
+	}
+	m.UpdateSnapshot()
+
+	q := m.GetSnapshotMetrics().TimeClient["publish"]
+	assert.Equal(t, int64(100), q.Count)
+	assert.Equal(t, int64(100000), q.Max)
+	assert.True(t, q.P50 >= 50000 && q.P50 <= 51600)
+	assert.True(t, q.P90 >= 90000 && q.P90 <= 92900)
+	assert.True(t, q.P99 >= 99000 && q.P99 <= 100000)
+	assert.Equal(t, 1, len(m.GetRawMetrics().TimeClient))
+	assert.Equal(t, 0, len(m.GetRawMetrics().TimeAPI))
+	// Deprecated timers filled from the same interval.
+	assert.Equal(t, int64(50500*time.Microsecond), m.GetSnapshotMetrics().TimeClientMean)
+	assert.Equal(t, int64(100*time.Millisecond), m.GetSnapshotMetrics().TimeClientMax)
+	assert.Equal(t, int64(0), m.GetSnapshotMetrics().TimeAPIMean)
+
+	// Next interval only contains new observations.
+	h.Observe(time.Millisecond)
+	m.UpdateSnapshot()
+	q = m.GetSnapshotMetrics().TimeClient["publish"]
+	assert.Equal(t, int64(1), q.Count)
+	assert.Equal(t, int64(1000), q.Max)
+	assert.Equal(t, int64(1000), q.P50)
+	assert.Equal(t, int64(time.Millisecond), m.GetSnapshotMetrics().TimeClientMean)
+
+	m.UpdateSnapshot()
+	assert.Equal(t, 0, len(m.GetSnapshotMetrics().TimeClient))
+}
@@ -0,0 +1,82 @@
+package libcentrifugo
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const prometheusNamespace = "centrifugo"
+
+// PrometheusHandler exposes node metrics in Prometheus text exposition format.
+// Counters are raw monotonic values, not deltas over NodeMetricsInterval.
+func (app *Application) PrometheusHandler(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	app.writePrometheusMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (app *Application) writePrometheusMetrics(buf *bytes.Buffer) {
+	m := app.metrics
+	raw := m.GetRawMetrics()
+
+	writePrometheusValue(buf, "num_msg_published_total", "counter", "Number of messages published into channels.", raw.NumMsgPublished)
+	writePrometheusValue(buf, "num_msg_queued_total", "counter", "Number of messages put into client queues.", raw.NumMsgQueued)
+	writePrometheusValue(buf, "num_msg_sent_total", "counter", "Number of messages sent into client connections.", raw.NumMsgSent)
+	writePrometheusValue(buf, "num_api_requests_total", "counter", "Number of requests to server API.", raw.NumAPIRequests)
+	writePrometheusValue(buf, "num_client_requests_total", "counter", "Number of requests to client API.", raw.NumClientRequests)
+	writePrometheusValue(buf, "bytes_client_in_total", "counter", "Amount of data in bytes coming into client API.", raw.BytesClientIn)
+	writePrometheusValue(buf, "bytes_client_out_total", "counter", "Amount of data in bytes coming out of client API.", raw.BytesClientOut)
+	writePrometheusValue(buf, "bytes_compression_saved_total", "counter", "Amount of data in bytes saved by websocket compression.", raw.BytesCompressionSaved)
+
+	writePrometheusValue(buf, "num_clients", "gauge", "Number of clients connected to node.", int64(app.clients.nClients()))
+	writePrometheusValue(buf, "num_unique_clients", "gauge", "Number of unique users connected to node.", int64(app.clients.nUniqueClients()))
+	writePrometheusValue(buf, "num_channels", "gauge", "Number of active channels on node.", int64(app.clients.nChannels()))
+	writePrometheusValue(buf, "memory_sys_bytes", "gauge", "System memory usage in bytes.", raw.MemSys)
+	writePrometheusValue(buf, "cpu_usage", "gauge", "CPU usage in percents.", raw.CPU)
+
+	writePrometheusHistograms(buf, "client_command_duration_seconds", "Client command processing time in seconds.", clientMethods, m.ClientCommandTimes)
+	writePrometheusHistograms(buf, "api_command_duration_seconds", "API command processing time in seconds.", apiMethods, m.APICommandTimes)
+}
+
+func writePrometheusHeader(buf *bytes.Buffer, name string, typ string, help string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writePrometheusValue(buf *bytes.Buffer, name string, typ string, help string, value int64) {
+	name = prometheusNamespace + "_" + name
+	writePrometheusHeader(buf, name, typ, help)
+	buf.WriteString(name + " " + strconv.FormatInt(value, 10) + "\n")
+}
+
+// writePrometheusHistograms writes histogram for each method in order given, methods
+// without histogram in vec skipped.
+func writePrometheusHistograms(buf *bytes.Buffer, name string, help string, methods []string, vec metricHistogramVec) {
+	name = prometheusNamespace + "_" + name
+	writePrometheusHeader(buf, name, "histogram", help)
+	for _, method := range methods {
+		h, ok := vec.histograms[method]
+		if !ok {
+			continue
+		}
+		label := `method="` + method + `"`
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += atomic.LoadInt64(&h.buckets[i])
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			buf.WriteString(name + "_bucket{" + label + `,le="` + le + `"} ` + strconv.FormatInt(cumulative, 10) + "\n")
+		}
+		count := atomic.LoadInt64(&h.count)
+		if count < cumulative {
+			// Observation can be in the middle of update – keep +Inf bucket consistent.
+			count = cumulative
+		}
+		buf.WriteString(name + "_bucket{" + label + `,le="+Inf"} ` + strconv.FormatInt(count, 10) + "\n")
+		sum := float64(atomic.LoadInt64(&h.sum)) / 1e9
+		buf.WriteString(name + "_sum{" + label + "} " + strconv.FormatFloat(sum, 'g', -1, 64) + "\n")
+		buf.WriteString(name + "_count{" + label + "} " + strconv.FormatInt(count, 10) + "\n")
+	}
+}
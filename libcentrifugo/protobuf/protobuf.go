@@ -0,0 +1,274 @@
+// Package protobuf provides minimal Protocol Buffers wire format encoder and decoder
+// used by libcentrifugo package binary client protocol.
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Wire types used in Centrifugo protocol messages.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+var (
+	// ErrTruncated returned when message ends in the middle of field.
+	ErrTruncated = errors.New("protobuf: truncated message")
+	// ErrOverflow returned when varint does not fit into 64 bits.
+	ErrOverflow = errors.New("protobuf: varint overflow")
+	// ErrWireType returned when field has wire type which can not be decoded
+	// into requested value or unknown wire type.
+	ErrWireType = errors.New("protobuf: unexpected wire type")
+)
+
+// Buffer is used to encode message fields. Fields with zero values are not
+// written to follow proto3 semantics.
+type Buffer struct {
+	buf []byte
+}
+
+// NewBuffer returns Buffer which appends encoded fields to buf.
+func NewBuffer(buf []byte) *Buffer {
+	return &Buffer{buf: buf}
+}
+
+// Bytes returns encoded message.
+func (b *Buffer) Bytes() []byte {
+	return b.buf
+}
+
+// Reset resets buffer to be empty but keeps underlying storage for reuse.
+func (b *Buffer) Reset() {
+	b.buf = b.buf[:0]
+}
+
+// EncodeVarint writes raw varint.
+func (b *Buffer) EncodeVarint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	b.buf = append(b.buf, tmp[:n]...)
+}
+
+func (b *Buffer) encodeTag(field int, wireType int) {
+	b.EncodeVarint(uint64(field)<<3 | uint64(wireType))
+}
+
+// EncodeString writes string field.
+func (b *Buffer) EncodeString(field int, s string) {
+	if s == "" {
+		return
+	}
+	b.encodeTag(field, WireBytes)
+	b.EncodeVarint(uint64(len(s)))
+	b.buf = append(b.buf, s...)
+}
+
+// EncodeBytes writes bytes field.
+func (b *Buffer) EncodeBytes(field int, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	b.EncodeMessage(field, data)
+}
+
+// EncodeMessage writes embedded message field. Unlike EncodeBytes it writes
+// field even if message is empty so receiver can distinguish it from unset one.
+func (b *Buffer) EncodeMessage(field int, msg []byte) {
+	b.encodeTag(field, WireBytes)
+	b.EncodeVarint(uint64(len(msg)))
+	b.buf = append(b.buf, msg...)
+}
+
+// EncodeBool writes bool field.
+func (b *Buffer) EncodeBool(field int, v bool) {
+	if !v {
+		return
+	}
+	b.encodeTag(field, WireVarint)
+	b.buf = append(b.buf, 1)
+}
+
+// EncodeInt64 writes int64 field.
+func (b *Buffer) EncodeInt64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	b.encodeTag(field, WireVarint)
+	b.EncodeVarint(uint64(v))
+}
+
+// EncodeDelimited writes message prefixed with its varint encoded length. This
+// allows to put several messages into one stream or frame.
+func (b *Buffer) EncodeDelimited(msg []byte) {
+	b.EncodeVarint(uint64(len(msg)))
+	b.buf = append(b.buf, msg...)
+}
+
+// Decoder iterates over fields of encoded message. Typical usage:
+//
+//	d := protobuf.NewDecoder(data)
+//	for d.Next() {
+//		switch d.Field() {
+//		case 1:
+//			name = d.String()
+//		default:
+//			d.Skip()
+//		}
+//	}
+//	if err := d.Err(); err != nil {
+//		...
+//	}
+type Decoder struct {
+	buf      []byte
+	pos      int
+	field    int
+	wireType int
+	err      error
+}
+
+// NewDecoder returns Decoder reading fields from data.
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{buf: data}
+}
+
+// Next advances decoder to next field and reports whether there is one.
+func (d *Decoder) Next() bool {
+	if d.err != nil || d.pos >= len(d.buf) {
+		return false
+	}
+	tag := d.varint()
+	if d.err != nil {
+		return false
+	}
+	d.field = int(tag >> 3)
+	d.wireType = int(tag & 7)
+	if d.field <= 0 {
+		d.err = ErrWireType
+		return false
+	}
+	return true
+}
+
+// Field returns current field number.
+func (d *Decoder) Field() int {
+	return d.field
+}
+
+// Err returns first error occurred while decoding.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Varint returns current field value as uint64.
+func (d *Decoder) Varint() uint64 {
+	if !d.expect(WireVarint) {
+		return 0
+	}
+	return d.varint()
+}
+
+// Int64 returns current field value as int64.
+func (d *Decoder) Int64() int64 {
+	return int64(d.Varint())
+}
+
+// Bool returns current field value as bool.
+func (d *Decoder) Bool() bool {
+	return d.Varint() != 0
+}
+
+// Bytes returns current length-delimited field value. Returned slice refers to
+// decoded data so caller must copy it if data can be modified later.
+func (d *Decoder) Bytes() []byte {
+	if !d.expect(WireBytes) {
+		return nil
+	}
+	return d.bytes()
+}
+
+// String returns current field value as string.
+func (d *Decoder) String() string {
+	return string(d.Bytes())
+}
+
+// Skip skips current field value.
+func (d *Decoder) Skip() {
+	switch d.wireType {
+	case WireVarint:
+		d.varint()
+	case WireBytes:
+		d.bytes()
+	case WireFixed64:
+		d.advance(8)
+	case WireFixed32:
+		d.advance(4)
+	default:
+		d.err = ErrWireType
+	}
+}
+
+func (d *Decoder) expect(wireType int) bool {
+	if d.err != nil {
+		return false
+	}
+	if d.wireType != wireType {
+		d.err = ErrWireType
+		return false
+	}
+	return true
+}
+
+func (d *Decoder) varint() uint64 {
+	x, n := binary.Uvarint(d.buf[d.pos:])
+	if n == 0 {
+		d.err = ErrTruncated
+		return 0
+	}
+	if n < 0 {
+		d.err = ErrOverflow
+		return 0
+	}
+	d.pos += n
+	return x
+}
+
+func (d *Decoder) bytes() []byte {
+	l := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	if l > uint64(len(d.buf)-d.pos) {
+		d.err = ErrTruncated
+		return nil
+	}
+	start := d.pos
+	d.pos += int(l)
+	return d.buf[start:d.pos]
+}
+
+func (d *Decoder) advance(n int) {
+	if len(d.buf)-d.pos < n {
+		d.err = ErrTruncated
+		return
+	}
+	d.pos += n
+}
+
+// SplitDelimited splits data containing length-delimited messages written by
+// Buffer.EncodeDelimited.
+func SplitDelimited(data []byte) ([][]byte, error) {
+	var msgs [][]byte
+	d := NewDecoder(data)
+	for d.pos < len(d.buf) {
+		msg := d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
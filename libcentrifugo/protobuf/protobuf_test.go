@@ -0,0 +1,80 @@
+package protobuf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	b := NewBuffer(nil)
+	b.EncodeString(1, "channel")
+	b.EncodeBool(2, true)
+	b.EncodeInt64(3, 1<<40)
+	b.EncodeBytes(4, []byte(`{"input":"test"}`))
+	b.EncodeString(5, "")
+	b.EncodeMessage(6, []byte{})
+
+	var str string
+	var flag bool
+	var num int64
+	var data []byte
+	var fields []int
+
+	d := NewDecoder(b.Bytes())
+	for d.Next() {
+		fields = append(fields, d.Field())
+		switch d.Field() {
+		case 1:
+			str = d.String()
+		case 2:
+			flag = d.Bool()
+		case 3:
+			num = d.Int64()
+		case 4:
+			data = d.Bytes()
+		default:
+			d.Skip()
+		}
+	}
+	assert.Equal(t, nil, d.Err())
+	assert.Equal(t, []int{1, 2, 3, 4, 6}, fields)
+	assert.Equal(t, "channel", str)
+	assert.Equal(t, true, flag)
+	assert.Equal(t, int64(1<<40), num)
+	assert.Equal(t, `{"input":"test"}`, string(data))
+}
+
+func TestDecodeErrors(t *testing.T) {
+	b := NewBuffer(nil)
+	b.EncodeString(1, "channel")
+	encoded := b.Bytes()
+
+	d := NewDecoder(encoded[:len(encoded)-1])
+	for d.Next() {
+		d.Skip()
+	}
+	assert.Equal(t, ErrTruncated, d.Err())
+
+	d = NewDecoder(encoded)
+	for d.Next() {
+		d.Bool()
+	}
+	assert.Equal(t, ErrWireType, d.Err())
+}
+
+func TestSplitDelimited(t *testing.T) {
+	b := NewBuffer(nil)
+	b.EncodeDelimited([]byte("first"))
+	b.EncodeDelimited([]byte{})
+	b.EncodeDelimited([]byte("second"))
+	msgs, err := SplitDelimited(b.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, "first", string(msgs[0]))
+	assert.Equal(t, "", string(msgs[1]))
+	assert.Equal(t, "second", string(msgs[2]))
+
+	_, err = SplitDelimited(b.Bytes()[:len(b.Bytes())-1])
+	assert.Equal(t, ErrTruncated, err)
+}
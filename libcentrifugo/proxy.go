@@ -0,0 +1,222 @@
+package libcentrifugo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/FZambia/go-logger"
+)
+
+// proxyHTTPClient used to send requests to proxy endpoints. Timeouts set for
+// every request separately.
+var proxyHTTPClient = &http.Client{}
+
+// proxyMaxReplySize is a maximum size of proxy endpoint reply body.
+const proxyMaxReplySize = 1 << 20
+
+// proxyStatusError returned when proxy endpoint replied with unexpected HTTP status.
+type proxyStatusError struct {
+	code int
+}
+
+func (e *proxyStatusError) Error() string {
+	return fmt.Sprintf("unexpected proxy response status: %d", e.code)
+}
+
+// proxyRejected returns whether proxy endpoint rejected request with 401 or 403
+// status as opposed to failed to process it.
+func proxyRejected(err error) bool {
+	if e, ok := err.(*proxyStatusError); ok {
+		return e.code == http.StatusUnauthorized || e.code == http.StatusForbidden
+	}
+	return false
+}
+
+// proxyRequest posts JSON encoded body to endpoint forwarding headers of client
+// connection request allowed in configuration and decodes JSON reply into result.
+func (app *Application) proxyRequest(endpoint string, timeout time.Duration, header http.Header, body interface{}, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	app.RLock()
+	proxyHeaders := app.config.ProxyHeaders
+	app.RUnlock()
+
+	for _, name := range proxyHeaders {
+		for _, value := range header[http.CanonicalHeaderKey(name)] {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	resp, err := proxyHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, proxyMaxReplySize))
+		return &proxyStatusError{resp.StatusCode}
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, proxyMaxReplySize)).Decode(result)
+}
+
+// connectProxyRequest is a body of request sent to connect proxy endpoint.
+type connectProxyRequest struct {
+	Client ConnID `json:"client"`
+}
+
+// ConnectProxyReply is a reply connect proxy endpoint must send to authenticate
+// connection. It has the same meaning as connection JWT claims.
+type ConnectProxyReply struct {
+	// User is ID of authenticated user, empty for anonymous connection.
+	User UserID `json:"user"`
+	// Info is optional additional information about connection.
+	Info json.RawMessage `json:"info,omitempty"`
+	// ExpireAt is Unix time connection expires at, 0 means connection never expires.
+	ExpireAt int64 `json:"expire_at,omitempty"`
+	// Channels client will be subscribed to on server side.
+	Channels []Channel `json:"channels,omitempty"`
+}
+
+// connectProxy asks backend to authenticate connection using headers (including
+// cookies) of client connection request. ErrUnauthorized returned if backend
+// rejected connection, other errors mean that client can retry later.
+func (app *Application) connectProxy(uid ConnID, header http.Header) (*ConnectProxyReply, error) {
+	app.RLock()
+	endpoint := app.config.ConnectProxyEndpoint
+	timeout := app.config.ConnectProxyTimeout
+	app.RUnlock()
+
+	var reply ConnectProxyReply
+	err := app.proxyRequest(endpoint, timeout, header, connectProxyRequest{Client: uid}, &reply)
+	if err != nil {
+		if proxyRejected(err) {
+			return nil, ErrUnauthorized
+		}
+		logger.ERROR.Println("connect proxy error:", err)
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// publishProxyRequest is a body of request sent to publish proxy endpoint. Data
+// which is not valid JSON (published by Protocol Buffers client) sent base64
+// encoded in Binary field.
+type publishProxyRequest struct {
+	Client  ConnID          `json:"client"`
+	User    UserID          `json:"user"`
+	Channel Channel         `json:"channel"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Binary  []byte          `json:"binary,omitempty"`
+}
+
+// PublishProxyReply is a reply publish proxy endpoint must send to decide what to
+// do with message client publishes. Empty reply accepts message as is.
+type PublishProxyReply struct {
+	// Error rejects message, it's sent to client as publish error.
+	Error string `json:"error,omitempty"`
+	// Data replaces data client published if set.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// publishProxy asks backend whether client can publish data into channel.
+// ErrPermissionDenied returned if backend rejected request with 401 or 403
+// status, other errors mean that backend failed to process request.
+func (app *Application) publishProxy(client ConnID, user UserID, ch Channel, data json.RawMessage, header http.Header) (*PublishProxyReply, error) {
+	app.RLock()
+	endpoint := app.config.PublishProxyEndpoint
+	timeout := app.config.PublishProxyTimeout
+	app.RUnlock()
+
+	req := publishProxyRequest{
+		Client:  client,
+		User:    user,
+		Channel: ch,
+	}
+	if json.Valid(data) {
+		req.Data = data
+	} else {
+		req.Binary = data
+	}
+	var reply PublishProxyReply
+	err := app.proxyRequest(endpoint, timeout, header, req, &reply)
+	if err != nil {
+		if proxyRejected(err) {
+			return nil, ErrPermissionDenied
+		}
+		logger.ERROR.Println("publish proxy error:", err)
+		return nil, err
+	}
+	return &reply, nil
+}
+
+// subscribeProxyRequest is a body of request sent to subscribe proxy endpoint.
+type subscribeProxyRequest struct {
+	Client  ConnID          `json:"client"`
+	User    UserID          `json:"user"`
+	Channel Channel         `json:"channel"`
+	Info    json.RawMessage `json:"info,omitempty"`
+}
+
+// SubscribeProxyReply is a reply subscribe proxy endpoint must send to authorize
+// subscription.
+type SubscribeProxyReply struct {
+	// Allow must be true to allow client to subscribe on channel.
+	Allow bool `json:"allow"`
+	// Info is optional channel info for connection, it's used in presence,
+	// join/leave messages and messages client publishes into channel.
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+// subscribeProxy asks backend whether client can subscribe on channel, info is
+// connection info client authenticated with. ErrPermissionDenied returned if
+// backend did not allow subscription, other errors mean that backend failed to
+// process request.
+func (app *Application) subscribeProxy(client ConnID, user UserID, ch Channel, info []byte, header http.Header) (*SubscribeProxyReply, error) {
+	app.RLock()
+	endpoint := app.config.SubscribeProxyEndpoint
+	timeout := app.config.SubscribeProxyTimeout
+	app.RUnlock()
+
+	req := subscribeProxyRequest{
+		Client:  client,
+		User:    user,
+		Channel: ch,
+	}
+	if len(info) > 0 {
+		req.Info = json.RawMessage(info)
+	}
+	var reply SubscribeProxyReply
+	err := app.proxyRequest(endpoint, timeout, header, req, &reply)
+	if err != nil {
+		if proxyRejected(err) {
+			return nil, ErrPermissionDenied
+		}
+		logger.ERROR.Println("subscribe proxy error:", err)
+		return nil, err
+	}
+	if !reply.Allow {
+		return nil, ErrPermissionDenied
+	}
+	return &reply, nil
+}
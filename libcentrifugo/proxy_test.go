@@ -0,0 +1,333 @@
+package libcentrifugo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func testProxyConnectCmd() clientCommand {
+	return clientCommand{
+		Method: "connect",
+		Params: []byte("{}"),
+	}
+}
+
+func TestClientConnectProxy(t *testing.T) {
+	expireAt := time.Now().Unix() + 60
+	var req connectProxyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "session=abc", r.Header.Get("Cookie"))
+		assert.Equal(t, "", r.Header.Get("X-Not-Forwarded"))
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(ConnectProxyReply{
+			User:     "user1",
+			Info:     json.RawMessage(`{"name":"John"}`),
+			ExpireAt: expireAt,
+			Channels: []Channel{"test#user1"},
+		})
+	}))
+	defer server.Close()
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = server.URL
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	c.header = http.Header{}
+	c.header.Set("Cookie", "session=abc")
+	c.header.Set("X-Not-Forwarded", "1")
+
+	resp, err := c.handleCmd(testProxyConnectCmd())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.clientError.err)
+	assert.Equal(t, c.UID, req.Client)
+	assert.Equal(t, true, c.authenticated)
+	assert.Equal(t, UserID("user1"), c.User)
+	assert.Equal(t, `{"name":"John"}`, string(c.defaultInfo))
+	assert.Equal(t, expireAt, c.expireAt)
+	body := resp.Body.(*ConnectBody)
+	assert.Equal(t, true, body.Expires)
+	assert.Equal(t, 1, len(body.Subscriptions))
+	assert.Equal(t, true, body.Subscriptions[0].Status)
+}
+
+func TestClientConnectProxyRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = server.URL
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	_, err = c.handleCmd(testProxyConnectCmd())
+	assert.Equal(t, ErrUnauthorized, err)
+	assert.Equal(t, false, c.authenticated)
+}
+
+func TestClientConnectProxyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = server.URL
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	resp, err := c.handleCmd(testProxyConnectCmd())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrUnauthorized, resp.clientError.err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+	assert.Equal(t, false, c.authenticated)
+}
+
+func TestClientConnectProxyTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = server.URL
+	app.config.ConnectProxyTimeout = 50 * time.Millisecond
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+
+	resp, err := c.handleCmd(testProxyConnectCmd())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+	assert.Equal(t, false, c.authenticated)
+}
+
+func TestClientRefreshProxy(t *testing.T) {
+	reply := ConnectProxyReply{User: "user1", ExpireAt: time.Now().Unix() + 60}
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "session=abc", r.Header.Get("Cookie"))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer server.Close()
+
+	app := testApp()
+	app.config.ConnectProxyEndpoint = server.URL
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	c.header = http.Header{}
+	c.header.Set("Cookie", "session=abc")
+	_, err = c.handleCmd(testProxyConnectCmd())
+	assert.Equal(t, nil, err)
+
+	reply.ExpireAt = time.Now().Unix() + 120
+	reply.Info = json.RawMessage(`{"name":"John"}`)
+	refresh := clientCommand{Method: "refresh", Params: []byte("{}")}
+	resp, err := c.handleCmd(refresh)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.clientError.err)
+	body := resp.Body.(*ConnectBody)
+	assert.Equal(t, true, body.Expires)
+	assert.Equal(t, false, body.Expired)
+	assert.True(t, body.TTL > 60)
+	assert.Equal(t, reply.ExpireAt, c.expireAt)
+	assert.Equal(t, `{"name":"John"}`, string(c.defaultInfo))
+
+	status = http.StatusInternalServerError
+	resp, err = c.handleCmd(refresh)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+
+	status = http.StatusOK
+	reply.User = "user2"
+	_, err = c.handleCmd(refresh)
+	assert.Equal(t, ErrUnauthorized, err)
+
+	status = http.StatusForbidden
+	_, err = c.handleCmd(refresh)
+	assert.Equal(t, ErrUnauthorized, err)
+}
+
+// testPublishProxyClient returns connected client subscribed on channel in
+// namespace with publish proxy enabled and Publish option off.
+func testPublishProxyClient(t *testing.T, endpoint string, sink chan []byte) *client {
+	app := testMemoryApp()
+	app.config.PublishProxyEndpoint = endpoint
+	app.config.Namespaces[0].Publish = false
+	app.config.Namespaces[0].PublishProxy = true
+	c, err := newClient(app, &testSession{sink: sink}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	_, err = c.handleCmd(testConnectJWTCmd(auth.ClientClaims{User: "user1"}))
+	assert.Equal(t, nil, err)
+	_, err = c.handleCmd(testSubscribeCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	return c
+}
+
+func TestClientPublishProxy(t *testing.T) {
+	var req publishProxyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(PublishProxyReply{
+			Data: json.RawMessage(`{"rewritten":true}`),
+		})
+	}))
+	defer server.Close()
+
+	sink := make(chan []byte, 16)
+	c := testPublishProxyClient(t, server.URL, sink)
+
+	resp, err := c.handleCmd(testPublishCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.clientError.err)
+	assert.Equal(t, true, resp.Body.(*PublishBody).Status)
+	assert.Equal(t, c.UID, req.Client)
+	assert.Equal(t, UserID("user1"), req.User)
+	assert.Equal(t, Channel("test:channel"), req.Channel)
+	assert.Equal(t, "{}", string(req.Data))
+
+	for {
+		var msg clientMessageResponse
+		err := json.Unmarshal(<-sink, &msg)
+		if err != nil || msg.Method != "message" {
+			continue
+		}
+		assert.Equal(t, `{"rewritten":true}`, string(*msg.Body.Data))
+		break
+	}
+}
+
+func TestPublishProxyBinary(t *testing.T) {
+	var req publishProxyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(PublishProxyReply{})
+	}))
+	defer server.Close()
+
+	app := testMemoryApp()
+	app.config.PublishProxyEndpoint = server.URL
+	_, err := app.publishProxy("client", "user1", "test:channel", []byte{0xff, 0x00}, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(req.Data))
+	assert.Equal(t, []byte{0xff, 0x00}, req.Binary)
+}
+
+func TestClientPublishProxyReject(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(PublishProxyReply{Error: "bad words"})
+	}))
+	defer server.Close()
+
+	c := testPublishProxyClient(t, server.URL, nil)
+	resp, err := c.handleCmd(testPublishCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bad words", resp.Error)
+	assert.Equal(t, errorAdviceFix, resp.Advice)
+	assert.Equal(t, false, resp.Body.(*PublishBody).Status)
+}
+
+func TestClientPublishProxyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	c := testPublishProxyClient(t, server.URL, nil)
+	resp, err := c.handleCmd(testPublishCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrPermissionDenied, resp.clientError.err)
+
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failingServer.Close()
+
+	c.app.config.PublishProxyEndpoint = failingServer.URL
+	resp, err = c.handleCmd(testPublishCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInternalServerError, resp.clientError.err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+}
+
+func TestClientPublishWithoutProxy(t *testing.T) {
+	c := testPublishProxyClient(t, "", nil)
+	c.app.config.Namespaces[0].PublishProxy = false
+	resp, err := c.handleCmd(testPublishCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrPermissionDenied, resp.clientError.err)
+}
+
+func testSubscribeProxyClient(t *testing.T, endpoint string) *client {
+	app := testMemoryApp()
+	app.config.SubscribeProxyEndpoint = endpoint
+	app.config.Namespaces[0].SubscribeProxy = true
+	c, err := newClient(app, &testSession{}, jsonClientEncoding)
+	assert.Equal(t, nil, err)
+	_, err = c.handleCmd(testConnectJWTCmd(auth.ClientClaims{
+		User: "user1",
+		Info: json.RawMessage(`{"name":"John"}`),
+	}))
+	assert.Equal(t, nil, err)
+	return c
+}
+
+func TestClientSubscribeProxy(t *testing.T) {
+	var req subscribeProxyRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(SubscribeProxyReply{
+			Allow: req.Channel == "test:allowed",
+			Info:  json.RawMessage(`{"role":"admin"}`),
+		})
+	}))
+	defer server.Close()
+
+	c := testSubscribeProxyClient(t, server.URL)
+
+	resp, err := c.handleCmd(testSubscribeCmd("test:allowed"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.clientError.err)
+	assert.Equal(t, true, resp.Body.(*SubscribeBody).Status)
+	assert.Equal(t, c.UID, req.Client)
+	assert.Equal(t, UserID("user1"), req.User)
+	assert.Equal(t, `{"name":"John"}`, string(req.Info))
+	assert.Equal(t, `{"role":"admin"}`, string(c.channelInfo["test:allowed"]))
+
+	resp, err = c.handleCmd(testSubscribeCmd("test:denied"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrPermissionDenied, resp.clientError.err)
+	assert.Equal(t, false, resp.Body.(*SubscribeBody).Status)
+	assert.Equal(t, 1, len(c.channels()))
+
+	// Channels without subscribe proxy option not sent to proxy.
+	req = subscribeProxyRequest{}
+	resp, err = c.handleCmd(testSubscribeCmd("channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, resp.clientError.err)
+	assert.Equal(t, Channel(""), req.Channel)
+}
+
+func TestClientSubscribeProxyError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	c := testSubscribeProxyClient(t, server.URL)
+	resp, err := c.handleCmd(testSubscribeCmd("test:channel"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ErrInternalServerError, resp.clientError.err)
+	assert.Equal(t, errorAdviceRetry, resp.Advice)
+	assert.Equal(t, 0, len(c.channels()))
+}
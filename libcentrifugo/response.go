@@ -125,13 +125,22 @@ type ConnectBody struct {
 	Expires bool   `json:"expires"`
 	Expired bool   `json:"expired"`
 	TTL     int64  `json:"ttl"`
+	// Subscriptions contains results of server-side subscriptions on channels
+	// listed in connection token.
+	Subscriptions []SubscribeBody `json:"subscriptions,omitempty"`
 }
 
 // SubscribeBody represents body of response in case of successful subscribe command.
+// Seq and Epoch describe current position in channel history – client must
+// keep them up to date with messages it receives to recover missed messages
+// on resubscribe. Last is UID of the last message in history for JSON clients
+// which still recover by message UID.
 type SubscribeBody struct {
 	Channel   Channel   `json:"channel"`
 	Status    bool      `json:"status"`
-	Last      MessageID `json:"last"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Epoch     string    `json:"epoch,omitempty"`
+	Last      MessageID `json:"last,omitempty"`
 	Messages  []Message `json:"messages"`
 	Recovered bool      `json:"recovered"`
 }
@@ -7,3 +7,22 @@ type session interface {
 	// Close closes the session with provided code and reason.
 	Close(status uint32, reason string) error
 }
+
+// batchingSession is a session which tells whether several messages queued for
+// client can be joined into one message sent to it. Messages joined for sessions
+// not implementing it when batching enabled.
+type batchingSession interface {
+	// batchMessages returns false if session must receive messages one by one.
+	batchMessages() bool
+}
+
+// preparedFrame is a frame of message prepared once for all connections message
+// broadcast to. Value is opaque, only session sending it knows what it is.
+type preparedFrame interface{}
+
+// preparedSession is a session which can send message frame prepared once
+// for all connections message broadcast to instead of framing it again.
+type preparedSession interface {
+	// SendPrepared sends prepared frame of message to session.
+	SendPrepared(message []byte, prepared preparedFrame) error
+}
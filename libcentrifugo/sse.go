@@ -0,0 +1,49 @@
+package libcentrifugo
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// sseReplyEvent is a name of SSE event with replies to commands client sent
+// in connection request.
+const sseReplyEvent = "reply"
+
+// sseEvent returns SSE event with encoded client response as data. Event named
+// after response method (message, join, leave etc.) so clients can listen for
+// events they are interested in, array of replies sent as reply event.
+func sseEvent(message []byte) []byte {
+	var event string
+	if len(message) > 0 && message[0] == arrayJSONPrefix {
+		event = sseReplyEvent
+	} else {
+		var resp struct {
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(message, &resp); err == nil {
+			event = resp.Method
+		}
+	}
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: ")
+		buf.WriteString(event)
+		buf.WriteByte('\n')
+	}
+	for _, line := range bytes.Split(message, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// SSEHandler called when new client connection comes to Server-Sent Events
+// endpoint. SSE is a unidirectional transport, see serveStream for how connection
+// parameters passed. SSE comment lines sent periodically to keep connection alive.
+// Messages never batched as every message sent as event named after its method.
+func (app *Application) SSEHandler(w http.ResponseWriter, r *http.Request) {
+	app.serveStream(w, r, "SSE", "text/event-stream; charset=utf-8", sseEvent, []byte(":ping\n\n"), false)
+}
@@ -0,0 +1,112 @@
+package libcentrifugo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/centrifugal/centrifugo/libcentrifugo/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// testReadSSEEvent reads next SSE event skipping comments, returns event name
+// and data.
+func testReadSSEEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		assert.Equal(t, nil, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != "" {
+				return event, data
+			}
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestSSEEvent(t *testing.T) {
+	assert.Equal(t, "event: message\ndata: {\"method\":\"message\"}\n\n", string(sseEvent([]byte(`{"method":"message"}`))))
+	assert.Equal(t, "event: reply\ndata: [{\"method\":\"connect\"}]\n\n", string(sseEvent([]byte(`[{"method":"connect"}]`))))
+	assert.Equal(t, "data: a\ndata: b\n\n", string(sseEvent([]byte("a\nb"))))
+}
+
+func TestSSEHandler(t *testing.T) {
+	app := testMemoryApp()
+	opts := DefaultMuxOptions
+	opts.HandlerFlags |= HandlerSSE
+	server := httptest.NewServer(DefaultMux(app, opts))
+	defer server.Close()
+
+	token, _ := auth.GenerateClientJWT("secret", auth.ClientClaims{User: "user1"})
+	connect, _ := json.Marshal(ConnectClientCommand{Token: token})
+	params := url.Values{}
+	params.Set("connect", string(connect))
+	params.Add("channel", "test:channel")
+	resp, err := http.Get(server.URL + "/connection/sse?" + params.Encode())
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	event, data := testReadSSEEvent(t, r)
+	assert.Equal(t, "reply", event)
+	var replies []clientResponse
+	err = json.Unmarshal([]byte(data), &replies)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(replies))
+	assert.Equal(t, "connect", replies[0].Method)
+	assert.Equal(t, "", replies[0].Error)
+	assert.Equal(t, "subscribe", replies[1].Method)
+	assert.Equal(t, "", replies[1].Error)
+
+	err = app.Publish(Channel("test:channel"), []byte(`{"input":"test"}`), "", nil)
+	assert.Equal(t, nil, err)
+	event, data = testReadSSEEvent(t, r)
+	assert.Equal(t, "message", event)
+	var msg clientMessageResponse
+	err = json.Unmarshal([]byte(data), &msg)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Channel("test:channel"), msg.Body.Channel)
+	assert.Equal(t, `{"input":"test"}`, string(*msg.Body.Data))
+}
+
+func TestSSEHandlerUnauthorized(t *testing.T) {
+	app := testMemoryApp()
+	server := httptest.NewServer(http.HandlerFunc(app.SSEHandler))
+	defer server.Close()
+
+	params := url.Values{}
+	params.Set("connect", `{"user":"user1","timestamp":"1","token":"bad"}`)
+	resp, err := http.PostForm(server.URL, params)
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+
+	event, _ := testReadSSEEvent(t, bufio.NewReader(resp.Body))
+	assert.Equal(t, "disconnect", event)
+}
+
+func TestSSEHandlerBadRequest(t *testing.T) {
+	app := testMemoryApp()
+	server := httptest.NewServer(http.HandlerFunc(app.SSEHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?connect=" + url.QueryEscape("{"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, _ := http.NewRequest("DELETE", server.URL, nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
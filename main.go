@@ -71,14 +71,22 @@ func handleSignals(app *libcentrifugo.Application) {
 	}
 }
 
-func listenHTTP(mux http.Handler, addr string, useSSL bool, sslCert, sslKey string, wg *sync.WaitGroup) {
+func listenHTTP(mux http.Handler, addr string, useSSL bool, sslCert, sslKey string, h2c bool, wg *sync.WaitGroup) {
 	defer wg.Done()
+	server := &http.Server{Addr: addr, Handler: mux}
+	if h2c {
+		// gRPC clients use HTTP/2 without TLS by default.
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
 	if useSSL {
-		if err := http.ListenAndServeTLS(addr, sslCert, sslKey, mux); err != nil {
+		if err := server.ListenAndServeTLS(sslCert, sslKey); err != nil {
 			logger.FATAL.Fatalln("ListenAndServe:", err)
 		}
 	} else {
-		if err := http.ListenAndServe(addr, mux); err != nil {
+		if err := server.ListenAndServe(); err != nil {
 			logger.FATAL.Fatalln("ListenAndServe:", err)
 		}
 	}
@@ -92,6 +100,10 @@ func Main() {
 	var port string
 	var address string
 	var debug bool
+	var prometheus bool
+	var sse bool
+	var httpStream bool
+	var httpPoll bool
 	var name string
 	var admin bool
 	var insecureAdmin bool
@@ -107,10 +119,12 @@ func Main() {
 	var sslCert string
 	var sslKey string
 	var apiPort string
+	var grpcAPIPort string
 	var adminPort string
 
 	var redisHost string
 	var redisPort string
+	var redisUser string
 	var redisPassword string
 	var redisDB string
 	var redisURL string
@@ -119,6 +133,15 @@ func Main() {
 	var redisAPINumShards int
 	var redisMasterName string
 	var redisSentinels string
+	var redisTLS bool
+	var redisTLSCA string
+	var redisTLSCert string
+	var redisTLSKey string
+	var redisTLSSkipVerify bool
+	var historyDir string
+	var natsURL string
+	var natsStore string
+	var natsConnectTimeout int
 
 	var rootCmd = &cobra.Command{
 		Use:   "",
@@ -128,6 +151,10 @@ func Main() {
 
 			viper.SetDefault("gomaxprocs", 0)
 			viper.SetDefault("debug", false)
+			viper.SetDefault("prometheus", false)
+			viper.SetDefault("sse", false)
+			viper.SetDefault("http_stream", false)
+			viper.SetDefault("http_poll", false)
 			viper.SetDefault("prefix", "")
 			viper.SetDefault("web", false)
 			viper.SetDefault("web_path", "")
@@ -147,6 +174,11 @@ func Main() {
 			viper.SetDefault("client_request_max_size", 65536)  // 64KB
 			viper.SetDefault("client_queue_max_size", 10485760) // 10MB
 			viper.SetDefault("client_queue_initial_capacity", 2)
+			viper.SetDefault("client_message_batching", false)
+			viper.SetDefault("client_message_batch_max_size", 65536) // 64KB
+			viper.SetDefault("websocket_compression", false)
+			viper.SetDefault("websocket_compression_level", 1)
+			viper.SetDefault("websocket_compression_min_size", 0)
 			viper.SetDefault("presence_ping_interval", 25)
 			viper.SetDefault("presence_expire_interval", 60)
 			viper.SetDefault("private_channel_prefix", "$")
@@ -158,9 +190,20 @@ func Main() {
 
 			viper.SetDefault("redis_connect_timeout", 1)
 			viper.SetDefault("redis_write_timeout", 1)
+			viper.SetDefault("nats_connect_timeout", 1)
 
 			viper.SetDefault("secret", "")
+			viper.SetDefault("grpc_api_key", "")
+			viper.SetDefault("token_rsa_public_key", "")
+			viper.SetDefault("token_ecdsa_public_key", "")
 			viper.SetDefault("connection_lifetime", 0)
+			viper.SetDefault("connect_proxy_endpoint", "")
+			viper.SetDefault("connect_proxy_timeout", 1)
+			viper.SetDefault("publish_proxy_endpoint", "")
+			viper.SetDefault("publish_proxy_timeout", 1)
+			viper.SetDefault("subscribe_proxy_endpoint", "")
+			viper.SetDefault("subscribe_proxy_timeout", 1)
+			viper.SetDefault("proxy_headers", libcentrifugo.DefaultConfig.ProxyHeaders)
 			viper.SetDefault("watch", false)
 			viper.SetDefault("publish", false)
 			viper.SetDefault("anonymous", false)
@@ -169,25 +212,35 @@ func Main() {
 			viper.SetDefault("history_lifetime", 0)
 			viper.SetDefault("recover", false)
 			viper.SetDefault("history_drop_inactive", false)
+			viper.SetDefault("publish_proxy", false)
+			viper.SetDefault("subscribe_proxy", false)
 			viper.SetDefault("namespaces", "")
 
 			viper.SetEnvPrefix("centrifugo")
 
 			bindEnvs := []string{
-				"debug", "engine", "insecure", "insecure_api", "web", "admin", "admin_password", "admin_secret",
+				"debug", "prometheus", "sse", "http_stream", "http_poll", "engine", "insecure", "insecure_api", "web", "admin", "admin_password", "admin_secret",
 				"insecure_web", "insecure_admin", "secret", "connection_lifetime", "watch", "publish", "anonymous",
 				"join_leave", "presence", "recover", "history_size", "history_lifetime", "history_drop_inactive",
-				"redis_host", "redis_port", "redis_url",
+				"redis_host", "redis_port", "redis_url", "redis_user", "redis_password", "redis_tls", "redis_tls_ca",
+				"redis_tls_cert", "redis_tls_key", "redis_tls_skip_verify", "token_rsa_public_key", "token_ecdsa_public_key",
+				"grpc_api_key", "nats_url", "nats_store", "nats_connect_timeout", "history_dir", "connect_proxy_endpoint", "connect_proxy_timeout",
+				"publish_proxy_endpoint", "publish_proxy_timeout", "publish_proxy",
+				"subscribe_proxy_endpoint", "subscribe_proxy_timeout", "subscribe_proxy",
+				"websocket_compression", "websocket_compression_level", "websocket_compression_min_size",
+				"client_message_batching", "client_message_batch_max_size",
 			}
 			for _, env := range bindEnvs {
 				viper.BindEnv(env)
 			}
 
 			bindPFlags := []string{
-				"port", "api_port", "admin_port", "address", "debug", "name", "admin", "insecure_admin", "web",
+				"port", "api_port", "grpc_api_port", "admin_port", "address", "debug", "prometheus", "sse", "http_stream", "http_poll", "name", "admin", "insecure_admin", "web",
 				"web_path", "insecure_web", "engine", "insecure", "insecure_api", "ssl", "ssl_cert", "ssl_key",
-				"log_level", "log_file", "redis_host", "redis_port", "redis_password", "redis_db", "redis_url",
+				"log_level", "log_file", "redis_host", "redis_port", "redis_user", "redis_password", "redis_db", "redis_url",
 				"redis_api", "redis_pool", "redis_api_num_shards", "redis_master_name", "redis_sentinels",
+				"redis_tls", "redis_tls_ca", "redis_tls_cert", "redis_tls_key", "redis_tls_skip_verify",
+				"nats_url", "nats_store", "nats_connect_timeout", "history_dir",
 			}
 			for _, flag := range bindPFlags {
 				viper.BindPFlag(flag, cmd.Flags().Lookup(flag))
@@ -250,48 +303,37 @@ func Main() {
 			var e libcentrifugo.Engine
 			switch viper.GetString("engine") {
 			case "memory":
-				e = libcentrifugo.NewMemoryEngine(app)
-			case "redis":
-				masterName := viper.GetString("redis_master_name")
-				sentinels := viper.GetString("redis_sentinels")
-				if masterName != "" && sentinels == "" {
-					logger.FATAL.Fatalf("Provide at least one Sentinel address")
+				dir := viper.GetString("history_dir")
+				if dir == "" {
+					e = libcentrifugo.NewMemoryEngine(app)
+					break
 				}
-
-				sentinelAddrs := []string{}
-				if sentinels != "" {
-					for _, addr := range strings.Split(sentinels, ",") {
-						addr := strings.TrimSpace(addr)
-						if addr == "" {
-							continue
-						}
-						if _, _, err := net.SplitHostPort(addr); err != nil {
-							logger.FATAL.Fatalf("Malformed Sentinel address: %s", addr)
-						}
-						sentinelAddrs = append(sentinelAddrs, addr)
-					}
+				historyStore, err := libcentrifugo.NewDiskHistoryStore(app, &libcentrifugo.DiskHistoryStoreConfig{
+					Dir: dir,
+				})
+				if err != nil {
+					logger.FATAL.Fatalln(err)
 				}
-
-				if len(sentinelAddrs) > 0 && masterName == "" {
-					logger.FATAL.Fatalln("Redis master name required when Sentinel used")
+				e = libcentrifugo.NewEngine(libcentrifugo.NewMemoryBroker(app), historyStore, libcentrifugo.NewMemoryPresenceStore())
+				logger.INFO.Println("Keeping history on disk in", dir)
+			case "redis":
+				e = libcentrifugo.NewShardedRedisEngine(app, redisEngineConfigs())
+			case "nats":
+				natsConf := &libcentrifugo.NatsBrokerConfig{
+					URL:            viper.GetString("nats_url"),
+					ConnectTimeout: time.Duration(viper.GetInt("nats_connect_timeout")) * time.Second,
 				}
-
-				redisConf := &libcentrifugo.RedisEngineConfig{
-					Host:           viper.GetString("redis_host"),
-					Port:           viper.GetString("redis_port"),
-					Password:       viper.GetString("redis_password"),
-					DB:             viper.GetString("redis_db"),
-					URL:            viper.GetString("redis_url"),
-					PoolSize:       viper.GetInt("redis_pool"),
-					API:            viper.GetBool("redis_api"),
-					NumAPIShards:   viper.GetInt("redis_api_num_shards"),
-					MasterName:     masterName,
-					SentinelAddrs:  sentinelAddrs,
-					ConnectTimeout: time.Duration(viper.GetInt("redis_connect_timeout")) * time.Second,
-					ReadTimeout:    time.Duration(viper.GetInt("node_ping_interval")*3+1) * time.Second,
-					WriteTimeout:   time.Duration(viper.GetInt("redis_write_timeout")) * time.Second,
+				broker := libcentrifugo.NewNatsBroker(app, natsConf)
+				switch viper.GetString("nats_store") {
+				case "memory":
+					logger.WARN.Println("NATS engine keeps history and presence in memory of each node, only use it with single node")
+					e = libcentrifugo.NewEngine(broker, libcentrifugo.NewMemoryHistoryStore(app), libcentrifugo.NewMemoryPresenceStore())
+				case "redis":
+					redisStore := libcentrifugo.NewShardedRedisEngine(app, redisEngineConfigs())
+					e = libcentrifugo.NewEngine(broker, redisStore, redisStore)
+				default:
+					logger.FATAL.Fatalln("Unknown NATS engine store: " + viper.GetString("nats_store"))
 				}
-				e = libcentrifugo.NewRedisEngine(app, redisConf)
 			default:
 				logger.FATAL.Fatalln("Unknown engine: " + viper.GetString("engine"))
 			}
@@ -356,6 +398,9 @@ func Main() {
 				adminPort = clientPort
 			}
 
+			// gRPC API is only served when port for it explicitly set.
+			grpcAPIPort = viper.GetString("grpc_api_port")
+
 			// portToHandlerFlags contains mapping between ports and handler flags
 			// to serve on this port.
 			portToHandlerFlags := map[string]libcentrifugo.HandlerFlag{}
@@ -364,12 +409,27 @@ func Main() {
 
 			portFlags = portToHandlerFlags[clientPort]
 			portFlags |= libcentrifugo.HandlerRawWS | libcentrifugo.HandlerSockJS
+			if viper.GetBool("sse") {
+				portFlags |= libcentrifugo.HandlerSSE
+			}
+			if viper.GetBool("http_stream") {
+				portFlags |= libcentrifugo.HandlerHTTPStream
+			}
+			if viper.GetBool("http_poll") {
+				portFlags |= libcentrifugo.HandlerHTTPPoll
+			}
 			portToHandlerFlags[clientPort] = portFlags
 
 			portFlags = portToHandlerFlags[apiPort]
 			portFlags |= libcentrifugo.HandlerAPI
 			portToHandlerFlags[apiPort] = portFlags
 
+			if grpcAPIPort != "" {
+				portFlags = portToHandlerFlags[grpcAPIPort]
+				portFlags |= libcentrifugo.HandlerGRPCAPI
+				portToHandlerFlags[grpcAPIPort] = portFlags
+			}
+
 			portFlags = portToHandlerFlags[adminPort]
 			if adminEnabled {
 				portFlags |= libcentrifugo.HandlerAdmin
@@ -377,6 +437,9 @@ func Main() {
 			if viper.GetBool("debug") {
 				portFlags |= libcentrifugo.HandlerDebug
 			}
+			if viper.GetBool("prometheus") {
+				portFlags |= libcentrifugo.HandlerPrometheus
+			}
 			portToHandlerFlags[adminPort] = portFlags
 
 			var wg sync.WaitGroup
@@ -398,7 +461,8 @@ func Main() {
 
 				logger.INFO.Printf("Start serving %s endpoints on %s\n", handlerFlags, addr)
 				wg.Add(1)
-				go listenHTTP(mux, addr, useSSL, sslCert, sslKey, &wg)
+				h2c := handlerFlags&libcentrifugo.HandlerGRPCAPI != 0
+				go listenHTTP(mux, addr, useSSL, sslCert, sslKey, h2c, &wg)
 			}
 			wg.Wait()
 		},
@@ -406,12 +470,16 @@ func Main() {
 	rootCmd.Flags().StringVarP(&port, "port", "p", "8000", "port to bind to")
 	rootCmd.Flags().StringVarP(&address, "address", "a", "", "address to listen on")
 	rootCmd.Flags().BoolVarP(&debug, "debug", "d", false, "debug mode - please, do not use it in production")
+	rootCmd.Flags().BoolVarP(&prometheus, "prometheus", "", false, "serve Prometheus metrics on /metrics endpoint of admin port")
+	rootCmd.Flags().BoolVarP(&sse, "sse", "", false, "serve Server-Sent Events endpoint on /connection/sse of client port")
+	rootCmd.Flags().BoolVarP(&httpStream, "http_stream", "", false, "serve newline delimited JSON HTTP streaming endpoint on /connection/http_stream of client port")
+	rootCmd.Flags().BoolVarP(&httpPoll, "http_poll", "", false, "serve HTTP long-polling endpoint on /connection/http_poll of client port")
 	rootCmd.Flags().StringVarP(&configFile, "config", "c", "config.json", "path to config file")
 	rootCmd.Flags().StringVarP(&name, "name", "n", "", "unique node name")
 	rootCmd.Flags().BoolVarP(&admin, "admin", "", false, "Enable admin socket")
 	rootCmd.Flags().BoolVarP(&web, "web", "w", false, "serve admin web interface application (warning: automatically enables admin socket)")
 	rootCmd.Flags().StringVarP(&webPath, "web_path", "", "", "optional path to web interface application")
-	rootCmd.Flags().StringVarP(&engn, "engine", "e", "memory", "engine to use: memory or redis")
+	rootCmd.Flags().StringVarP(&engn, "engine", "e", "memory", "engine to use: memory, redis or nats")
 	rootCmd.Flags().BoolVarP(&insecure, "insecure", "", false, "start in insecure client mode")
 	rootCmd.Flags().BoolVarP(&insecureAPI, "insecure_api", "", false, "use insecure API mode")
 	rootCmd.Flags().BoolVarP(&insecureWeb, "insecure_web", "", false, "use insecure web mode – no web password and web secret required for web interface (warning: automatically enables insecure_admin option)")
@@ -420,19 +488,30 @@ func Main() {
 	rootCmd.Flags().StringVarP(&sslCert, "ssl_cert", "", "", "path to an X509 certificate file")
 	rootCmd.Flags().StringVarP(&sslKey, "ssl_key", "", "", "path to an X509 certificate key")
 	rootCmd.Flags().StringVarP(&apiPort, "api_port", "", "", "port to bind api endpoints to (optional until this is required by your deploy setup)")
+	rootCmd.Flags().StringVarP(&grpcAPIPort, "grpc_api_port", "", "", "port to bind gRPC API service to, gRPC API disabled if not set")
 	rootCmd.Flags().StringVarP(&adminPort, "admin_port", "", "", "port to bind admin endpoints to (optional until this is required by your deploy setup)")
 	rootCmd.Flags().StringVarP(&logLevel, "log_level", "", "info", "set the log level: debug, info, error, critical, fatal or none")
 	rootCmd.Flags().StringVarP(&logFile, "log_file", "", "", "optional log file - if not specified all logs go to STDOUT")
-	rootCmd.Flags().StringVarP(&redisHost, "redis_host", "", "127.0.0.1", "redis host (Redis engine)")
-	rootCmd.Flags().StringVarP(&redisPort, "redis_port", "", "6379", "redis port (Redis engine)")
+	rootCmd.Flags().StringVarP(&historyDir, "history_dir", "", "", "directory to keep history in to survive restarts (Memory engine)")
+	rootCmd.Flags().StringVarP(&redisHost, "redis_host", "", "127.0.0.1", "redis host, comma separated list of hosts to shard channels over (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisPort, "redis_port", "", "6379", "redis port, one for all hosts or comma separated list (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisUser, "redis_user", "", "", "redis ACL username, Redis >= 6 (Redis engine)")
 	rootCmd.Flags().StringVarP(&redisPassword, "redis_password", "", "", "redis auth password (Redis engine)")
 	rootCmd.Flags().StringVarP(&redisDB, "redis_db", "", "0", "redis database (Redis engine)")
-	rootCmd.Flags().StringVarP(&redisURL, "redis_url", "", "", "redis connection URL (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisURL, "redis_url", "", "", "redis connection URL, comma separated list of URLs to shard channels over (Redis engine)")
 	rootCmd.Flags().BoolVarP(&redisAPI, "redis_api", "", false, "enable Redis API listener (Redis engine)")
 	rootCmd.Flags().IntVarP(&redisPool, "redis_pool", "", 256, "Redis pool size (Redis engine)")
 	rootCmd.Flags().IntVarP(&redisAPINumShards, "redis_api_num_shards", "", 0, "Number of shards for redis API queue (Redis engine)")
-	rootCmd.Flags().StringVarP(&redisMasterName, "redis_master_name", "", "", "Name of Redis master Sentinel monitors (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisMasterName, "redis_master_name", "", "", "Name of Redis master Sentinel monitors, comma separated list of names to shard channels over (Redis engine)")
 	rootCmd.Flags().StringVarP(&redisSentinels, "redis_sentinels", "", "", "Comma separated list of Sentinels (Redis engine)")
+	rootCmd.Flags().BoolVarP(&redisTLS, "redis_tls", "", false, "use TLS for connections to Redis, also enabled by rediss:// URL (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisTLSCA, "redis_tls_ca", "", "", "path to CA certificates file to verify Redis server (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisTLSCert, "redis_tls_cert", "", "", "path to client certificate file for Redis TLS (Redis engine)")
+	rootCmd.Flags().StringVarP(&redisTLSKey, "redis_tls_key", "", "", "path to client key file for Redis TLS (Redis engine)")
+	rootCmd.Flags().BoolVarP(&redisTLSSkipVerify, "redis_tls_skip_verify", "", false, "skip Redis server certificate verification, for testing only (Redis engine)")
+	rootCmd.Flags().StringVarP(&natsURL, "nats_url", "", "nats://127.0.0.1:4222", "comma separated list of NATS server URLs (NATS engine)")
+	rootCmd.Flags().StringVarP(&natsStore, "nats_store", "", "redis", "where to keep history and presence: redis or memory – memory is not shared between nodes so history recovery and presence only correct with single node (NATS engine)")
+	rootCmd.Flags().IntVarP(&natsConnectTimeout, "nats_connect_timeout", "", 1, "NATS connect timeout in seconds (NATS engine)")
 
 	var versionCmd = &cobra.Command{
 		Use:   "version",
@@ -479,6 +558,96 @@ func Main() {
 	rootCmd.Execute()
 }
 
+// splitCommaList splits comma separated configuration value skipping empty items.
+func splitCommaList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// redisEngineConfigs returns Redis engine options set in configuration for every
+// Redis shard. Shards set as comma separated lists of URLs, hosts, ports or Sentinel
+// master names, every list must have one value used for all shards or one value
+// per shard.
+func redisEngineConfigs() []*libcentrifugo.RedisEngineConfig {
+	masterName := viper.GetString("redis_master_name")
+	sentinels := viper.GetString("redis_sentinels")
+	if masterName != "" && sentinels == "" {
+		logger.FATAL.Fatalf("Provide at least one Sentinel address")
+	}
+
+	sentinelAddrs := splitCommaList(sentinels)
+	for _, addr := range sentinelAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			logger.FATAL.Fatalf("Malformed Sentinel address: %s", addr)
+		}
+	}
+
+	if len(sentinelAddrs) > 0 && masterName == "" {
+		logger.FATAL.Fatalln("Redis master name required when Sentinel used")
+	}
+
+	urls := splitCommaList(viper.GetString("redis_url"))
+	masterNames := splitCommaList(masterName)
+	hosts := splitCommaList(viper.GetString("redis_host"))
+	ports := splitCommaList(viper.GetString("redis_port"))
+
+	numShards := 1
+	for _, values := range [][]string{urls, masterNames, hosts, ports} {
+		if len(values) <= 1 {
+			continue
+		}
+		if numShards > 1 && len(values) != numShards {
+			logger.FATAL.Fatalln("Number of values in redis_url, redis_master_name, redis_host and redis_port must be 1 or the same for all of them")
+		}
+		numShards = len(values)
+	}
+
+	// shardValue returns value of comma separated list for shard, single value
+	// used for all shards.
+	shardValue := func(values []string, i int) string {
+		switch {
+		case len(values) == 0:
+			return ""
+		case len(values) == 1:
+			return values[0]
+		}
+		return values[i]
+	}
+
+	confs := make([]*libcentrifugo.RedisEngineConfig, numShards)
+	for i := 0; i < numShards; i++ {
+		confs[i] = &libcentrifugo.RedisEngineConfig{
+			Host:           shardValue(hosts, i),
+			Port:           shardValue(ports, i),
+			User:           viper.GetString("redis_user"),
+			Password:       viper.GetString("redis_password"),
+			DB:             viper.GetString("redis_db"),
+			URL:            shardValue(urls, i),
+			PoolSize:       viper.GetInt("redis_pool"),
+			API:            viper.GetBool("redis_api"),
+			NumAPIShards:   viper.GetInt("redis_api_num_shards"),
+			MasterName:     shardValue(masterNames, i),
+			SentinelAddrs:  sentinelAddrs,
+			UseTLS:         viper.GetBool("redis_tls"),
+			TLSCAFile:      viper.GetString("redis_tls_ca"),
+			TLSCertFile:    viper.GetString("redis_tls_cert"),
+			TLSKeyFile:     viper.GetString("redis_tls_key"),
+			TLSSkipVerify:  viper.GetBool("redis_tls_skip_verify"),
+			ConnectTimeout: time.Duration(viper.GetInt("redis_connect_timeout")) * time.Second,
+			ReadTimeout:    time.Duration(viper.GetInt("node_ping_interval")*3+1) * time.Second,
+			WriteTimeout:   time.Duration(viper.GetInt("redis_write_timeout")) * time.Second,
+		}
+	}
+	return confs
+}
+
 func main() {
 	Main()
 }